@@ -0,0 +1,143 @@
+#!/usr/bin/env bash
+
+# The bash integration, loaded with `eval "$(ai-functions shell-init bash)"`,
+# which defines _ai_bin after it. bash can't put a command on the next prompt
+# like zsh's print -z, so suggested commands go on the editing line by way of
+# a key binding: Alt-a asks about what's on the line and replaces it with the
+# command, or, on an empty line, brings back the last command `ai` suggested.
+
+# The last command suggested, for Alt-a to put on an empty line
+_AI_SUGGESTION=""
+
+function ai() {
+  # A missing API key is left to the go app, which knows the provider from the
+  # config too, and answers with an auth error record if it's needed
+  _ai_ask "$@" || return
+
+  if [ -n "$_AI_SUGGESTION" ]; then
+    history -s "$_AI_SUGGESTION"
+    echo "$_AI_SUGGESTION"
+    echo "ai: press Alt-a to edit it, or up for it from history" >&2
+  fi
+}
+
+# Ask the go app, printing a message or error it answers with, and leaving a
+# suggested command in _AI_SUGGESTION
+function _ai_ask() {
+  _AI_SUGGESTION=""
+
+  # The model comes from ~/.config/ai-functions/config.yaml unless
+  # OPENAI_API_MODEL says otherwise
+  local model_args=()
+  [ -n "${OPENAI_API_MODEL}" ] && model_args=(--model "${OPENAI_API_MODEL}")
+
+  local bin
+  bin=$(_ai_bin) || return
+
+  # Records of NUL terminated fields: the protocol version, an action and its
+  # payload, then `key=value` metadata up to an empty field. bash variables
+  # can't hold a NUL, so they're read field by field. What a tool prints, like
+  # a crawl summary, comes in message_part records as it's printed, which are
+  # shown as they arrive, then whole in the final record.
+  local field="" got="" action="" payload="" class="" last_part="" unexpected=""
+  local fields=()
+  while IFS= read -r -d '' field; do
+    got+="$field "
+    fields+=("$field")
+
+    # A record ends with the first empty field after its payload
+    (( ${#fields[@]} >= 4 )) && [ -z "$field" ] || continue
+
+    if [ "${fields[0]}" != "1" ]; then
+      unexpected=1
+    elif [ "${fields[1]}" = "message_part" ]; then
+      printf '%s' "${fields[2]}"
+      last_part="${fields[2]}"
+    else
+      action="${fields[1]}"
+      payload="${fields[2]}"
+      class=""
+      for field in "${fields[@]:3}"; do
+        [[ "$field" == class=* ]] && class="${field#class=}"
+      done
+    fi
+    fields=()
+  done < <("$bin" ask --output_format nul --shell bash "${model_args[@]}" -- "$@")
+  wait $!
+  local go_status=$?
+  # Whatever came after the last NUL, like a panic
+  got+="$field"
+
+  if [ -n "$unexpected" ] || [ -z "$action" ]; then
+    if [ -z "$unexpected" ] && ! [ "$go_status" = "0" ]; then
+      echo "initial call to openai failure: $got" >&2
+    else
+      echo "ai errored - received unexpected response from go app: $got" >&2
+    fi
+    false
+    return
+  fi
+
+  # What's been shown a piece at a time needn't be shown again, only ended
+  if [ -n "$last_part" ]; then
+    [[ "$last_part" == *$'\n' ]] || echo
+    [[ "$action" == info || "$action" == message ]] && return
+  fi
+
+  case "$action" in
+    printz)
+      _AI_SUGGESTION="$payload"
+      ;;
+    info|message)
+      printf '%s\n' "$payload"
+      ;;
+    error)
+      _ai_error "$class" "$payload"
+      false
+      ;;
+    *)
+      echo "ai errored - received unexpected response from go app: $action $payload" >&2
+      false
+      ;;
+  esac
+}
+
+# Alt-a: ask about the editing line and put the suggested command in its
+# place, or put the last suggestion on an empty line
+function _ai_readline() {
+  if [ -n "$READLINE_LINE" ]; then
+    _ai_ask "$READLINE_LINE" || return
+  fi
+
+  if [ -n "$_AI_SUGGESTION" ]; then
+    READLINE_LINE="$_AI_SUGGESTION"
+    READLINE_POINT=${#READLINE_LINE}
+  fi
+}
+
+# Only interactive shells have a line to edit
+if [[ $- == *i* ]]; then
+  bind -x '"\ea": _ai_readline'
+fi
+
+# Explain an error record's message, with a hint for the classes there's
+# something to be done about
+function _ai_error() {
+  local class="$1"
+  echo "ai: $2" >&2
+  case "$class" in
+    auth) echo "ai: check the API key for your provider, ex OPENAI_API_KEY" >&2 ;;
+    rate_limit) echo "ai: rate limited, try again in a bit" >&2 ;;
+    context_length) echo "ai: that's too much for the model, try piping in less" >&2 ;;
+    network) echo "ai: unable to reach the api, check your connection or proxy" >&2 ;;
+    timeout) echo "ai: raise timeouts in the config if it needs longer" >&2 ;;
+    budget) echo "ai: see \`ai-functions usage\` for what's been spent" >&2 ;;
+  esac
+}
+
+# Manage the sessions ai remembers follow ups in: list, resume, export, clear
+function ai-session() {
+  local bin
+  bin=$(_ai_bin) || return
+  "$bin" session "$@"
+}
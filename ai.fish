@@ -0,0 +1,146 @@
+#!/usr/bin/env fish
+
+# The fish integration, loaded with `ai-functions shell-init fish | source`,
+# which defines _ai_bin after it. fish can't put a command on the next prompt
+# like zsh's print -z, so suggested commands go on the editing line by way of
+# a key binding: Alt-a asks about what's on the line and replaces it with the
+# command, or, on an empty line, brings back the last command `ai` suggested.
+
+# The last command suggested, for Alt-a to put on an empty line
+set -g _ai_suggestion ""
+
+function ai
+  # A missing API key is left to the go app, which knows the provider from the
+  # config too, and answers with an auth error record if it's needed
+  _ai_ask $argv; or return
+
+  if test -n "$_ai_suggestion"
+    echo $_ai_suggestion
+    echo "ai: press Alt-a to edit it" >&2
+  end
+end
+
+# Ask the go app, printing a message or error it answers with, and leaving a
+# suggested command in _ai_suggestion
+function _ai_ask
+  set -g _ai_suggestion ""
+
+  set -l bin (_ai_bin); or return
+
+  # The model comes from ~/.config/ai-functions/config.yaml unless
+  # OPENAI_API_MODEL says otherwise
+  set -l model_args
+  test -n "$OPENAI_API_MODEL"; and set model_args --model $OPENAI_API_MODEL
+
+  # Records of NUL terminated fields: the protocol version, an action and its
+  # payload, then `key=value` metadata up to an empty field. What a tool
+  # prints, like a crawl summary, comes in message_part records as it's
+  # printed, which are shown as they arrive, then whole in the final record.
+  set -l field ""
+  set -l got ""
+  set -l action ""
+  set -l payload ""
+  set -l class ""
+  set -l last_part ""
+  set -l unexpected ""
+  set -l fields
+  $bin ask --output_format nul --shell fish $model_args -- $argv | while read -z field
+    set got "$got$field "
+    set -a fields $field
+
+    # A record ends with the first empty field after its payload
+    test (count $fields) -ge 4; and test -z "$field"; or continue
+
+    if test "$fields[1]" != 1
+      set unexpected 1
+    else if test "$fields[2]" = message_part
+      printf '%s' $fields[3]
+      set last_part $fields[3]
+    else
+      set action $fields[2]
+      set payload $fields[3]
+      set class ""
+      for meta in $fields[4..-1]
+        string match -q 'class=*' -- $meta; and set class (string replace 'class=' '' -- $meta)
+      end
+    end
+    set fields
+  end
+  set -l go_status $pipestatus[1]
+  # Whatever came after the last NUL, like a panic
+  set got "$got$field"
+
+  if test -n "$unexpected"; or test -z "$action"
+    if test -z "$unexpected"; and test "$go_status" != 0
+      echo "initial call to openai failure: $got" >&2
+    else
+      echo "ai errored - received unexpected response from go app: $got" >&2
+    end
+    return 1
+  end
+
+  # What's been shown a piece at a time needn't be shown again, only ended
+  if test -n "$last_part"
+    string match -q '*'\n -- "$last_part"; or echo
+    contains -- $action info message; and return
+  end
+
+  switch $action
+    case printz
+      set -g _ai_suggestion $payload
+    case info message
+      printf '%s\n' $payload
+    case error
+      _ai_error $class $payload
+      return 1
+    case '*'
+      echo "ai errored - received unexpected response from go app: $action $payload" >&2
+      return 1
+  end
+end
+
+# Alt-a: ask about the editing line and put the suggested command in its
+# place, or put the last suggestion on an empty line
+function _ai_commandline
+  set -l line (commandline)
+  if test -n "$line"
+    _ai_ask "$line"
+  end
+
+  if test -n "$_ai_suggestion"
+    commandline -r -- $_ai_suggestion
+  end
+  commandline -f repaint
+end
+
+# Only interactive shells have a line to edit
+if status is-interactive
+  bind \ea _ai_commandline
+  bind -M insert \ea _ai_commandline
+end
+
+# Explain an error record's message, with a hint for the classes there's
+# something to be done about
+function _ai_error
+  echo "ai: $argv[2]" >&2
+  switch $argv[1]
+    case auth
+      echo "ai: check the API key for your provider, ex OPENAI_API_KEY" >&2
+    case rate_limit
+      echo "ai: rate limited, try again in a bit" >&2
+    case context_length
+      echo "ai: that's too much for the model, try piping in less" >&2
+    case network
+      echo "ai: unable to reach the api, check your connection or proxy" >&2
+    case timeout
+      echo "ai: raise timeouts in the config if it needs longer" >&2
+    case budget
+      echo "ai: see `ai-functions usage` for what's been spent" >&2
+  end
+end
+
+# Manage the sessions ai remembers follow ups in: list, resume, export, clear
+function ai-session
+  set -l bin (_ai_bin); or return
+  $bin session $argv
+end
@@ -0,0 +1,262 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+type AgentOptions struct {
+	// The most times the model will be called. 1 is a single shot.
+	MaxSteps int
+	// Write a plain message, or the info tool's text, out as it arrives
+	Stream bool
+	// Earlier exchanges of the user's session, to go ahead of the new prompt
+	History []map[string]any
+	// Content piped in along with the prompt. If it's too big to read at
+	// once, notes taken on it are sent instead.
+	Context string
+	// Run the tool the model settles on, like gen_image, right here, and write
+	// what it printed as a message, rather than handing it to the shell
+	RunTools bool
+}
+
+// Run the primary flow as a loop. Tools whose results the model can use, like
+// crawl_web, are run right here and their results are fed back to the model as
+// role: tool messages, until it settles on an answer like printz or a message,
+// or until MaxSteps is hit. The answer is handled like HandlePrimaryResponse
+// does, an error in it coming back already reported. If the model still wants
+// to crawl on its last step, that crawl_web line is what gets written, and the
+// shell can run it as before.
+func RunPrimaryAgent(ctx context.Context, model string, userInput string, systemContent string, url string, opts AgentOptions, w io.Writer) (*OpenAICompletionResponse, error) {
+	provider, err := NewProvider(url)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Context != "" {
+		notes, err := condense(ctx, provider, model, userInput, opts.Context)
+		if err != nil {
+			return nil, err
+		}
+		userInput = withContext(userInput, notes)
+	}
+
+	prompt := buildPrimaryPrompt(userInput, model, systemContent, opts.History)
+
+	maxSteps := opts.MaxSteps
+	if maxSteps < 1 {
+		maxSteps = 1
+	}
+
+	for step := 1; ; step++ {
+		// Content is written as it arrives, up until a tool call like printz
+		// starts, which makes it a preamble. The info tool's text is the
+		// answer once info's been called, and is written as it arrives too.
+		content := &messageStream{w: w, action: "message"}
+		info := &messageStream{w: w, action: "info"}
+		gate := &contentGate{write: content.write, onStop: func() { content.end("", nil) }}
+		handler := StreamHandler{}
+		if opts.Stream {
+			writeInfo := firstToolCallFieldWriter(info, "info", "str")
+			handler.OnContent = gate.content
+			handler.OnToolCall = func(name string, argumentsSoFar string) {
+				gate.toolCall()
+				writeInfo(name, argumentsSoFar)
+			}
+		}
+
+		if err := checkCompletionBudget("This request", model, prompt); err != nil {
+			return nil, err
+		}
+
+		resp, err := streamChatCompletion(ctx, provider, prompt, handler)
+		if err != nil {
+			return nil, err
+		}
+		recordCompletionUsage("primary", model, resp)
+
+		toolCalls := getToolCalls(*resp)
+		if step < maxSteps && getErrorMessage(*resp) == "" && allAgentRunnable(toolCalls) {
+			if gate.answered() {
+				content.end("", nil)
+			}
+			if info.started {
+				info.end("", nil)
+			}
+			prompt["messages"] = append(prompt["messages"].([]map[string]any), runAgentToolCalls(ctx, model, url, *resp, toolCalls)...)
+			continue
+		}
+
+		if gate.answered() {
+			if getErrorMessage(*resp) == "" && getToolcallFunctionName(*resp) == "message" {
+				content.end(getMessageContent(*resp), map[string]string{})
+				return resp, nil
+			}
+			content.end("", nil)
+		}
+
+		if info.started {
+			if getErrorMessage(*resp) == "" && getToolcallFunctionName(*resp) == "info" {
+				arguments := getToolcallArguments(*resp)
+				info.end(infoTool{}.Payload(arguments), map[string]string{"arguments": arguments})
+				return resp, nil
+			}
+			info.end("", nil)
+		}
+
+		if opts.RunTools && getErrorMessage(*resp) == "" {
+			if name, arguments := getToolcallFunctionName(*resp), getToolcallArguments(*resp); isRunnableTool(name) && json.Valid([]byte(arguments)) {
+				return resp, runAnswerTool(ctx, name, arguments, w)
+			}
+		}
+
+		return resp, HandlePrimaryResponse(*resp, w)
+	}
+}
+
+// Write field of the first tool call's arguments to stream as it arrives, if
+// that call is to toolName. Only the first call is answered with, so the
+// pieces of any others are left out.
+func firstToolCallFieldWriter(stream *messageStream, toolName string, field string) func(name string, argumentsSoFar string) {
+	first := ""
+	seen := ""
+	written := 0
+	return func(name string, argumentsSoFar string) {
+		if first == "" {
+			first = name
+		}
+		// A later call starts its arguments over
+		if first != toolName || name != toolName || !strings.HasPrefix(argumentsSoFar, seen) {
+			return
+		}
+		seen = argumentsSoFar
+
+		value := partialJSONString(argumentsSoFar, field)
+		if len(value) > written {
+			stream.write(value[written:])
+			written = len(value)
+		}
+	}
+}
+
+// Whether the shell would hand name back to the go app to run
+func isRunnableTool(name string) bool {
+	tool, ok := lookupTool(name)
+	if !ok {
+		return false
+	}
+	_, runnable := tool.(RunnableTool)
+	return runnable
+}
+
+// Run the tool the model answered with, writing what it printed as a message
+// record. In the structured formats what it prints goes out as it's printed
+// too, as message_part records, so a long crawl summary doesn't sit unseen
+// until it's done. A failure is written as an error record, and returned
+// reported.
+func runAnswerTool(ctx context.Context, name string, arguments string, w io.Writer) error {
+	var output bytes.Buffer
+	stream := &messageStream{w: w, action: "message"}
+
+	var out io.Writer = &output
+	if outputFormat != FormatPrefix {
+		out = io.MultiWriter(&output, stream)
+	}
+
+	if err := RunTool(ctx, name, arguments, out); err != nil {
+		return report(w, err)
+	}
+
+	payload := strings.TrimRight(output.String(), "\n")
+	metadata := map[string]string{"tool": name, "arguments": arguments}
+	if stream.started {
+		stream.end(payload, metadata)
+		return nil
+	}
+
+	writeRecord(w, Record{Action: "message", Payload: payload, Metadata: metadata})
+	return nil
+}
+
+// What separates the prompt from content piped in along with it
+const contextHeading = "\n\nADDITIONAL CONTEXT: "
+
+// The prompt with piped in content added on, the way the shell used to add it
+func withContext(userInput string, piped string) string {
+	if piped == "" {
+		return userInput
+	}
+	return userInput + contextHeading + piped
+}
+
+// Whether every one of the tool calls can be run in the loop, with its result
+// going back to the model rather than to the user
+func allAgentRunnable(toolCalls []translatedToolCall) bool {
+	if len(toolCalls) == 0 {
+		return false
+	}
+
+	for _, toolCall := range toolCalls {
+		if toolCall.Name != "crawl_web" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Run the tool calls, returning the assistant's message followed by one
+// role: tool message per call with its result
+func runAgentToolCalls(ctx context.Context, model string, url string, resp OpenAICompletionResponse, toolCalls []translatedToolCall) []map[string]any {
+	var assistantToolCalls []map[string]any
+	for _, toolCall := range toolCalls {
+		assistantToolCalls = append(assistantToolCalls, map[string]any{
+			"id":       toolCall.Id,
+			"type":     "function",
+			"function": map[string]any{"name": toolCall.Name, "arguments": toolCall.Arguments},
+		})
+	}
+
+	assistantMessage := map[string]any{"role": "assistant", "tool_calls": assistantToolCalls}
+	if content := getMessageContent(resp); content != "" {
+		assistantMessage["content"] = content
+	}
+
+	messages := []map[string]any{assistantMessage}
+	for _, toolCall := range toolCalls {
+		messages = append(messages, map[string]any{
+			"role":         "tool",
+			"tool_call_id": toolCall.Id,
+			"content":      runAgentCrawlWeb(ctx, model, url, toolCall.Arguments),
+		})
+	}
+
+	return messages
+}
+
+// Crawl and extract for the model. Failures are reported back to it as the
+// result, so it can try another page or answer without one.
+func runAgentCrawlWeb(ctx context.Context, model string, url string, arguments string) string {
+	resp, err := CrawlWeb(ctx, model, arguments, url)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "crawl failed:", err)
+		return fmt.Sprintf("crawl_web failed: %s", err)
+	}
+
+	result, err := getCrawlWebResult(*resp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "crawl failed:", err)
+		return fmt.Sprintf("crawl_web failed: %s", err)
+	}
+
+	return result
+}
@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Answers each request with the next of responses, recording the requests
+func sequenceServer(t *testing.T, responses []string) (*httptest.Server, *[]map[string]any) {
+	var requests []map[string]any
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBytes, _ := io.ReadAll(r.Body)
+		var reqBody map[string]any
+		json.Unmarshal(reqBytes, &reqBody)
+		requests = append(requests, reqBody)
+
+		if len(requests) > len(responses) {
+			t.Errorf("unexpected request #%d: %s", len(requests), string(reqBytes))
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(responses[len(requests)-1]))
+	}))
+
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// Swap out the page fetcher so crawls don't hit the web
+func stubFetchPage(t *testing.T, page string) {
+	previous := fetchPage
+	fetchPage = func(ctx context.Context, url string) (*WebPage, error) {
+		return &WebPage{URL: url, Markdown: page}, nil
+	}
+	t.Cleanup(func() { fetchPage = previous })
+}
+
+const agentCrawlResponse = `{"choices": [{"message": {"tool_calls": [{
+	"id": "call_crawl",
+	"type": "function",
+	"function": {"name": "crawl_web", "arguments": "{\"url\": \"https://bbc.com\", \"purpose\": \"first headline\"}"}
+}]}}]}`
+
+const agentReportResponse = `{"choices": [{"message": {"tool_calls": [{
+	"id": "call_report",
+	"type": "function",
+	"function": {"name": "report_information", "arguments": "{\"str\": \"Big news today\"}"}
+}]}}]}`
+
+func TestRunPrimaryAgent_FeedsCrawlBack(t *testing.T) {
+	stubFetchPage(t, "BBC homepage: Big news today")
+	t.Setenv("AI_PROVIDER", "openai")
+
+	server, requests := sequenceServer(t, []string{
+		agentCrawlResponse,
+		agentReportResponse,
+		`{"choices": [{"message": {"tool_calls": [{"id": "call_printz", "type": "function", "function": {"name": "printz", "arguments": "{\"command\": \"echo Big news today\"}"}}]}}]}`,
+	})
+
+	var outputBuffer bytes.Buffer
+	_, err := RunPrimaryAgent(context.Background(), "gpt-4o", "echo the first headline from bbc.com", "Linux", server.URL, AgentOptions{MaxSteps: 5}, &outputBuffer)
+	if err != nil {
+		t.Fatal("agent errored:", err)
+	}
+
+	if output := outputBuffer.String(); output != "printz echo Big news today\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+
+	if len(*requests) != 3 {
+		t.Fatalf("expected primary, crawl and primary requests, got %d", len(*requests))
+	}
+
+	// The final primary request should carry the crawl's findings back
+	messages := (*requests)[2]["messages"].([]any)
+	toolMessage := messages[len(messages)-1].(map[string]any)
+	if toolMessage["role"] != "tool" || toolMessage["tool_call_id"] != "call_crawl" || toolMessage["content"] != "Big news today" {
+		t.Errorf("unexpected tool message: %v", toolMessage)
+	}
+
+	assistantMessage := messages[len(messages)-2].(map[string]any)
+	if assistantMessage["role"] != "assistant" || assistantMessage["tool_calls"] == nil {
+		t.Errorf("unexpected assistant message: %v", assistantMessage)
+	}
+}
+
+func TestRunPrimaryAgent_StepLimit(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+
+	server, requests := sequenceServer(t, []string{agentCrawlResponse})
+
+	var outputBuffer bytes.Buffer
+	_, err := RunPrimaryAgent(context.Background(), "gpt-4o", "what is the first headline from bbc.com?", "Linux", server.URL, AgentOptions{MaxSteps: 1}, &outputBuffer)
+	if err != nil {
+		t.Fatal("agent errored:", err)
+	}
+
+	// Out of steps, the crawl is left to the shell like before
+	want := "crawl_web {\"url\": \"https://bbc.com\", \"purpose\": \"first headline\"}\n"
+	if output := outputBuffer.String(); output != want {
+		t.Errorf("unexpected output: %q", output)
+	}
+
+	if len(*requests) != 1 {
+		t.Errorf("expected a single request, got %d", len(*requests))
+	}
+}
+
+func TestRunPrimaryAgent_RunTools(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "ai-tool-deploy", deployStatusPlugin, 0755)
+	discoverWithPath(t, dir)
+	useOutputFormat(t, FormatJSON)
+	t.Setenv("AI_PROVIDER", "openai")
+
+	server, _ := sequenceServer(t, []string{
+		`{"choices": [{"message": {"tool_calls": [{"id": "call_deploy", "type": "function", "function": {"name": "deploy_status", "arguments": "{\"service\": \"api\"}"}}]}}]}`,
+		`{"choices": [{"message": {"tool_calls": [{"id": "call_printz", "type": "function", "function": {"name": "printz", "arguments": "{\"command\": \"ls\"}"}}]}}]}`,
+	})
+
+	// The plugin runs right here, and only what it printed comes back, as it
+	// prints it and then whole
+	var outputBuffer bytes.Buffer
+	_, err := RunPrimaryAgent(context.Background(), "gpt-4o", "how's the api deploy going?", "Linux", server.URL, AgentOptions{MaxSteps: 5, RunTools: true}, &outputBuffer)
+	if err != nil {
+		t.Fatal("agent errored:", err)
+	}
+
+	want := `{"version":1,"action":"message_part","payload":"deploying, given {\"service\": \"api\"}\n"}` + "\n" +
+		`{"version":1,"action":"message","payload":"deploying, given {\"service\": \"api\"}","metadata":{"arguments":"{\"service\": \"api\"}","streamed":"true","tool":"deploy_status"}}` + "\n"
+	if outputBuffer.String() != want {
+		t.Errorf("expected the plugin's output as a message, got %s", outputBuffer.String())
+	}
+
+	// A command is still the shell's to put on the command line
+	outputBuffer.Reset()
+	if _, err := RunPrimaryAgent(context.Background(), "gpt-4o", "list files", "Linux", server.URL, AgentOptions{MaxSteps: 5, RunTools: true}, &outputBuffer); err != nil {
+		t.Fatal("agent errored:", err)
+	}
+	if !strings.Contains(outputBuffer.String(), `"action":"printz","payload":"ls"`) {
+		t.Errorf("expected a printz record, got %s", outputBuffer.String())
+	}
+}
+
+func TestSystemInfo(t *testing.T) {
+	info := systemInfo("fish")
+	if !strings.HasSuffix(info, "\nShell: fish") || len(info) <= len("\nShell: fish") {
+		t.Errorf("expected the system, then the shell, got %q", info)
+	}
+}
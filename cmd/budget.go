@@ -0,0 +1,174 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// Dollars an API key may spend, 0 for no limit
+type BudgetLimits struct {
+	Daily   float64 `mapstructure:"daily" yaml:"daily,omitempty"`
+	Monthly float64 `mapstructure:"monthly" yaml:"monthly,omitempty"`
+}
+
+// Limits on spend, checked against the usage ledger before each call
+type BudgetConfig struct {
+	// Every API key's limits, unless it has its own under keys
+	Daily   float64 `mapstructure:"daily" yaml:"daily,omitempty"`
+	Monthly float64 `mapstructure:"monthly" yaml:"monthly,omitempty"`
+	// Calls estimated to cost more than this many dollars are confirmed first
+	ConfirmAbove float64 `mapstructure:"confirm_above" yaml:"confirm_above"`
+	// Limits for particular API keys, by the fingerprint `ai usage` shows
+	Keys map[string]BudgetLimits `mapstructure:"keys" yaml:"keys,omitempty"`
+}
+
+// The limits for the key with fingerprint
+func (b BudgetConfig) limitsFor(fingerprint string) BudgetLimits {
+	if limits, ok := b.Keys[fingerprint]; ok {
+		return limits
+	}
+	return BudgetLimits{Daily: b.Daily, Monthly: b.Monthly}
+}
+
+// What's returned when a call is refused for its cost
+var errOverBudget = errors.New("over budget")
+
+// Identifies an API key in the ledger and the config without giving it away
+func keyFingerprint(apiKey string) string {
+	if apiKey == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:4])
+}
+
+// The API key the provider sends, if it sends one
+func providerAPIKey(provider Provider) string {
+	switch p := provider.(type) {
+	case *OpenAIProvider:
+		return p.ApiKey
+	case *AnthropicProvider:
+		return p.ApiKey
+	case *AzureProvider:
+		return p.ApiKey
+	case *GeminiProvider:
+		return p.ApiKey
+	}
+	return ""
+}
+
+// The fingerprint of the selected provider's API key
+func currentKeyFingerprint() string {
+	provider, err := NewProvider("")
+	if err != nil {
+		return ""
+	}
+	return keyFingerprint(providerAPIKey(provider))
+}
+
+// Ask the user at the terminal, since stdout belongs to the shell. With no
+// terminal to ask at, the answer is no. A var so tests can answer.
+var confirmSpend = func(question string) bool {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	defer tty.Close()
+
+	fmt.Fprintf(tty, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(tty).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// Check a call estimated to cost estimate against the budget before it's made.
+// A call that would go over the current key's daily or monthly limit, or that
+// costs more than confirm_above, goes ahead only if the user says so.
+func checkBudget(what string, estimate float64) error {
+	budget := activeConfig.Budget
+	fingerprint := currentKeyFingerprint()
+	limits := budget.limitsFor(fingerprint)
+
+	var reasons []string
+
+	if limits.Daily > 0 || limits.Monthly > 0 {
+		today, month, err := spentBy(fingerprint, time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to read usage ledger, skipping the budget check:", err)
+		} else {
+			if limits.Daily > 0 && today+estimate > limits.Daily {
+				reasons = append(reasons, fmt.Sprintf("today's spend would be $%.2f of the $%.2f daily budget", today+estimate, limits.Daily))
+			}
+			if limits.Monthly > 0 && month+estimate > limits.Monthly {
+				reasons = append(reasons, fmt.Sprintf("this month's spend would be $%.2f of the $%.2f monthly budget", month+estimate, limits.Monthly))
+			}
+		}
+	}
+
+	if len(reasons) == 0 && (budget.ConfirmAbove <= 0 || estimate <= budget.ConfirmAbove) {
+		return nil
+	}
+
+	question := fmt.Sprintf("%s is estimated to cost $%.2f", what, estimate)
+	if len(reasons) > 0 {
+		question += ", and " + strings.Join(reasons, ", and ")
+	}
+
+	if confirmSpend(question + ". Go ahead?") {
+		return nil
+	}
+	return classifyf(ErrBudget, "%s: %w", question, errOverBudget)
+}
+
+// Check a chat completion before it's sent, estimating it from its prompt and
+// the most it can say back
+func checkCompletionBudget(what string, model string, request map[string]any) error {
+	estimate, _ := UsageEntry{
+		Model:            model,
+		PromptTokens:     requestTokens(model, request),
+		CompletionTokens: activeConfig.MaxTokens,
+	}.Cost()
+
+	return checkBudget(what, estimate)
+}
+
+// What the key with fingerprint has spent today and this month, going by the
+// ledger
+func spentBy(fingerprint string, now time.Time) (float64, float64, error) {
+	path := activeConfig.UsageLedger
+	if path == "" || path == "off" {
+		return 0, 0, nil
+	}
+
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	entries, err := readUsage(path, monthStart)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var today, month float64
+	for _, entry := range entries {
+		if entry.APIKey != fingerprint {
+			continue
+		}
+		cost, _ := entry.Cost()
+		month += cost
+		if !entry.Time.Before(dayStart) {
+			today += cost
+		}
+	}
+
+	return today, month, nil
+}
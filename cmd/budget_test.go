@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Answer spend confirmations with answer, returning the questions asked
+func stubConfirmSpend(t *testing.T, answer bool) *[]string {
+	var questions []string
+	previous := confirmSpend
+	confirmSpend = func(question string) bool {
+		questions = append(questions, question)
+		return answer
+	}
+	t.Cleanup(func() { confirmSpend = previous })
+	return &questions
+}
+
+// Write entries to a fresh ledger
+func writeLedger(t *testing.T, entries ...UsageEntry) {
+	path := useUsageLedger(t)
+
+	var lines []string
+	for _, entry := range entries {
+		line, _ := json.Marshal(entry)
+		lines = append(lines, string(line))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func imageServer(t *testing.T, requests *int) string {
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": [{"url": "one.biz"}]}`))
+	})
+	return server.URL
+}
+
+func TestBudget_ConfirmsExpensiveImages(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	useUsageLedger(t)
+	questions := stubConfirmSpend(t, false)
+
+	requests := 0
+	url := imageServer(t, &requests)
+
+	activeConfig.Budget.ConfirmAbove = 0.1
+
+	_, err := GenImage(context.Background(), "gpt-4o", `{"n": 10, "size": "1024x1024", "model": "dall-e-2", "prompt": "lions"}`, url)
+	if !errors.Is(err, errOverBudget) {
+		t.Fatalf("expected the images to be refused, got %v", err)
+	}
+	if requests != 0 {
+		t.Error("expected no images to be generated")
+	}
+	if len(*questions) != 1 || !strings.Contains((*questions)[0], "Generating 10 1024x1024 image(s) with dall-e-2 is estimated to cost $0.20") {
+		t.Errorf("expected to be asked about the cost, got %q", *questions)
+	}
+
+	// A cheap one goes ahead without asking, and dall-e-3 only ever makes one
+	// at a time, so that's all that's priced
+	for _, carryoverJson := range []string{
+		`{"n": 1, "size": "1024x1024", "model": "dall-e-2", "prompt": "lions"}`,
+		`{"n": 10, "size": "1024x1024", "model": "dall-e-3", "prompt": "lions"}`,
+	} {
+		if _, err := GenImage(context.Background(), "gpt-4o", carryoverJson, url); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if requests != 2 || len(*questions) != 1 {
+		t.Errorf("expected the cheap images without a question, got %d requests and %q", requests, *questions)
+	}
+}
+
+func TestBudget_ConfirmedGoesAhead(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	useUsageLedger(t)
+	stubConfirmSpend(t, true)
+
+	requests := 0
+	activeConfig.Budget.ConfirmAbove = 0.1
+
+	if _, err := GenImage(context.Background(), "gpt-4o", `{"n": 10, "size": "1024x1024", "model": "dall-e-2", "prompt": "lions"}`, imageServer(t, &requests)); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("expected the images once confirmed, got %d requests", requests)
+	}
+}
+
+func TestBudget_DailyAndMonthlyLimits(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	t.Setenv("OPENAI_API_KEY", "sk-ours")
+	ours := keyFingerprint("sk-ours")
+	theirs := keyFingerprint("sk-theirs")
+
+	now := time.Now()
+	// $2.50 each
+	spend := func(key string, when time.Time) UsageEntry {
+		return UsageEntry{Time: when, APIKey: key, Model: "gpt-4o", PromptTokens: 1_000_000}
+	}
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	writeLedger(t,
+		spend(ours, now),
+		spend(ours, monthStart),
+		spend(theirs, now),
+		spend(ours, monthStart.AddDate(0, -1, 0)),
+	)
+
+	send := func() error {
+		server, _ := sequenceServer(t, []string{`{"choices": [{"message": {"content": "hi"}}]}`})
+		_, err := RunPrimaryAgent(context.Background(), "gpt-4o", "hi", "Linux", server.URL, AgentOptions{MaxSteps: 1}, &bytes.Buffer{})
+		return err
+	}
+
+	questions := stubConfirmSpend(t, false)
+
+	// Today's $2.50 (or $5 if the month started today) is under $6
+	activeConfig.Budget = BudgetConfig{Daily: 6}
+	if err := send(); err != nil {
+		t.Errorf("expected to be under the daily budget, got %v", err)
+	}
+
+	activeConfig.Budget = BudgetConfig{Daily: 2}
+	if err := send(); !errors.Is(err, errOverBudget) || !strings.Contains(err.Error(), "daily budget") {
+		t.Errorf("expected the daily budget to refuse, got %v", err)
+	}
+
+	// Last month's spend doesn't count, and neither does the other key's
+	activeConfig.Budget = BudgetConfig{Monthly: 5.01}
+	if err := send(); err != nil {
+		t.Errorf("expected to be under the monthly budget, got %v", err)
+	}
+
+	activeConfig.Budget = BudgetConfig{Monthly: 5}
+	if err := send(); !errors.Is(err, errOverBudget) || !strings.Contains(err.Error(), "monthly budget") {
+		t.Errorf("expected the monthly budget to refuse, got %v", err)
+	}
+
+	// The key's own limits win
+	activeConfig.Budget = BudgetConfig{Daily: 1, Keys: map[string]BudgetLimits{ours: {Daily: 100}}}
+	if err := send(); err != nil {
+		t.Errorf("expected the key's own budget to be used, got %v", err)
+	}
+
+	if len(*questions) != 2 {
+		t.Errorf("expected to be asked only when over budget, got %q", *questions)
+	}
+}
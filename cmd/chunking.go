@@ -0,0 +1,175 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// How many times notes are condensed again before giving up and cutting them
+const maxCondenseRounds = 3
+
+// Tokens the notes request takes up besides the chunk
+const notesRequestTokens = 500
+
+// How big a chunk model is handed at once: chunk_tokens, unless its context
+// window is too small for that
+func chunkTokens(model string) int {
+	return max(min(activeConfig.ChunkTokens, tokensLeft(model, notesRequestTokens)), 100)
+}
+
+// Split text into chunks of at most maxTokens, breaking between paragraphs
+// where it can, then between lines, then wherever
+func splitIntoChunks(tokenizer Tokenizer, text string, maxTokens int) []string {
+	var chunks []string
+	var current strings.Builder
+	currentTokens := 0
+
+	flush := func() {
+		if strings.TrimSpace(current.String()) != "" {
+			chunks = append(chunks, strings.TrimSpace(current.String()))
+		}
+		current.Reset()
+		currentTokens = 0
+	}
+
+	add := func(piece string, pieceTokens int, separator string) {
+		if current.Len() > 0 && currentTokens+tokenizer.Count(separator)+pieceTokens > maxTokens {
+			flush()
+		}
+		if current.Len() > 0 {
+			current.WriteString(separator)
+			currentTokens += tokenizer.Count(separator)
+		}
+		current.WriteString(piece)
+		currentTokens += pieceTokens
+	}
+
+	for _, paragraph := range strings.Split(text, "\n\n") {
+		if tokens := tokenizer.Count(paragraph); tokens <= maxTokens {
+			add(paragraph, tokens, "\n\n")
+			continue
+		}
+
+		for _, line := range strings.Split(paragraph, "\n") {
+			if tokens := tokenizer.Count(line); tokens <= maxTokens {
+				add(line, tokens, "\n")
+				continue
+			}
+
+			for line != "" {
+				var head string
+				head, line = tokenizer.Cut(line, maxTokens)
+				if head == "" {
+					// Nothing fits, which only a tiny maxTokens does
+					head, line = line, ""
+				}
+				add(head, tokenizer.Count(head), "")
+			}
+		}
+	}
+	flush()
+
+	return chunks
+}
+
+// Boil text down to what matters for purpose, if it's too big to hand the
+// model whole. The text is split into chunks, notes are taken on each in
+// parallel (map), and the notes are joined (reduce), condensing them again if
+// they're still too big. Text that already fits is returned as is.
+func condense(ctx context.Context, provider Provider, model string, purpose string, text string) (string, error) {
+	tokenizer := tokenizerFor(model)
+	maxTokens := chunkTokens(model)
+
+	for round := 1; tokenizer.Count(text) > maxTokens; round++ {
+		if round > maxCondenseRounds {
+			return truncateTokens(model, text, maxTokens), nil
+		}
+
+		chunks := splitIntoChunks(tokenizer, text, maxTokens)
+
+		estimate, _ := UsageEntry{
+			Model:            model,
+			PromptTokens:     tokenizer.Count(text) + len(chunks)*notesRequestTokens,
+			CompletionTokens: len(chunks) * activeConfig.MaxTokens,
+		}.Cost()
+		if err := checkBudget(fmt.Sprintf("Reading %d chunks", len(chunks)), estimate); err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(os.Stderr, "reading %d chunks of about %d tokens each\n", len(chunks), maxTokens)
+
+		notes, err := takeNotes(ctx, provider, model, purpose, chunks)
+		if err != nil {
+			return "", err
+		}
+
+		text = strings.Join(notes, "\n\n")
+	}
+
+	return text, nil
+}
+
+// The map step: notes on each chunk, chunk_concurrency at a time. Chunks
+// without anything relevant are dropped.
+func takeNotes(ctx context.Context, provider Provider, model string, purpose string, chunks []string) ([]string, error) {
+	concurrency := max(activeConfig.ChunkConcurrency, 1)
+
+	notes := make([]string, len(chunks))
+	errs := make([]error, len(chunks))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, chunk := range chunks {
+		wg.Add(1)
+		go func(i int, chunk string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			resp, err := chatCompletion(ctx, provider, buildNotesRequest(model, purpose, chunk, i+1, len(chunks)))
+			recordCompletionUsage("notes", model, resp)
+			if err == nil {
+				err = getError(*resp)
+			}
+			if err != nil {
+				errs[i] = fmt.Errorf("unable to read chunk %d of %d: %w", i+1, len(chunks), err)
+				return
+			}
+
+			notes[i] = strings.TrimSpace(getMessageContent(*resp))
+		}(i, chunk)
+	}
+	wg.Wait()
+
+	var relevant []string
+	for i, note := range notes {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		if note != "" && note != "NONE" {
+			relevant = append(relevant, note)
+		}
+	}
+
+	return relevant, nil
+}
+
+func buildNotesRequest(model string, purpose string, chunk string, part int, parts int) map[string]any {
+	return map[string]any{
+		"max_tokens":  activeConfig.MaxTokens,
+		"temperature": activeConfig.Temperature,
+		"model":       model,
+		"messages": []map[string]any{
+			{"role": "system", "content": fmt.Sprintf("You are reading part %d of %d of a larger text, which is too big to read at once. Write down everything in this part that's relevant to what the user is after, keeping specifics like names, numbers, times, commands and quotes. Don't answer the user, just take notes. If nothing in this part is relevant, reply with only NONE.", part, parts)},
+			{"role": "system", "content": "What the user is after: " + purpose},
+			{"role": "user", "content": chunk},
+		},
+	}
+}
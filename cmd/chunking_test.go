@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func useChunkTokens(t *testing.T, chunkTokens int) {
+	// Chunks are measured by estimate, whatever tables are installed
+	useTokenizerDir(t, t.TempDir())
+	previous := activeConfig
+	activeConfig.ChunkTokens = chunkTokens
+	t.Cleanup(func() { activeConfig = previous })
+}
+
+// Answers each request with whatever respond makes of it. Chunks are read in
+// parallel, so unlike sequenceServer the order requests come in can't matter.
+func chunkServer(t *testing.T, respond func(request string) string) (*httptest.Server, *[]string) {
+	var mu sync.Mutex
+	var requests []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqBytes, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		requests = append(requests, string(reqBytes))
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(respond(string(reqBytes))))
+	}))
+
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// The last request that isn't for notes on a chunk
+func finalRequest(t *testing.T, requests []string) string {
+	for i := len(requests) - 1; i >= 0; i-- {
+		if !strings.Contains(requests[i], "You are reading part") {
+			return requests[i]
+		}
+	}
+	t.Fatal("expected a request that wasn't for notes")
+	return ""
+}
+
+func testProvider(t *testing.T, url string) Provider {
+	t.Setenv("AI_PROVIDER", "openai")
+	provider, err := NewProvider(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return provider
+}
+
+func notesResponse(notes string) string {
+	content, _ := json.Marshal(notes)
+	return `{"choices": [{"message": {"content": ` + string(content) + `}}]}`
+}
+
+func TestSplitIntoChunks(t *testing.T) {
+	text := strings.Repeat("a short paragraph\n\n", 20) + strings.Repeat("x", 500)
+
+	tokenizer := estimateTokenizer{charsPerToken: 4}
+	chunks := splitIntoChunks(tokenizer, text, 25)
+	if len(chunks) < 2 {
+		t.Fatalf("expected several chunks, got %d", len(chunks))
+	}
+
+	for _, chunk := range chunks {
+		if tokenizer.Count(chunk) > 25 {
+			t.Errorf("expected chunks of at most 25 tokens, got %d: %q", tokenizer.Count(chunk), chunk)
+		}
+	}
+
+	if !strings.HasPrefix(chunks[0], "a short paragraph\n\na short paragraph") {
+		t.Errorf("expected paragraphs to be kept together, got %q", chunks[0])
+	}
+
+	joined := strings.ReplaceAll(strings.Join(chunks, ""), "\n", "")
+	if joined != strings.ReplaceAll(text, "\n", "") {
+		t.Error("expected nothing to be lost splitting")
+	}
+}
+
+func TestCondense_FitsAlready(t *testing.T) {
+	useChunkTokens(t, 100)
+	server, requests := sequenceServer(t, nil)
+
+	text, err := condense(context.Background(), testProvider(t, server.URL), "gpt-4o", "lions", "Lions are tawny.")
+	if err != nil || text != "Lions are tawny." {
+		t.Errorf("expected small text to pass through, got %q, %v", text, err)
+	}
+	if len(*requests) != 0 {
+		t.Errorf("expected no requests, got %d", len(*requests))
+	}
+}
+
+func TestCondense_TakesNotes(t *testing.T) {
+	useChunkTokens(t, 100)
+	// Two paragraphs, each fitting in a chunk but not together
+	text := strings.Repeat("Tigers are orange and striped. ", 10) + "\n\n" +
+		strings.Repeat("Lions are tawny, and males grow manes. ", 8)
+
+	server, requests := chunkServer(t, func(request string) string {
+		if strings.Contains(request, "Lions are tawny") {
+			return notesResponse("Lions are tawny")
+		}
+		return notesResponse("NONE")
+	})
+
+	notes, err := condense(context.Background(), testProvider(t, server.URL), "gpt-4o", "what color are lions", text)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if notes != "Lions are tawny" {
+		t.Errorf("expected the chunk without anything relevant to be dropped, got %q", notes)
+	}
+
+	if len(*requests) != 2 {
+		t.Fatalf("expected a request per chunk, got %d", len(*requests))
+	}
+	for _, request := range *requests {
+		for _, want := range []string{"of 2 of a larger text", "What the user is after: what color are lions"} {
+			if !strings.Contains(request, want) {
+				t.Errorf("expected each request to have %q, got %s", want, request)
+			}
+		}
+	}
+}
+
+func TestCondense_ChunkError(t *testing.T) {
+	useChunkTokens(t, 100)
+
+	server, _ := chunkServer(t, func(request string) string {
+		if strings.Contains(request, "part 2 of 2") {
+			return `{"error": {"message": "context length exceeded"}}`
+		}
+		return notesResponse("Lions are tawny")
+	})
+
+	text := strings.Repeat("Lions are tawny. ", 20) + "\n\n" + strings.Repeat("Lions are tawny. ", 20)
+	_, err := condense(context.Background(), testProvider(t, server.URL), "gpt-4o", "lions", text)
+	if err == nil || !strings.Contains(err.Error(), "chunk 2 of 2: context length exceeded") {
+		t.Errorf("expected the chunk's error, got %v", err)
+	}
+}
+
+func TestCrawl_BigPageReadInChunks(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	useChunkTokens(t, 100)
+	useCrawlConfig(t, CrawlConfig{MaxDepth: 0, MaxPages: 1, Concurrency: 1})
+	stubFetchPage(t, strings.Repeat("Big news today. ", 18)+"\n\n"+strings.Repeat("Small news today. ", 18))
+
+	server, requests := chunkServer(t, func(request string) string {
+		if strings.Contains(request, "Big news today") {
+			return notesResponse("Big news")
+		}
+		return notesResponse("NONE")
+	})
+
+	if _, err := CrawlWeb(context.Background(), "gpt-4o", `{"url": "https://bbc.com", "purpose": "first headline"}`, server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*requests) != 3 {
+		t.Fatalf("expected two chunks and the extraction, got %d requests", len(*requests))
+	}
+
+	extracting := finalRequest(t, *requests)
+	if !strings.Contains(extracting, "Notes taken while reading the pages:\\n\\nBig news") {
+		t.Errorf("expected the extraction to be from the notes, got %s", extracting)
+	}
+	if strings.Contains(extracting, "today") {
+		t.Errorf("expected the page itself to be left out, got %s", extracting)
+	}
+}
+
+func TestAgent_BigContextReadInChunks(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	useChunkTokens(t, 100)
+
+	server, requests := chunkServer(t, func(request string) string {
+		switch {
+		case !strings.Contains(request, "You are reading part"):
+			return `{"choices": [{"message": {"tool_calls": [{"id": "call_printz", "type": "function", "function": {"name": "printz", "arguments": "{\"command\": \"df -h\"}"}}]}}]}`
+		case strings.Contains(request, "disk full"):
+			return notesResponse("error: disk full")
+		default:
+			return notesResponse("NONE")
+		}
+	})
+
+	logs := strings.Repeat("a log line\n", 30) + "\n" + "error: disk full\n" + strings.Repeat("another log line\n", 15)
+
+	var outputBuffer bytes.Buffer
+	if _, err := RunPrimaryAgent(context.Background(), "gpt-4o", "why did this fail", "Linux", server.URL, AgentOptions{MaxSteps: 5, Context: logs}, &outputBuffer); err != nil {
+		t.Fatal(err)
+	}
+
+	if outputBuffer.String() != "printz df -h\n" {
+		t.Errorf("unexpected output %q", outputBuffer.String())
+	}
+
+	if len(*requests) != 3 {
+		t.Errorf("expected two chunks and the prompt, got %d requests", len(*requests))
+	}
+
+	asking := finalRequest(t, *requests)
+	if !strings.Contains(asking, "why did this fail\\n\\nADDITIONAL CONTEXT: error: disk full") {
+		t.Errorf("expected the notes as the additional context, got %s", asking)
+	}
+}
@@ -3,26 +3,62 @@ package cmd
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
+	"sort"
+	"strings"
 )
 
+// OpenAI sends error codes as strings, while compatible servers like llama.cpp
+// send the http status as a number. Either way we keep it as a string.
+type ErrorCode string
+
+func (c *ErrorCode) UnmarshalJSON(data []byte) error {
+	var str string
+	if err := json.Unmarshal(data, &str); err == nil {
+		*c = ErrorCode(str)
+		return nil
+	}
+
+	var num json.Number
+	if err := json.Unmarshal(data, &num); err != nil {
+		return err
+	}
+	*c = ErrorCode(num.String())
+	return nil
+}
+
+type OpenAIError struct {
+	Message string    `json:"message"`
+	Type    string    `json:"type"`
+	Param   string    `json:"param"`
+	Code    ErrorCode `json:"code"`
+	// Azure explains content filter rejections in here
+	InnerError *struct {
+		Code                string                          `json:"code"`
+		ContentFilterResult map[string]contentFilterVerdict `json:"content_filter_result"`
+	} `json:"innererror"`
+}
+
+type contentFilterVerdict struct {
+	Filtered bool   `json:"filtered"`
+	Severity string `json:"severity"`
+}
+
 type OpenAICompletionResponse struct {
-	Error *struct {
-		Message string `json:"message"`
-		Type    string `json:"type"`
-		Param   string `json:"param"`
-		Code    string `json:"code"`
-	} `json:"error"`
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int    `json:"created"`
-	Model   string `json:"model"`
+	Error   *OpenAIError `json:"error"`
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int          `json:"created"`
+	Model   string       `json:"model"`
 	Choices []struct {
-		Index        int         `json:"index"`
-		Logprobs     any `json:"logprobs,omitempty"`
-		FinishReason string      `json:"finish_reason"`
-		Message      struct {
+		Index        int    `json:"index"`
+		Logprobs     any    `json:"logprobs,omitempty"`
+		FinishReason string `json:"finish_reason"`
+		// Azure's verdicts on the generated content, when it filters a completion
+		ContentFilterResults map[string]contentFilterVerdict `json:"content_filter_results,omitempty"`
+		Message              struct {
 			Content   *string `json:"content"`
-			Role      string `json:"role"`
+			Role      string  `json:"role"`
 			ToolCalls *[]struct {
 				Id       string `json:"id"`
 				Type     string `json:"type"`
@@ -41,16 +77,11 @@ type OpenAICompletionResponse struct {
 }
 
 type OpenAIImageGenerationResponse struct {
-	Error *struct {
-		Message string `json:"message"`
-		Type    string `json:"type"`
-		Param   string `json:"param"`
-		Code    string `json:"code"`
-	} `json:"error"`
-	ID      string `json:"id"`
-	Object  string `json:"object"`
-	Created int    `json:"created"`
-	Model   string `json:"model"`
+	Error   *OpenAIError `json:"error"`
+	ID      string       `json:"id"`
+	Object  string       `json:"object"`
+	Created int          `json:"created"`
+	Model   string       `json:"model"`
 	Data    *[]struct {
 		Url string `json:"url"`
 	} `json:"data"`
@@ -67,19 +98,68 @@ func prettyPrint(i any) string {
 	return string(s)
 }
 
-// Pull the error message off a resp if there is any
+// Name the categories a content filter flagged, ex "hate, violence"
+func filteredCategories(verdicts map[string]contentFilterVerdict) string {
+	var categories []string
+	for category, verdict := range verdicts {
+		if verdict.Filtered {
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	return strings.Join(categories, ", ")
+}
+
+// The error's message, plus which categories tripped the content filter if any
+func (e *OpenAIError) fullMessage() string {
+	if e == nil || e.Message == "" {
+		return ""
+	}
+
+	if e.InnerError != nil {
+		if categories := filteredCategories(e.InnerError.ContentFilterResult); categories != "" {
+			return fmt.Sprintf("%s (content filtered: %s)", e.Message, categories)
+		}
+	}
+
+	return e.Message
+}
+
+// What kind of error the api reported
+func (e *OpenAIError) class() ErrorClass {
+	if e.InnerError != nil && filteredCategories(e.InnerError.ContentFilterResult) != "" {
+		return ErrContentFilter
+	}
+	return apiErrorClass(0, string(e.Code), e.Type, e.Message)
+}
+
+// Pull the error off a resp if there is any
 func getError(resp OpenAICompletionResponse) error {
-	if resp.Error != nil && resp.Error.Message != "" {
-		return errors.New(resp.Error.Message)
+	message := getErrorMessage(resp)
+	if message == "" {
+		return nil
 	}
 
-	return nil
+	if resp.Error.fullMessage() != "" {
+		return classify(resp.Error.class(), errors.New(message))
+	}
+	return classify(ErrContentFilter, errors.New(message))
 }
 
-// Pull the error message off a resp if there is any
+// Pull the error message off a resp if there is any. A completion that Azure
+// filtered comes back without an error but without content either, so that
+// counts as one too.
 func getErrorMessage(resp OpenAICompletionResponse) string {
-	if resp.Error != nil && resp.Error.Message != "" {
-		return resp.Error.Message
+	if message := resp.Error.fullMessage(); message != "" {
+		return message
+	}
+
+	if len(resp.Choices) > 0 && resp.Choices[0].FinishReason == "content_filter" {
+		message := "The response was filtered by the content filter"
+		if categories := filteredCategories(resp.Choices[0].ContentFilterResults); categories != "" {
+			message = fmt.Sprintf("%s (content filtered: %s)", message, categories)
+		}
+		return message
 	}
 
 	return ""
@@ -87,8 +167,12 @@ func getErrorMessage(resp OpenAICompletionResponse) string {
 
 // Pull the error message off a resp if there is any
 func getErrorMessageFromImgGenResp(resp OpenAIImageGenerationResponse) error {
-	if resp.Error != nil && resp.Error.Message != "" {
-		return errors.New(resp.Error.Message)
+	if message := resp.Error.fullMessage(); message != "" {
+		return classify(resp.Error.class(), errors.New(message))
+	}
+
+	if resp.Data == nil {
+		return classifyf(ErrBadResponse, "no images in the response")
 	}
 
 	return nil
@@ -122,3 +206,18 @@ func getToolcallFunctionName(resp OpenAICompletionResponse) string {
 		return ""
 	}
 }
+
+// Return all of the tool calls off a resp, if there are any
+func getToolCalls(resp OpenAICompletionResponse) []translatedToolCall {
+	var toolCalls []translatedToolCall
+	if len(resp.Choices) > 0 && resp.Choices[0].Message.ToolCalls != nil {
+		for _, toolCall := range *resp.Choices[0].Message.ToolCalls {
+			toolCalls = append(toolCalls, translatedToolCall{
+				Id:        toolCall.Id,
+				Name:      toolCall.Function.Name,
+				Arguments: toolCall.Function.Arguments,
+			})
+		}
+	}
+	return toolCalls
+}
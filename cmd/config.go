@@ -0,0 +1,403 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Everything that can be set from the config file, env vars or flags
+type Config struct {
+	Provider    string                `mapstructure:"provider" yaml:"provider"`
+	Model       string                `mapstructure:"model" yaml:"model"`
+	MaxTokens   int                   `mapstructure:"max_tokens" yaml:"max_tokens"`
+	Temperature float64               `mapstructure:"temperature" yaml:"temperature"`
+	MaxSteps    int                   `mapstructure:"max_steps" yaml:"max_steps"`
+	BaseURL     string                `mapstructure:"base_url" yaml:"base_url,omitempty"`
+	Headers     map[string]string     `mapstructure:"-" yaml:"headers,omitempty"`
+	Proxy       string                `mapstructure:"proxy" yaml:"proxy,omitempty"`
+	CABundle    string                `mapstructure:"ca_bundle" yaml:"ca_bundle,omitempty"`
+	Tools       map[string]ToolConfig `mapstructure:"tools" yaml:"tools,omitempty"`
+	// Seconds an ai-tool-* plugin or mcp tool call gets to run
+	PluginTimeout int `mapstructure:"plugin_timeout" yaml:"plugin_timeout"`
+	// Times a rate limited or unavailable request is tried again
+	MaxRetries int           `mapstructure:"max_retries" yaml:"max_retries"`
+	Timeouts   TimeoutConfig `mapstructure:"timeouts" yaml:"timeouts"`
+	Crawl      CrawlConfig   `mapstructure:"crawl" yaml:"crawl"`
+	// Bigger pages and piped input are read in chunks of about this many
+	// tokens, and the notes taken on them used instead
+	ChunkTokens int `mapstructure:"chunk_tokens" yaml:"chunk_tokens"`
+	// Chunks read at once
+	ChunkConcurrency int `mapstructure:"chunk_concurrency" yaml:"chunk_concurrency"`
+	// Overrides the context window known for the model, ex for a local model
+	// run with a bigger or smaller one. 0 goes by the model.
+	ContextWindow int `mapstructure:"context_window" yaml:"context_window,omitempty"`
+	// Where the BPE tables for OpenAI's models are read from, defaults to
+	// tokenizers/ next to the config file
+	TokenizerDir string `mapstructure:"tokenizer_dir" yaml:"tokenizer_dir,omitempty"`
+	// Where every call's usage is appended, "off" to keep none
+	UsageLedger string `mapstructure:"usage_ledger" yaml:"usage_ledger"`
+	// Added to or replacing the built in prices, keyed by model name prefix
+	Prices map[string]Price `mapstructure:"prices" yaml:"prices,omitempty"`
+	Budget BudgetConfig     `mapstructure:"budget" yaml:"budget"`
+	// MCP servers whose tools are offered to the model, keyed by name
+	MCPServers map[string]MCPServerConfig `mapstructure:"mcp_servers" yaml:"mcp_servers,omitempty"`
+	Azure      AzureConfig                `mapstructure:"azure" yaml:"azure"`
+}
+
+// Per tool settings, keyed by tool name in the config file
+type ToolConfig struct {
+	// Replaces the description the model is given for the tool
+	Description string `mapstructure:"description" yaml:"description,omitempty"`
+	// Turns an optional tool like info on, or a default one off
+	Enabled *bool `mapstructure:"enabled" yaml:"enabled,omitempty"`
+}
+
+// The settings in effect. Starts out as the defaults, so the request builders
+// work without a config having been loaded, like in tests and hydrate.go.
+var activeConfig = defaultConfig()
+
+// Set by the --config flag
+var configFile string
+
+func defaultConfig() Config {
+	return Config{
+		Provider:    "openai",
+		Model:       "gpt-4.1-mini",
+		MaxTokens:   703,
+		Temperature: 0,
+		MaxSteps:    5,
+
+		PluginTimeout: 30,
+		MaxRetries:    3,
+
+		Timeouts: TimeoutConfig{
+			Request: 120,
+			Page:    20,
+			Image:   180,
+			Crawl:   300,
+		},
+
+		ChunkTokens:      6000,
+		ChunkConcurrency: 4,
+
+		Budget: BudgetConfig{ConfirmAbove: 0.25},
+
+		Azure: AzureConfig{ApiVersion: defaultAzureApiVersion},
+
+		Crawl: CrawlConfig{
+			MaxDepth:    1,
+			MaxPages:    5,
+			Concurrency: 4,
+			HostDelay:   500,
+		},
+	}
+}
+
+// Where the config file lives unless --config says otherwise
+func defaultConfigPath() string {
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+
+	return filepath.Join(configHome, "ai-functions", "config.yaml")
+}
+
+// Settings that already had env vars before there was a config file keep them
+var configEnvVars = map[string][]string{
+	"provider":  {"AI_PROVIDER"},
+	"model":     {"AI_MODEL", "OPENAI_API_MODEL"},
+	"base_url":  {"OPENAI_BASE_URL"},
+	"headers":   {"AI_EXTRA_HEADERS"},
+	"proxy":     {"AI_HTTPS_PROXY"},
+	"ca_bundle": {"AI_CA_BUNDLE"},
+
+	"azure.endpoint":    {"AZURE_OPENAI_ENDPOINT"},
+	"azure.api_version": {"AZURE_OPENAI_API_VERSION"},
+	"azure.deployments": {"AZURE_OPENAI_DEPLOYMENTS"},
+}
+
+// Flags that override settings of the same name, when the command has them
+var configFlags = []string{"provider", "model", "max_steps"}
+
+// Build a viper that reads, from lowest to highest precedence: the defaults,
+// the config file, env vars (AI_ plus the setting's name, ex AI_MAX_TOKENS,
+// along with the older names above), then the command's flags.
+func newConfigViper(path string, flags *pflag.FlagSet) (*viper.Viper, error) {
+	v := viper.New()
+
+	defaults := defaultConfig()
+	v.SetDefault("provider", defaults.Provider)
+	v.SetDefault("model", defaults.Model)
+	v.SetDefault("max_tokens", defaults.MaxTokens)
+	v.SetDefault("temperature", defaults.Temperature)
+	v.SetDefault("max_steps", defaults.MaxSteps)
+	v.SetDefault("plugin_timeout", defaults.PluginTimeout)
+	v.SetDefault("max_retries", defaults.MaxRetries)
+	v.SetDefault("timeouts.request", defaults.Timeouts.Request)
+	v.SetDefault("timeouts.page", defaults.Timeouts.Page)
+	v.SetDefault("timeouts.image", defaults.Timeouts.Image)
+	v.SetDefault("timeouts.crawl", defaults.Timeouts.Crawl)
+	v.SetDefault("chunk_tokens", defaults.ChunkTokens)
+	v.SetDefault("chunk_concurrency", defaults.ChunkConcurrency)
+	v.SetDefault("context_window", defaults.ContextWindow)
+	v.SetDefault("tokenizer_dir", defaults.TokenizerDir)
+	v.SetDefault("usage_ledger", defaults.UsageLedger)
+	v.SetDefault("budget.daily", defaults.Budget.Daily)
+	v.SetDefault("budget.monthly", defaults.Budget.Monthly)
+	v.SetDefault("budget.confirm_above", defaults.Budget.ConfirmAbove)
+	v.SetDefault("crawl.max_depth", defaults.Crawl.MaxDepth)
+	v.SetDefault("crawl.max_pages", defaults.Crawl.MaxPages)
+	v.SetDefault("crawl.concurrency", defaults.Crawl.Concurrency)
+	v.SetDefault("crawl.host_delay", defaults.Crawl.HostDelay)
+	v.SetDefault("azure.api_version", defaults.Azure.ApiVersion)
+
+	v.SetEnvPrefix("AI")
+	v.AutomaticEnv()
+	for key, envVars := range configEnvVars {
+		v.BindEnv(append([]string{key}, envVars...)...)
+	}
+
+	if flags != nil {
+		for _, name := range configFlags {
+			if flag := flags.Lookup(name); flag != nil {
+				v.BindPFlag(name, flag)
+			}
+		}
+	}
+
+	if path != "" {
+		v.SetConfigFile(path)
+		if err := v.ReadInConfig(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("unable to read config %s: %w", path, err)
+		}
+	}
+
+	return v, nil
+}
+
+// Resolve the effective config from a viper built by newConfigViper
+func configFromViper(v *viper.Viper) (Config, error) {
+	var config Config
+	if err := v.Unmarshal(&config); err != nil {
+		return config, err
+	}
+
+	// A map in the config file, but a single string in AI_EXTRA_HEADERS
+	switch headers := v.Get("headers").(type) {
+	case string:
+		config.Headers = parseHeaders(headers)
+	case map[string]any:
+		config.Headers = map[string]string{}
+		for key, value := range headers {
+			config.Headers[key] = fmt.Sprint(value)
+		}
+	}
+
+	// Likewise a map in the config file, but a single string in
+	// AZURE_OPENAI_DEPLOYMENTS
+	switch deployments := v.Get("azure.deployments").(type) {
+	case string:
+		config.Azure.Deployments = parseAzureDeployments(deployments)
+	case map[string]any:
+		config.Azure.Deployments = map[string]string{}
+		for model, deployment := range deployments {
+			config.Azure.Deployments[model] = fmt.Sprint(deployment)
+		}
+	}
+
+	if resource := os.Getenv("AZURE_OPENAI_RESOURCE"); config.Azure.Endpoint == "" && resource != "" {
+		config.Azure.Endpoint = azureResourceEndpoint(resource)
+	}
+
+	config.BaseURL = strings.TrimRight(config.BaseURL, "/")
+
+	// Left empty in the defaults, so that nothing run without a config, like
+	// the tests, writes to the real ledger
+	if config.UsageLedger == "" {
+		config.UsageLedger = defaultUsageLedgerPath()
+	}
+
+	return config, nil
+}
+
+// Load the config for the command being run and put it into effect
+func loadConfig(cmd *cobra.Command) error {
+	path := configFile
+	if path == "" {
+		path = defaultConfigPath()
+	}
+
+	v, err := newConfigViper(path, cmd.Flags())
+	if err != nil {
+		return err
+	}
+
+	config, err := configFromViper(v)
+	if err != nil {
+		return err
+	}
+
+	activeConfig = config
+	setHTTPSettings(config.HTTPSettings())
+
+	return nil
+}
+
+func (c Config) HTTPSettings() HTTPSettings {
+	return HTTPSettings{
+		BaseURL:  c.BaseURL,
+		Headers:  c.Headers,
+		Proxy:    c.Proxy,
+		CABundle: c.CABundle,
+	}
+}
+
+// The description the model is given for a tool, fallback unless configured
+func toolDescription(name string, fallback string) string {
+	if tool, ok := activeConfig.Tools[name]; ok && tool.Description != "" {
+		return tool.Description
+	}
+	return fallback
+}
+
+// Everything wrong with the config, if anything
+func (c Config) Validate() []error {
+	var problems []error
+
+	if _, ok := providerConstructors[c.Provider]; !ok {
+		problems = append(problems, fmt.Errorf("provider %q is unknown, expected one of: %s", c.Provider, strings.Join(providerNames(), ", ")))
+	}
+
+	if c.Model == "" {
+		problems = append(problems, errors.New("model is empty"))
+	}
+
+	if c.MaxTokens < 1 {
+		problems = append(problems, fmt.Errorf("max_tokens must be positive, got %d", c.MaxTokens))
+	}
+
+	if c.Temperature < 0 || c.Temperature > 2 {
+		problems = append(problems, fmt.Errorf("temperature must be between 0 and 2, got %v", c.Temperature))
+	}
+
+	if c.MaxSteps < 1 {
+		problems = append(problems, fmt.Errorf("max_steps must be at least 1, got %d", c.MaxSteps))
+	}
+
+	if c.PluginTimeout < 1 {
+		problems = append(problems, fmt.Errorf("plugin_timeout must be at least 1 second, got %d", c.PluginTimeout))
+	}
+
+	if c.MaxRetries < 0 {
+		problems = append(problems, fmt.Errorf("max_retries can't be negative, got %d", c.MaxRetries))
+	}
+
+	if c.Timeouts.Request < 0 || c.Timeouts.Page < 0 || c.Timeouts.Image < 0 || c.Timeouts.Crawl < 0 {
+		problems = append(problems, fmt.Errorf("timeouts can't be negative, got %+v", c.Timeouts))
+	}
+
+	if c.BaseURL != "" {
+		if parsed, err := url.Parse(c.BaseURL); err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			problems = append(problems, fmt.Errorf("base_url %q is not a full url", c.BaseURL))
+		}
+	}
+
+	if _, err := buildHTTPClient(c.HTTPSettings()); err != nil {
+		problems = append(problems, err)
+	}
+
+	if c.ChunkTokens < 100 {
+		problems = append(problems, fmt.Errorf("chunk_tokens must be at least 100, got %d", c.ChunkTokens))
+	}
+
+	if c.ContextWindow < 0 {
+		problems = append(problems, fmt.Errorf("context_window can't be negative, got %d", c.ContextWindow))
+	} else if c.ContextWindow > 0 && c.ContextWindow <= c.MaxTokens {
+		problems = append(problems, fmt.Errorf("context_window must be bigger than max_tokens, got %d", c.ContextWindow))
+	}
+
+	if c.Budget.Daily < 0 || c.Budget.Monthly < 0 || c.Budget.ConfirmAbove < 0 {
+		problems = append(problems, errors.New("budget amounts can't be negative"))
+	}
+	for fingerprint, limits := range c.Budget.Keys {
+		if limits.Daily < 0 || limits.Monthly < 0 {
+			problems = append(problems, fmt.Errorf("budget for key %s can't be negative", fingerprint))
+		}
+	}
+
+	if c.ChunkConcurrency < 1 {
+		problems = append(problems, fmt.Errorf("chunk_concurrency must be at least 1, got %d", c.ChunkConcurrency))
+	}
+
+	if c.Crawl.MaxDepth < 0 || c.Crawl.MaxPages < 1 || c.Crawl.Concurrency < 1 || c.Crawl.HostDelay < 0 {
+		problems = append(problems, fmt.Errorf("crawl needs max_pages and concurrency of at least 1, and no negative max_depth or host_delay, got %+v", c.Crawl))
+	}
+
+	for name, server := range c.MCPServers {
+		if server.Command == "" {
+			problems = append(problems, fmt.Errorf("mcp_servers.%s has no command", name))
+		}
+	}
+
+	for name := range c.Tools {
+		if !isKnownTool(name) {
+			problems = append(problems, fmt.Errorf("tools.%s is not a tool", name))
+		}
+	}
+
+	return problems
+}
+
+// Whether name is a registered tool, or crawl_web's report_information. Plugins
+// and mcp servers are only asked for their tools if it isn't a built in one.
+func isKnownTool(name string) bool {
+	if _, ok := toolRegistry[name]; ok || name == "report_information" {
+		return true
+	}
+	_, ok := lookupTool(name)
+	return ok
+}
+
+// A copy of the config that's safe to print, with header values and mcp
+// server env var values hidden
+func (c Config) Redacted() Config {
+	redacted := c
+	if len(c.Headers) > 0 {
+		redacted.Headers = map[string]string{}
+		for key := range c.Headers {
+			redacted.Headers[key] = "<redacted>"
+		}
+	}
+
+	if len(c.MCPServers) > 0 {
+		redacted.MCPServers = map[string]MCPServerConfig{}
+		for name, server := range c.MCPServers {
+			var env []string
+			for _, envVar := range server.Env {
+				key, _, _ := strings.Cut(envVar, "=")
+				env = append(env, key+"=<redacted>")
+			}
+			server.Env = env
+			redacted.MCPServers[name] = server
+		}
+	}
+
+	return redacted
+}
@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+const testConfigYaml = `
+provider: ollama
+model: llama3.1
+max_tokens: 2000
+temperature: 0.5
+base_url: https://gateway.internal/openai/v1/
+headers:
+  X-Gateway-Token: abc
+tools:
+  printz:
+    description: Suggest a fish shell command
+`
+
+func writeTestConfig(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Clear out env vars from the machine running the tests
+func clearConfigEnv(t *testing.T) {
+	for _, envVars := range configEnvVars {
+		for _, envVar := range envVars {
+			t.Setenv(envVar, "")
+			os.Unsetenv(envVar)
+		}
+	}
+}
+
+func TestConfig_Precedence(t *testing.T) {
+	clearConfigEnv(t)
+	path := writeTestConfig(t, testConfigYaml)
+
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.String("model", "", "")
+	flags.Int("max_steps", 0, "")
+
+	t.Setenv("AI_MAX_TOKENS", "900")
+	t.Setenv("OPENAI_API_MODEL", "llama3.2")
+	flags.Parse([]string{"--model", "qwen2.5"})
+
+	v, err := newConfigViper(path, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := configFromViper(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Provider != "ollama" {
+		t.Errorf("provider should come from the file, got %s", config.Provider)
+	}
+	if config.MaxTokens != 900 {
+		t.Errorf("max_tokens env var should beat the file, got %d", config.MaxTokens)
+	}
+	if config.Model != "qwen2.5" {
+		t.Errorf("model flag should beat the env var and file, got %s", config.Model)
+	}
+	if config.MaxSteps != 5 {
+		t.Errorf("unset max_steps should be the default, got %d", config.MaxSteps)
+	}
+	if config.Temperature != 0.5 {
+		t.Errorf("temperature should come from the file, got %v", config.Temperature)
+	}
+	if config.BaseURL != "https://gateway.internal/openai/v1" {
+		t.Errorf("unexpected base_url %s", config.BaseURL)
+	}
+	// viper lower cases keys, which is fine for http headers
+	if config.Headers["x-gateway-token"] != "abc" {
+		t.Errorf("unexpected headers %v", config.Headers)
+	}
+}
+
+func TestConfig_MissingFileUsesDefaults(t *testing.T) {
+	clearConfigEnv(t)
+
+	v, err := newConfigViper(filepath.Join(t.TempDir(), "nope.yaml"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := configFromViper(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defaults := defaultConfig()
+	if config.Model != defaults.Model || config.MaxTokens != defaults.MaxTokens || config.Provider != defaults.Provider {
+		t.Errorf("expected defaults, got %+v", config)
+	}
+}
+
+func TestConfig_FeedsRequestBuilders(t *testing.T) {
+	clearConfigEnv(t)
+
+	v, err := newConfigViper(writeTestConfig(t, testConfigYaml), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := configFromViper(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := activeConfig
+	activeConfig = config
+	defer func() { activeConfig = previous }()
+
+	prompt := buildPrimaryPrompt("hi", "llama3.1", "Linux", nil)
+	if prompt["max_tokens"] != 2000 || prompt["temperature"] != 0.5 {
+		t.Errorf("prompt did not use the config, got max_tokens %v, temperature %v", prompt["max_tokens"], prompt["temperature"])
+	}
+
+	for _, tool := range payloadTools(prompt) {
+		function := tool["function"].(map[string]any)
+		if function["name"] == "printz" && function["description"] != "Suggest a fish shell command" {
+			t.Errorf("tool description was not overridden, got %v", function["description"])
+		}
+	}
+}
+
+func TestConfig_Validate(t *testing.T) {
+	config := defaultConfig()
+	if problems := config.Validate(); len(problems) != 0 {
+		t.Errorf("defaults should be valid, got %v", problems)
+	}
+
+	config.Provider = "furby"
+	config.Temperature = 3
+	config.BaseURL = "gateway"
+	config.CABundle = "/nonexistent/ca.pem"
+	config.Tools = map[string]ToolConfig{"nope": {Description: "x"}}
+
+	if problems := config.Validate(); len(problems) != 5 {
+		t.Errorf("expected 5 problems, got %v", problems)
+	}
+}
+
+func TestConfig_MCPServers(t *testing.T) {
+	clearConfigEnv(t)
+
+	v, err := newConfigViper(writeTestConfig(t, `
+mcp_servers:
+  jira:
+    command: jira-mcp
+    args: ["--stdio"]
+    env: ["JIRA_TOKEN=secret"]
+`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := configFromViper(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jira := config.MCPServers["jira"]
+	if jira.Command != "jira-mcp" || len(jira.Args) != 1 || jira.Env[0] != "JIRA_TOKEN=secret" {
+		t.Errorf("unexpected mcp server %+v", jira)
+	}
+
+	if redacted := config.Redacted().MCPServers["jira"].Env[0]; redacted != "JIRA_TOKEN=<redacted>" {
+		t.Errorf("expected the env var's value to be hidden, got %s", redacted)
+	}
+	if config.MCPServers["jira"].Env[0] != "JIRA_TOKEN=secret" {
+		t.Errorf("redacting changed the config itself")
+	}
+}
+
+func TestConfig_Azure(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("AZURE_OPENAI_RESOURCE", "")
+	os.Unsetenv("AZURE_OPENAI_RESOURCE")
+
+	path := writeTestConfig(t, `
+provider: azure
+azure:
+  endpoint: https://my-resource.openai.azure.com
+  deployments:
+    gpt-4o: chat-prod
+`)
+	t.Setenv("AZURE_OPENAI_API_VERSION", "2024-10-21")
+
+	v, err := newConfigViper(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := configFromViper(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Azure.Endpoint != "https://my-resource.openai.azure.com" || config.Azure.Deployments["gpt-4o"] != "chat-prod" {
+		t.Errorf("expected the azure section of the file, got %+v", config.Azure)
+	}
+	if config.Azure.ApiVersion != "2024-10-21" {
+		t.Errorf("api_version env var should beat the default, got %s", config.Azure.ApiVersion)
+	}
+
+	// The env var's mapping replaces the file's
+	t.Setenv("AZURE_OPENAI_DEPLOYMENTS", "dall-e-3=images")
+	if config, err = configFromViper(v); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Azure.Deployments) != 1 || config.Azure.Deployments["dall-e-3"] != "images" {
+		t.Errorf("expected the deployments env var to win, got %v", config.Azure.Deployments)
+	}
+
+	previous := activeConfig
+	activeConfig = config
+	defer func() { activeConfig = previous }()
+
+	provider, err := NewProvider("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if azure := provider.(*AzureProvider); azure.Endpoint != "https://my-resource.openai.azure.com" || azure.ApiVersion != "2024-10-21" {
+		t.Errorf("expected the provider to be set up from the config, got %+v", azure)
+	}
+}
@@ -5,48 +5,92 @@ Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
 package cmd
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
-	"os/exec"
+	"strings"
 )
 
-func buildCrawlWebRequest(carryoverJson string, model string) map[string]any {
+// Fetches a page and has the model pull out what the user's after
+type crawlWebTool struct{}
+
+func init() {
+	registerTool(crawlWebTool{})
+}
+
+func (crawlWebTool) Name() string {
+	return "crawl_web"
+}
+
+func (crawlWebTool) Description() string {
+	return "Crawl the web for more information."
+}
+
+func (crawlWebTool) Parameters() map[string]any {
+	return stringParameters(
+		"url", "Fully qualified URL",
+		"purpose", "A detailed description of the user's needs.",
+	)
+}
+
+func (crawlWebTool) Guidance() string {
+	return "use crawl_web for information you're otherwise unable to provide. Avoid crawl_web when possible."
+}
+
+func (crawlWebTool) Payload(arguments string) string {
+	return arguments
+}
+
+func (crawlWebTool) Run(ctx context.Context, arguments string, w io.Writer) error {
+	_, err := StreamCrawlWeb(ctx, activeConfig.Model, arguments, "", w)
+	return err
+}
+
+// Crawl the site from the model's url and build the request that has the model
+// pull what the user is after out of the pages it read
+func buildCrawlWebRequest(ctx context.Context, provider Provider, carryoverJson string, model string) (map[string]any, error) {
 	type Json struct {
 		Url     string `json:"url"`
 		Purpose string `json:"purpose"`
 	}
 	var carryover Json
 	if err := json.Unmarshal([]byte(carryoverJson), &carryover); err != nil {
-		log.Fatalf("Error parsing JSON: %s", err)
+		return nil, classifyf(ErrBadToolArguments, "unable to parse crawl_web arguments: %w", err)
 	}
 	url := carryover.Url
 	purpose := carryover.Purpose
 
-	fmt.Println("crawling:", url)
-	fmt.Println("purpose:", purpose)
+	// Progress goes to stderr, so it can't be mistaken for the result
+	fmt.Fprintln(os.Stderr, "purpose:", purpose)
 
-	// Get the page content using lynx
-	// TODO This is hitting the web during unit tests
-	cmd := exec.Command("lynx", "-dump", url)
-	output, err := cmd.Output()
+	pages, err := newCrawler(provider, model, purpose, activeConfig.Crawl).crawl(ctx, url)
 	if err != nil {
-		fmt.Println("Error fetching page:", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("unable to fetch page: %w", err)
+	}
+
+	var pageTexts []string
+	for i, page := range pages {
+		pageTexts = append(pageTexts, fmt.Sprintf("Page %d of %d\n%s", i+1, len(pages), page))
+	}
+
+	// Pages too big to read at once are read in chunks, and the notes taken
+	// on them are what the answer comes from
+	if allPages := strings.Join(pageTexts, "\n\n"); countTokens(model, allPages) > chunkTokens(model) {
+		notes, err := condense(ctx, provider, model, purpose, allPages)
+		if err != nil {
+			return nil, err
+		}
+		pageTexts = []string{"Notes taken while reading the pages:\n\n" + notes}
 	}
-	page := string(output)
 
 	Data := map[string]any{
-		"max_tokens":  703,
-		"temperature": 0,
+		"max_tokens":  activeConfig.MaxTokens,
+		"temperature": activeConfig.Temperature,
 		"model":       model,
 		"messages": []map[string]any{
-			{"role": "system", "content": "You are an information extraction system. You'll be given a parsed web page and a goal, usually to extract information from the parsed page. You should call report_information with the extracted information."},
-			{"role": "user", "content": page},
+			{"role": "system", "content": "You are an information extraction system. You'll be given one or more parsed web pages and a goal, usually to extract information from the parsed pages. You should call report_information with the extracted information."},
 			{"role": "system", "content": purpose},
 			{"role": "user", "content": "only call a single tool/function once"},
 		},
@@ -55,13 +99,13 @@ func buildCrawlWebRequest(carryoverJson string, model string) map[string]any {
 				"type": "function",
 				"function": map[string]any{
 					"name":        "report_information",
-					"description": "DEFAULT - Report with the requested information.",
+					"description": toolDescription("report_information", "DEFAULT - Report with the requested information."),
 					"parameters": map[string]any{
 						"type": "object",
 						"properties": map[string]any{
 							"str": map[string]any{
 								"type":        "string",
-								"description": "The information the user is looking for from the supplied web page.",
+								"description": "The information the user is looking for from the supplied web pages.",
 							},
 						},
 						"required": []string{"str"},
@@ -71,67 +115,116 @@ func buildCrawlWebRequest(carryoverJson string, model string) map[string]any {
 		},
 	}
 
-	return Data
-}
+	// The pages go after the instructions, trimmed to what's left of the
+	// context window, the first pages first
+	messages := Data["messages"].([]map[string]any)
+	room := tokensLeft(model, requestTokens(model, Data))
+	pageMessages := []map[string]any{messages[0]}
+	for _, pageText := range pageTexts {
+		pageText = truncateTokens(model, pageText, room)
+		room = max(room-countTokens(model, pageText)-4, 0)
+		pageMessages = append(pageMessages, map[string]any{"role": "user", "content": pageText})
+	}
+	Data["messages"] = append(pageMessages, messages[1:]...)
 
-func CrawlWeb(model string, carryoverJson string, openaiUrl string) (*OpenAICompletionResponse, error) {
-	if openaiUrl == "" {
-		openaiUrl = "https://api.openai.com/v1/chat/completions"
+	if err := checkCompletionBudget(fmt.Sprintf("Reading %d crawled page(s)", len(pages)), model, Data); err != nil {
+		return nil, err
 	}
 
-	prompt := buildCrawlWebRequest(carryoverJson, model)
+	return Data, nil
+}
+
+// Crawl and extract, all of it within the crawl timeout
+func CrawlWeb(ctx context.Context, model string, carryoverJson string, openaiUrl string) (*OpenAICompletionResponse, error) {
+	return withTimeout(ctx, "crawl_web", activeConfig.Timeouts.Crawl, func(ctx context.Context) (*OpenAICompletionResponse, error) {
+		provider, err := NewProvider(openaiUrl)
+		if err != nil {
+			return nil, err
+		}
+
+		prompt, err := buildCrawlWebRequest(ctx, provider, carryoverJson, model)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := chatCompletion(ctx, provider, prompt)
+		recordCompletionUsage("crawl_web", model, resp)
+		return resp, err
+	})
+}
 
-	promptBytes, err := json.Marshal(prompt)
+// Like CrawlWeb followed by HandleCrawlWebResponse, except that the extracted
+// information is written to w as it arrives
+func StreamCrawlWeb(ctx context.Context, model string, carryoverJson string, openaiUrl string, w io.Writer) (*OpenAICompletionResponse, error) {
+	provider, err := NewProvider(openaiUrl)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create an HTTP request
-	req, err := http.NewRequest("POST", openaiUrl, bytes.NewBuffer(promptBytes))
+	written := 0
+	writeReport := toolCallFieldWriter(w, "report_information", "str", &written)
+	gate := &contentGate{
+		write:  func(text string) { fmt.Fprint(w, text) },
+		onStop: func() { fmt.Fprintln(w) },
+	}
+	resp, err := withTimeout(ctx, "crawl_web", activeConfig.Timeouts.Crawl, func(ctx context.Context) (*OpenAICompletionResponse, error) {
+		prompt, err := buildCrawlWebRequest(ctx, provider, carryoverJson, model)
+		if err != nil {
+			return nil, err
+		}
+
+		return streamChatCompletion(ctx, provider, prompt, StreamHandler{
+			OnContent: gate.content,
+			OnToolCall: func(name string, argumentsSoFar string) {
+				gate.toolCall()
+				writeReport(name, argumentsSoFar)
+			},
+		})
+	})
 	if err != nil {
 		return nil, err
 	}
+	recordCompletionUsage("crawl_web", model, resp)
 
-	openaiApiKey := os.Getenv("OPENAI_API_KEY")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", openaiApiKey))
-	req.Header.Add("Content-Type", "application/json")
+	if err := getError(*resp); err != nil {
+		return resp, err
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
+	if gate.answered() || written > 0 {
+		fmt.Fprintln(w)
+		return resp, nil
 	}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
+	return resp, HandleCrawlWebResponse(*resp)
+}
+
+func HandleCrawlWebResponse(resp OpenAICompletionResponse) error {
+	result, err := getCrawlWebResult(resp)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var obj OpenAICompletionResponse
-	if err := json.Unmarshal(body, &obj); err != nil {
-		return nil, err
-	}
+	// Tell the user of what the AI found
+	fmt.Println(result)
 
-	return &obj, nil
+	return nil
 }
 
-func HandleCrawlWebResponse(resp OpenAICompletionResponse) error {
+// Pull what the AI found off of a crawl web response
+func getCrawlWebResult(resp OpenAICompletionResponse) (string, error) {
 	if err := getError(resp); err != nil {
-		return err
+		return "", err
 	}
 
 	if message := getMessageContent(resp); message != "" {
-		fmt.Println(message)
-		return nil
+		return message, nil
 	}
 
 	args := getToolcallArguments(resp)
 
 	// If we've made it this far, there should be function arguments
 	if args == "" {
-		log.Fatalln("No function arguments found")
-
+		return "", classifyf(ErrBadResponse, "no function arguments found")
 	}
 
 	var argsStruct struct {
@@ -139,11 +232,8 @@ func HandleCrawlWebResponse(resp OpenAICompletionResponse) error {
 	}
 
 	if err := json.Unmarshal([]byte(args), &argsStruct); err != nil {
-		return err
+		return "", classifyf(ErrBadResponse, "unable to parse report_information arguments: %w", err)
 	}
 
-	// Tell the user of what the AI found
-	fmt.Println(argsStruct.Str)
-
-	return nil
+	return argsStruct.Str, nil
 }
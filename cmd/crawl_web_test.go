@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -31,7 +32,7 @@ func TestCrawlWeb(t *testing.T) {
 
 	carryoverJson := `{"purpose": "do something", "url": "` + server.URL + `"}`
 
-	resp, _ := CrawlWeb("gpt-3.5", carryoverJson, server.URL)
+	resp, _ := CrawlWeb(context.Background(), "gpt-3.5", carryoverJson, server.URL)
 	HandleCrawlWebResponse(*resp)
 }
 
@@ -47,6 +48,6 @@ func TestCrawlWeb(t *testing.T) {
 
 // 	defer server.Close()
 
-// 	resp := GenImage("model-doesnt-matter", badJson, server.URL)
+// 	resp := GenImage(context.Background(), "model-doesnt-matter", badJson, server.URL)
 // 	HandleGenImageResponse(resp)
 // }
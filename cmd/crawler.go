@@ -0,0 +1,292 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The most links the model is shown when choosing which to follow
+const maxLinkCandidates = 100
+
+// How far crawl_web may wander from the page the model asked for
+type CrawlConfig struct {
+	// Levels of links followed from the first page. 0 reads only that page.
+	MaxDepth int `mapstructure:"max_depth" yaml:"max_depth"`
+	// Pages read in all, the first included
+	MaxPages int `mapstructure:"max_pages" yaml:"max_pages"`
+	// Pages fetched at once
+	Concurrency int `mapstructure:"concurrency" yaml:"concurrency"`
+	// Milliseconds between requests to the same host
+	HostDelay int `mapstructure:"host_delay" yaml:"host_delay"`
+}
+
+// Reads a site for a purpose: the first page, then the links on it the model
+// thinks are worth following, and so on, level by level
+type crawler struct {
+	provider Provider
+	model    string
+	purpose  string
+	config   CrawlConfig
+	limiter  *hostLimiter
+	robots   *robotsCache
+	visited  map[string]bool
+}
+
+func newCrawler(provider Provider, model string, purpose string, config CrawlConfig) *crawler {
+	return &crawler{
+		provider: provider,
+		model:    model,
+		purpose:  purpose,
+		config:   config,
+		limiter:  newHostLimiter(time.Duration(config.HostDelay) * time.Millisecond),
+		robots:   newRobotsCache(),
+		visited:  map[string]bool{},
+	}
+}
+
+// Crawl from startUrl, returning the pages read in the order they were read.
+// Only the first page failing is an error, the rest are skipped with a warning.
+func (c *crawler) crawl(ctx context.Context, startUrl string) ([]*WebPage, error) {
+	if !c.robots.allowed(ctx, startUrl) {
+		return nil, fmt.Errorf("robots.txt disallows crawling %s", startUrl)
+	}
+
+	c.visited[normalizeLink(startUrl)] = true
+	first, err := c.fetch(ctx, startUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	pages := []*WebPage{first}
+	level := []*WebPage{first}
+
+	for depth := 1; depth <= c.config.MaxDepth && len(pages) < c.config.MaxPages; depth++ {
+		candidates := c.candidateLinks(ctx, first.URL, level)
+		if len(candidates) == 0 {
+			break
+		}
+
+		chosen := c.chooseLinks(ctx, pages, candidates, c.config.MaxPages-len(pages))
+		if len(chosen) == 0 {
+			break
+		}
+
+		fmt.Fprintf(os.Stderr, "following %d link(s)\n", len(chosen))
+		level = c.fetchAll(ctx, chosen)
+		pages = append(pages, level...)
+	}
+
+	// Skipped pages don't fail the crawl, but being stopped does
+	if ctx.Err() != nil {
+		return nil, networkError(ctx.Err())
+	}
+
+	return pages, nil
+}
+
+func (c *crawler) fetch(ctx context.Context, pageUrl string) (*WebPage, error) {
+	if parsed, err := url.Parse(pageUrl); err == nil {
+		if err := c.limiter.wait(ctx, parsed.Host); err != nil {
+			return nil, err
+		}
+	}
+
+	// Progress goes to stderr, so it can't be mistaken for the result
+	fmt.Fprintln(os.Stderr, "crawling:", pageUrl)
+
+	return fetchPage(ctx, pageUrl)
+}
+
+// Fetch the urls, config.Concurrency at a time, keeping their order
+func (c *crawler) fetchAll(ctx context.Context, urls []string) []*WebPage {
+	concurrency := c.config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]*WebPage, len(urls))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, pageUrl := range urls {
+		wg.Add(1)
+		go func(i int, pageUrl string) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			page, err := c.fetch(ctx, pageUrl)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "skipping page:", err)
+				return
+			}
+			results[i] = page
+		}(i, pageUrl)
+	}
+	wg.Wait()
+
+	var pages []*WebPage
+	for _, page := range results {
+		if page != nil {
+			pages = append(pages, page)
+		}
+	}
+	return pages
+}
+
+// Links on the pages that stay on the site, haven't been read yet, and
+// robots.txt allows. A link is only ever offered to the model once.
+func (c *crawler) candidateLinks(ctx context.Context, siteUrl string, pages []*WebPage) []WebLink {
+	var candidates []WebLink
+	for _, page := range pages {
+		for _, link := range page.Links {
+			key := normalizeLink(link.URL)
+			if c.visited[key] || !sameSite(siteUrl, link.URL) || !c.robots.allowed(ctx, link.URL) {
+				continue
+			}
+
+			c.visited[key] = true
+			candidates = append(candidates, link)
+			if len(candidates) == maxLinkCandidates {
+				return candidates
+			}
+		}
+	}
+	return candidates
+}
+
+// Ask the model which of the candidates are worth reading for the purpose,
+// up to budget of them. Anything it makes up that isn't a candidate is ignored.
+func (c *crawler) chooseLinks(ctx context.Context, pages []*WebPage, candidates []WebLink, budget int) []string {
+	resp, err := chatCompletion(ctx, c.provider, buildFollowLinksRequest(c.model, c.purpose, pages, candidates, budget))
+	recordCompletionUsage("crawl_web", c.model, resp)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "unable to choose links to follow:", err)
+		return nil
+	}
+	if err := getError(*resp); err != nil {
+		fmt.Fprintln(os.Stderr, "unable to choose links to follow:", err)
+		return nil
+	}
+
+	var args struct {
+		Urls []string `json:"urls"`
+	}
+	json.Unmarshal([]byte(getToolcallArguments(*resp)), &args)
+
+	isCandidate := map[string]bool{}
+	for _, link := range candidates {
+		isCandidate[link.URL] = true
+	}
+
+	var chosen []string
+	for _, pageUrl := range args.Urls {
+		if isCandidate[pageUrl] && len(chosen) < budget {
+			chosen = append(chosen, pageUrl)
+			isCandidate[pageUrl] = false
+		}
+	}
+	return chosen
+}
+
+func buildFollowLinksRequest(model string, purpose string, pages []*WebPage, candidates []WebLink, budget int) map[string]any {
+	var read strings.Builder
+	for _, page := range pages {
+		fmt.Fprintf(&read, "- %s %s\n", page.URL, page.Title)
+	}
+
+	var links strings.Builder
+	for _, link := range candidates {
+		fmt.Fprintf(&links, "- %s %s\n", link.URL, link.Text)
+	}
+
+	return map[string]any{
+		"max_tokens":  activeConfig.MaxTokens,
+		"temperature": activeConfig.Temperature,
+		"model":       model,
+		"messages": []map[string]any{
+			{"role": "system", "content": "You are helping crawl a website. Given what the user is looking for, the pages read so far and the links found on them, choose which links are worth reading next by calling follow_links. Choose none if the pages already read have what the user is looking for."},
+			{"role": "system", "content": purpose},
+			{"role": "user", "content": "Pages read so far:\n" + read.String()},
+			{"role": "user", "content": "Links found on them:\n" + links.String()},
+		},
+		"tools": []map[string]any{
+			{
+				"type": "function",
+				"function": map[string]any{
+					"name":        "follow_links",
+					"description": fmt.Sprintf("Read the linked pages. Choose at most %d, the most promising first.", budget),
+					"parameters": map[string]any{
+						"type": "object",
+						"properties": map[string]any{
+							"urls": map[string]any{
+								"type":        "array",
+								"items":       map[string]any{"type": "string"},
+								"description": "Urls exactly as they were listed, or an empty list to stop",
+							},
+						},
+						"required": []string{"urls"},
+					},
+				},
+			},
+		},
+	}
+}
+
+// The link without its fragment or a trailing slash, so that the same page
+// isn't read twice
+func normalizeLink(link string) string {
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return link
+	}
+	parsed.Fragment = ""
+	parsed.Path = strings.TrimSuffix(parsed.Path, "/")
+	return parsed.String()
+}
+
+// Whether both urls are on the same site, www. or not
+func sameSite(a string, b string) bool {
+	parsedA, errA := url.Parse(a)
+	parsedB, errB := url.Parse(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	return strings.TrimPrefix(parsedA.Hostname(), "www.") == strings.TrimPrefix(parsedB.Hostname(), "www.")
+}
+
+// Spaces out requests to each host by delay
+type hostLimiter struct {
+	mu    sync.Mutex
+	delay time.Duration
+	next  map[string]time.Time
+}
+
+func newHostLimiter(delay time.Duration) *hostLimiter {
+	return &hostLimiter{delay: delay, next: map[string]time.Time{}}
+}
+
+// Block until it's host's turn, or ctx is done
+func (l *hostLimiter) wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	now := time.Now()
+	turn := l.next[host]
+	if turn.Before(now) {
+		turn = now
+	}
+	l.next[host] = turn.Add(l.delay)
+	l.mu.Unlock()
+
+	return sleepContext(ctx, time.Until(turn))
+}
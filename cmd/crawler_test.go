@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A small news site with a robots.txt
+func newsSite(t *testing.T) string {
+	pages := map[string]string{
+		"/":           `<main><h1>News</h1><a href="/news/1">Lion cubs born</a> <a href="/news/2">Weather</a> <a href="/private/drafts">Drafts</a> <a href="https://elsewhere.example.com/">Elsewhere</a></main>`,
+		"/news/1":     `<article><h1>Lion cubs born</h1><p>Three cubs were born at the zoo.</p><a href="/news/1/photos">Photos</a></article>`,
+		"/news/2":     `<article><h1>Weather</h1><p>Sunny.</p></article>`,
+		"/robots.txt": "User-agent: *\nDisallow: /private\n",
+	}
+
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, ".txt") {
+			w.Header().Set("Content-Type", "text/plain")
+		} else {
+			w.Header().Set("Content-Type", "text/html")
+		}
+		w.Write([]byte(page))
+	})
+
+	return server.URL
+}
+
+func useCrawlConfig(t *testing.T, config CrawlConfig) {
+	previous := activeConfig
+	activeConfig.Crawl = config
+	t.Cleanup(func() { activeConfig = previous })
+}
+
+func followLinksResponse(urls ...string) string {
+	args, _ := json.Marshal(map[string]any{"urls": urls})
+	arguments, _ := json.Marshal(string(args))
+	return fmt.Sprintf(`{"choices": [{"message": {"tool_calls": [{"function": {"name": "follow_links", "arguments": %s}}]}}]}`, arguments)
+}
+
+func TestCrawler_FollowsChosenLinks(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	useCrawlConfig(t, CrawlConfig{MaxDepth: 1, MaxPages: 5, Concurrency: 2})
+	site := newsSite(t)
+
+	server, requests := sequenceServer(t, []string{
+		// Made up and disallowed urls should be ignored
+		followLinksResponse(site+"/news/1", site+"/private/drafts", "https://made.up.example.com/"),
+		`{"choices": [{"message": {"tool_calls": [{"function": {"name": "report_information", "arguments": "{\"str\": \"Three lion cubs were born\"}"}}]}}]}`,
+	})
+
+	resp, err := CrawlWeb(context.Background(), "gpt-4o", `{"url": "`+site+`/", "purpose": "latest headline"}`, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if result, _ := getCrawlWebResult(*resp); result != "Three lion cubs were born" {
+		t.Errorf("unexpected result %q", result)
+	}
+
+	if len(*requests) != 2 {
+		t.Fatalf("expected a follow_links request and an extraction request, got %d", len(*requests))
+	}
+
+	choosing, _ := json.Marshal((*requests)[0]["messages"])
+	if !strings.Contains(string(choosing), site+"/news/2") {
+		t.Errorf("expected /news/2 to be offered, got %s", choosing)
+	}
+	for _, unwanted := range []string{"/private/drafts", "elsewhere.example.com"} {
+		if strings.Contains(string(choosing), unwanted) {
+			t.Errorf("expected %s not to be offered, got %s", unwanted, choosing)
+		}
+	}
+
+	extracting, _ := json.Marshal((*requests)[1]["messages"])
+	for _, want := range []string{"Page 1 of 2", "Page 2 of 2", "Three cubs were born at the zoo."} {
+		if !strings.Contains(string(extracting), want) {
+			t.Errorf("expected the extraction request to have %q, got %s", want, extracting)
+		}
+	}
+	if strings.Contains(string(extracting), "Sunny") {
+		t.Errorf("expected /news/2 not to have been read, got %s", extracting)
+	}
+}
+
+func TestCrawler_DepthZeroReadsOnePage(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	useCrawlConfig(t, CrawlConfig{MaxDepth: 0, MaxPages: 5, Concurrency: 1})
+	site := newsSite(t)
+
+	server, requests := sequenceServer(t, []string{
+		`{"choices": [{"message": {"content": "News"}}]}`,
+	})
+
+	if _, err := CrawlWeb(context.Background(), "gpt-4o", `{"url": "`+site+`/", "purpose": "latest headline"}`, server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*requests) != 1 {
+		t.Errorf("expected only the extraction request, got %d", len(*requests))
+	}
+}
+
+func TestStreamCrawlWeb_PreambleSetApart(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	useCrawlConfig(t, CrawlConfig{MaxDepth: 0, MaxPages: 5, Concurrency: 1})
+	site := newsSite(t)
+
+	server := sseServer(t, []string{
+		`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "Here's what I found:"}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "report_information", "arguments": "{\"str\": \"Three lion "}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"content": " more preamble"}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "cubs were born\"}"}}]}}]}`,
+	})
+
+	var output strings.Builder
+	if _, err := StreamCrawlWeb(context.Background(), "gpt-4o", `{"url": "`+site+`/", "purpose": "latest headline"}`, server.URL, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	if output.String() != "Here's what I found:\nThree lion cubs were born\n" {
+		t.Errorf("expected the preamble on its own line, then the report, got %q", output.String())
+	}
+}
+
+func TestCrawler_RobotsDisallowsStart(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	site := newsSite(t)
+	server, _ := sequenceServer(t, nil)
+
+	_, err := CrawlWeb(context.Background(), "gpt-4o", `{"url": "`+site+`/private/drafts", "purpose": "drafts"}`, server.URL)
+	if err == nil || !strings.Contains(err.Error(), "robots.txt") {
+		t.Errorf("expected robots.txt to stop the crawl, got %v", err)
+	}
+}
+
+func TestRobots_Rules(t *testing.T) {
+	rules := parseRobots(`
+User-agent: somebot
+Disallow: /
+
+User-agent: *
+Disallow: /search
+Disallow: /*.pdf$
+Allow: /search/about
+`)
+
+	for path, want := range map[string]bool{
+		"/":                  true,
+		"/search?q=lions":    false,
+		"/search/about":      true,
+		"/files/report.pdf":  false,
+		"/files/report.pdfx": true,
+	} {
+		if got := rules.allowed(path); got != want {
+			t.Errorf("%s: expected allowed to be %v", path, want)
+		}
+	}
+
+	ours := parseRobots("User-agent: *\nDisallow: /\n\nUser-agent: ai-functions\nDisallow:\n")
+	if !ours.allowed("/anything") {
+		t.Error("expected our own group to win over *")
+	}
+}
+
+func TestHostLimiter(t *testing.T) {
+	limiter := newHostLimiter(50 * time.Millisecond)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limiter.wait(context.Background(), "example.com")
+		}()
+	}
+	limiter.wait(context.Background(), "other.example.com")
+	wg.Wait()
+
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("expected requests to one host to be spaced out, all three took %s", elapsed)
+	}
+}
@@ -0,0 +1,264 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// What kind of failure an error is. Each class has its own exit code, and is
+// the second word of the `error <class> <message>` line the shell acts on.
+type ErrorClass string
+
+const (
+	// Anything not more specific
+	ErrOther ErrorClass = "other"
+	// Bad flags or arguments
+	ErrUsage ErrorClass = "usage"
+	// A config that can't be loaded or doesn't validate
+	ErrConfig ErrorClass = "config"
+	// A missing, wrong or unauthorized API key
+	ErrAuth ErrorClass = "auth"
+	// Rate limited or out of quota, once retries have given up
+	ErrRateLimit ErrorClass = "rate_limit"
+	// The prompt is too big for the model
+	ErrContextLength ErrorClass = "context_length"
+	// The prompt or the response tripped the provider's content filter
+	ErrContentFilter ErrorClass = "content_filter"
+	// The api couldn't be reached
+	ErrNetwork ErrorClass = "network"
+	// The api answered with an error that's none of the above
+	ErrAPI ErrorClass = "api"
+	// The api answered with something that can't be made sense of, like an html
+	// error page from a proxy
+	ErrBadResponse ErrorClass = "bad_response"
+	// The model called a tool with arguments it can't use
+	ErrBadToolArguments ErrorClass = "bad_tool_arguments"
+	// A tool the model called failed to run
+	ErrToolFailed ErrorClass = "tool_failed"
+	// The call was refused for its cost
+	ErrBudget ErrorClass = "budget"
+	// A stage ran past its timeout
+	ErrTimeout ErrorClass = "timeout"
+	// Cancelled by Ctrl-C or SIGTERM
+	ErrInterrupted ErrorClass = "interrupted"
+)
+
+// The process exits with these, so scripts can tell failures apart
+var exitCodes = map[ErrorClass]int{
+	ErrOther:            1,
+	ErrUsage:            2,
+	ErrConfig:           3,
+	ErrAuth:             4,
+	ErrRateLimit:        5,
+	ErrContextLength:    6,
+	ErrContentFilter:    7,
+	ErrNetwork:          8,
+	ErrAPI:              9,
+	ErrBadResponse:      10,
+	ErrBadToolArguments: 11,
+	ErrToolFailed:       12,
+	ErrBudget:           13,
+	ErrTimeout:          14,
+	// 128 plus SIGINT, like a shell reports it
+	ErrInterrupted: 130,
+}
+
+// An error along with its class
+type ClassifiedError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *ClassifiedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClassifiedError) Unwrap() error {
+	return e.Err
+}
+
+// Give err a class. An error that already has one keeps it, since the closer
+// to the failure it was classified the more specific it is.
+func classify(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	var classified *ClassifiedError
+	if errors.As(err, &classified) {
+		return err
+	}
+
+	return &ClassifiedError{Class: class, Err: err}
+}
+
+// Shorthand for classify with fmt.Errorf
+func classifyf(class ErrorClass, format string, args ...any) error {
+	return classify(class, fmt.Errorf(format, args...))
+}
+
+// The class of err, ErrOther if it doesn't have one
+func errorClass(err error) ErrorClass {
+	var classified *ClassifiedError
+	if errors.As(err, &classified) {
+		return classified.Class
+	}
+	return ErrOther
+}
+
+// What the process should exit with for err
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if code, ok := exitCodes[errorClass(err)]; ok {
+		return code
+	}
+	return 1
+}
+
+// Classify an error sending a request or reading its response, telling being
+// cancelled or timing out apart from the api being unreachable
+func networkError(err error) error {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return classify(ErrInterrupted, err)
+	case errors.Is(err, context.DeadlineExceeded):
+		return classify(ErrTimeout, err)
+	}
+	return classify(ErrNetwork, err)
+}
+
+// Write the `error <class> <message>` line for err, with the message kept to
+// the one line. The other output formats get an error record, whose payload
+// is the message as is.
+func writeError(w io.Writer, err error) {
+	if outputFormat == FormatPrefix {
+		fmt.Fprintln(w, "error", errorClass(err), strings.Join(strings.Fields(err.Error()), " "))
+		return
+	}
+
+	writeRecord(w, Record{
+		Action:  "error",
+		Payload: err.Error(),
+		Metadata: map[string]string{
+			"class":     string(errorClass(err)),
+			"exit_code": strconv.Itoa(exitCode(err)),
+		},
+	})
+}
+
+// An error whose line has already been written, so it only sets the exit code
+type reportedError struct {
+	err error
+}
+
+func (e reportedError) Error() string {
+	return e.err.Error()
+}
+
+func (e reportedError) Unwrap() error {
+	return e.err
+}
+
+// Write err's line, or record, to w, returning it marked as written
+func report(w io.Writer, err error) error {
+	if err == nil {
+		return nil
+	}
+	writeError(w, err)
+	return reportedError{err}
+}
+
+// The class of an error the api reported, going by the http status if there is
+// one, and by the code, type and message the providers use
+func apiErrorClass(status int, code string, errorType string, message string) ErrorClass {
+	code = strings.ToLower(code)
+	errorType = strings.ToLower(errorType)
+	message = strings.ToLower(message)
+	has := func(needles ...string) bool {
+		for _, needle := range needles {
+			if strings.Contains(code, needle) || strings.Contains(errorType, needle) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden ||
+		has("invalid_api_key", "authentication", "permission", "unauthenticated") ||
+		strings.Contains(message, "api key"):
+		return ErrAuth
+	case status == http.StatusTooManyRequests || has("rate_limit", "insufficient_quota", "resource_exhausted"):
+		return ErrRateLimit
+	case status == http.StatusRequestEntityTooLarge || has("context_length") ||
+		strings.Contains(message, "context length") || strings.Contains(message, "context window") ||
+		strings.Contains(message, "prompt is too long") || strings.Contains(message, "maximum context"):
+		return ErrContextLength
+	case has("content_filter", "content_policy") || strings.Contains(message, "content management policy") ||
+		strings.Contains(message, "content filter"):
+		return ErrContentFilter
+	}
+	return ErrAPI
+}
+
+// The error in an api response body with status, which isn't a success.
+// Providers wrap their errors a few different ways, and a proxy in between may
+// answer with an html page instead.
+func apiStatusError(status int, body []byte) error {
+	var obj struct {
+		Error   json.RawMessage `json:"error"`
+		Message string          `json:"message"`
+	}
+
+	if err := json.Unmarshal(body, &obj); err == nil {
+		var detail struct {
+			OpenAIError
+			// Gemini's code is the http status, its status is the useful part
+			Status string `json:"status"`
+		}
+		var message string
+
+		if json.Unmarshal(obj.Error, &detail) == nil && detail.fullMessage() != "" {
+			errorType := detail.Type
+			if errorType == "" {
+				errorType = detail.Status
+			}
+			return classify(apiErrorClass(status, string(detail.Code), errorType, detail.Message), errors.New(detail.fullMessage()))
+		} else if json.Unmarshal(obj.Error, &message) == nil && message != "" {
+			return classify(apiErrorClass(status, "", "", message), errors.New(message))
+		} else if obj.Message != "" {
+			return classify(apiErrorClass(status, "", "", obj.Message), errors.New(obj.Message))
+		}
+	}
+
+	return classifyf(apiErrorClass(status, "", "", ""), "%d %s: %s", status, http.StatusText(status), snippet(body))
+}
+
+// The start of a body, on one line, for error messages
+func snippet(body []byte) string {
+	text := strings.Join(strings.Fields(string(body)), " ")
+	if len(text) > 200 {
+		text = text[:200] + "..."
+	}
+	if text == "" {
+		text = "(empty body)"
+	}
+	return text
+}
+
+// An error for a body that should have been json and wasn't
+func unexpectedBody(from string, body []byte) error {
+	return classifyf(ErrBadResponse, "unexpected response from %s: %s", from, snippet(body))
+}
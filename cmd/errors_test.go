@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestErrors_FromStatus(t *testing.T) {
+	previous := activeConfig
+	activeConfig.MaxRetries = 0
+	t.Cleanup(func() { activeConfig = previous })
+
+	for _, test := range []struct {
+		status  int
+		body    string
+		class   ErrorClass
+		message string
+	}{
+		{401, `{"error": {"message": "Incorrect API key provided", "type": "invalid_request_error", "code": "invalid_api_key"}}`, ErrAuth, "Incorrect API key provided"},
+		{429, `{"error": {"code": 429, "message": "Quota exceeded", "status": "RESOURCE_EXHAUSTED"}}`, ErrRateLimit, "Quota exceeded"},
+		{400, `{"error": {"message": "This model's maximum context length is 8192 tokens", "code": "context_length_exceeded"}}`, ErrContextLength, "This model's maximum context length is 8192 tokens"},
+		{400, `{"type": "error", "error": {"type": "invalid_request_error", "message": "prompt is too long: 210000 tokens > 200000 maximum"}}`, ErrContextLength, "prompt is too long: 210000 tokens > 200000 maximum"},
+		{400, `{"error": {"message": "Your request was rejected", "code": "content_policy_violation"}}`, ErrContentFilter, "Your request was rejected"},
+		{404, `{"error": "model \"llama3.1\" not found, try pulling it first"}`, ErrAPI, `model "llama3.1" not found, try pulling it first`},
+		{502, "<html>\n<head><title>502 Bad Gateway</title></head>\n</html>", ErrAPI, "502 Bad Gateway: <html> <head><title>502 Bad Gateway</title></head> </html>"},
+	} {
+		server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		})
+
+		var out OpenAICompletionResponse
+		err := postJSON(context.Background(), server.URL, nil, map[string]any{}, &out)
+		if errorClass(err) != test.class || err.Error() != test.message {
+			t.Errorf("%d %s: expected %s %q, got %s %v", test.status, test.body, test.class, test.message, errorClass(err), err)
+		}
+	}
+}
+
+func TestErrors_NotJSON(t *testing.T) {
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>Please sign in to the proxy</html>"))
+	})
+
+	var out OpenAICompletionResponse
+	err := postJSON(context.Background(), server.URL, nil, map[string]any{}, &out)
+	if errorClass(err) != ErrBadResponse || !strings.Contains(err.Error(), "Please sign in to the proxy") {
+		t.Errorf("expected a bad response saying what came back, got %s %v", errorClass(err), err)
+	}
+}
+
+func TestErrors_Network(t *testing.T) {
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {})
+	url := server.URL
+	server.Close()
+
+	previous := activeConfig
+	activeConfig.MaxRetries = 0
+	t.Cleanup(func() { activeConfig = previous })
+
+	var out OpenAICompletionResponse
+	if err := postJSON(context.Background(), url, nil, map[string]any{}, &out); errorClass(err) != ErrNetwork {
+		t.Errorf("expected a network error, got %s %v", errorClass(err), err)
+	}
+}
+
+func TestErrors_ToolArguments(t *testing.T) {
+	if _, err := GenImage(context.Background(), "gpt-4o", "{not json", ""); errorClass(err) != ErrBadToolArguments {
+		t.Errorf("expected bad gen_image arguments, got %s %v", errorClass(err), err)
+	}
+
+	err := RunTool(context.Background(), "crawl_web", "{not json", &bytes.Buffer{})
+	if errorClass(err) != ErrBadToolArguments || !strings.HasPrefix(err.Error(), "crawl_web failed:") {
+		t.Errorf("expected bad crawl_web arguments, got %s %v", errorClass(err), err)
+	}
+
+	var output bytes.Buffer
+	err = HandlePrimaryResponse(toolCallResponse("printz", `{"command": "ls`), &output)
+	if errorClass(err) != ErrBadToolArguments || !strings.HasPrefix(output.String(), "error bad_tool_arguments printz was called") {
+		t.Errorf("expected bad printz arguments to be reported, got %q", output.String())
+	}
+}
+
+func TestErrors_Line(t *testing.T) {
+	var output bytes.Buffer
+	err := report(&output, classifyf(ErrRateLimit, "slow down:\n%w", errors.New("try again in 20s")))
+
+	if output.String() != "error rate_limit slow down: try again in 20s\n" {
+		t.Errorf("expected one line, got %q", output.String())
+	}
+
+	var reported reportedError
+	if !errors.As(err, &reported) || exitCode(err) != exitCodes[ErrRateLimit] {
+		t.Errorf("expected the error back as reported, with its exit code, got %v", err)
+	}
+
+	if exitCode(errors.New("plain")) != 1 || exitCode(nil) != 0 {
+		t.Error("expected 1 for errors without a class, and 0 for none")
+	}
+
+	// An error keeps the class it was given first
+	wrapped := classify(ErrToolFailed, fmt.Errorf("crawl_web failed: %w", classifyf(ErrNetwork, "connection refused")))
+	if errorClass(wrapped) != ErrNetwork {
+		t.Errorf("expected the inner class, got %s", errorClass(wrapped))
+	}
+
+	codes := map[int]ErrorClass{}
+	for class, code := range exitCodes {
+		if other, taken := codes[code]; taken {
+			t.Errorf("%s and %s share exit code %d", class, other, code)
+		}
+		codes[code] = class
+	}
+}
+
+// A completion calling name with arguments
+func toolCallResponse(name string, arguments string) OpenAICompletionResponse {
+	completion, _ := translatedCompletion{
+		ToolCalls: []translatedToolCall{{Name: name, Arguments: arguments}},
+	}.toOpenAI()
+	return *completion
+}
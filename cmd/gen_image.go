@@ -5,83 +5,137 @@ Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
 package cmd
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
 	"os"
 	"os/exec"
 )
 
+// Generates images and opens them
+type genImageTool struct{}
+
+func init() {
+	registerTool(genImageTool{})
+}
+
+func (genImageTool) Name() string {
+	return "gen_image"
+}
+
+func (genImageTool) Description() string {
+	return "use this IF AND ONLY IF the user is EXPLICITLY requesting an image, with verbiage like Make me an image or Generate an image."
+}
+
+func (genImageTool) Parameters() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"n": map[string]any{
+				"type":        "integer",
+				"description": "1, unless otherwise specified by user",
+			},
+			"model": map[string]any{
+				"type":        "string",
+				"description": "Default to dall-e-2. If the user has requested a high quality image, then dall-e-3",
+			},
+			"size": map[string]any{
+				"type":        "string",
+				"description": "default to 1024x1024 unless the user specifies they want a specific size. If they specify a size, follow this guide: dall-e-2 supports sizes: 256x256 (small), 512x512 (medium), or 1024x1024 (default/large). dall-e-3 supports sizes: 1024x1024 (default), 1024x1792 (portrait) or 1792x1024 (landscape). If multiple images, all use the same size.",
+			},
+			"prompt": map[string]any{
+				"type":        "string",
+				"description": "What the user input, minus the parts about image quality, size, and portrait/landscape",
+			},
+		},
+		"required": []string{"n", "model", "size", "prompt"},
+	}
+}
+
+func (genImageTool) Guidance() string {
+	return "use gen_image only when explicitly asked for an image, like 'generate an image of ..', or 'make a high quality image of ..'."
+}
+
+func (genImageTool) Payload(arguments string) string {
+	return arguments
+}
+
+func (genImageTool) Run(ctx context.Context, arguments string, w io.Writer) error {
+	resp, err := GenImage(ctx, activeConfig.Model, arguments, "")
+	if err != nil {
+		return err
+	}
+
+	if err := HandleGenImageResponse(*resp); err != nil {
+		return err
+	}
+
+	for _, datum := range *resp.Data {
+		fmt.Fprintln(w, datum.Url)
+	}
+	return nil
+}
+
 type CarryoverJson struct {
-	N      int `json:"n"`
+	N      int    `json:"n"`
 	Model  string `json:"model"`
 	Size   string `json:"size"`
 	Prompt string `json:"prompt"`
 }
 
-func buildGenImageRequest(carryoverJson string, model string) CarryoverJson {
+func buildGenImageRequest(carryoverJson string, model string) (CarryoverJson, error) {
 	var params CarryoverJson
 	if err := json.Unmarshal([]byte(carryoverJson), &params); err != nil {
-		log.Fatalf("Error parsing JSON: %s", err)
+		return params, classifyf(ErrBadToolArguments, "unable to parse gen_image arguments: %w", err)
 	}
 
 	// currently dall-e-3 only will do one at a time
-	if params.Model == "dall-e-3" && params.N == 1 {
-		fmt.Println("Using dall-e-3, which limits parallel requests to 1")
+	if params.Model == "dall-e-3" && params.N != 1 {
+		fmt.Fprintln(os.Stderr, "Using dall-e-3, which limits parallel requests to 1")
 		params.N = 1
 	}
 
-	fmt.Printf(
+	// Progress goes to stderr, so it can't be mistaken for the result
+	fmt.Fprintf(os.Stderr,
 		"Generating %d image(s) using [%s], size: [%s] with prompt: %s\n",
 		params.N, params.Model, params.Size, params.Prompt,
 	)
 
-	return params
+	return params, nil
 }
 
-func GenImage(model string, carryoverJson string, url string) (*OpenAIImageGenerationResponse, error) {
-	if url == "" {
-		url = "https://api.openai.com/v1/images/generations"
-	}
-
-	genImageReqJson := buildGenImageRequest(carryoverJson, model)
-
-	promptBytes, err := json.Marshal(genImageReqJson)
+func GenImage(ctx context.Context, model string, carryoverJson string, url string) (*OpenAIImageGenerationResponse, error) {
+	provider, err := NewProvider(url)
 	if err != nil {
 		return nil, err
 	}
 
-	// Create an HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(promptBytes))
+	genImageReqJson, err := buildGenImageRequest(carryoverJson, model)
 	if err != nil {
 		return nil, err
 	}
 
-	openaiApiKey := os.Getenv("OPENAI_API_KEY")
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", openaiApiKey))
-	req.Header.Add("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
+	estimate, _ := UsageEntry{Model: genImageReqJson.Model, Images: genImageReqJson.N, ImageSize: genImageReqJson.Size}.Cost()
+	what := fmt.Sprintf("Generating %d %s image(s) with %s", genImageReqJson.N, genImageReqJson.Size, genImageReqJson.Model)
+	if err := checkBudget(what, estimate); err != nil {
 		return nil, err
 	}
 
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	resp, err := withTimeout(ctx, "generating images", activeConfig.Timeouts.Image, func(ctx context.Context) (*OpenAIImageGenerationResponse, error) {
+		return provider.GenerateImage(ctx, genImageReqJson)
+	})
+	if err == nil && resp.Data != nil {
+		recordUsage(UsageEntry{
+			Model:            genImageReqJson.Model,
+			Tool:             "gen_image",
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+			Images:           len(*resp.Data),
+			ImageSize:        genImageReqJson.Size,
+		})
 	}
-
-	var obj OpenAIImageGenerationResponse
-	if err := json.Unmarshal(body, &obj); err != nil {
-		return nil, err
-	}
-
-	return &obj, nil
+	return resp, err
 }
 
 func HandleGenImageResponse(resp OpenAIImageGenerationResponse) error {
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -18,7 +19,7 @@ func TestGenImage_Happy(t *testing.T) {
 
 	defer server.Close()
 
-	resp, _ := GenImage("gpt-3.5", carryoverJson, server.URL)
+	resp, _ := GenImage(context.Background(), "gpt-3.5", carryoverJson, server.URL)
 	HandleGenImageResponse(*resp)
 }
 
@@ -34,6 +35,6 @@ func TestGenImage_Sad(t *testing.T) {
 
 	defer server.Close()
 
-	resp, _ := GenImage("gpt-3.5", badJson, server.URL)
+	resp, _ := GenImage(context.Background(), "gpt-3.5", badJson, server.URL)
 	var _ = HandleGenImageResponse(*resp)
 }
@@ -0,0 +1,237 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Settings for the http client shared by every request this app makes
+type HTTPSettings struct {
+	// Base of an OpenAI compatible api, ex https://gateway.internal/openai/v1
+	BaseURL string
+	// Sent with every request, ex an org ID or a gateway token
+	Headers map[string]string
+	// Proxy for all requests. Falls back to the usual HTTPS_PROXY env vars.
+	Proxy string
+	// PEM file of extra CAs to trust, ex a corporate TLS intercepting proxy's
+	CABundle string
+}
+
+var (
+	sharedClient     *http.Client
+	sharedClientErr  error
+	sharedClientOnce sync.Once
+	httpSettings     = httpSettingsFromEnv()
+)
+
+func httpSettingsFromEnv() HTTPSettings {
+	return HTTPSettings{
+		BaseURL:  strings.TrimRight(os.Getenv("OPENAI_BASE_URL"), "/"),
+		Headers:  parseHeaders(os.Getenv("AI_EXTRA_HEADERS")),
+		Proxy:    os.Getenv("AI_HTTPS_PROXY"),
+		CABundle: os.Getenv("AI_CA_BUNDLE"),
+	}
+}
+
+// Parse headers like "OpenAI-Organization: org-123; X-Gateway-Token: abc".
+// Newlines work as separators too.
+func parseHeaders(headers string) map[string]string {
+	parsed := map[string]string{}
+	for _, header := range strings.FieldsFunc(headers, func(r rune) bool { return r == ';' || r == '\n' }) {
+		key, value, found := strings.Cut(header, ":")
+		if found && strings.TrimSpace(key) != "" {
+			parsed[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return parsed
+}
+
+// Replace the shared client's settings. The client is rebuilt on next use.
+func setHTTPSettings(settings HTTPSettings) {
+	httpSettings = settings
+	sharedClient = nil
+	sharedClientErr = nil
+	sharedClientOnce = sync.Once{}
+}
+
+func buildHTTPClient(settings HTTPSettings) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if settings.Proxy != "" {
+		proxyUrl, err := url.Parse(settings.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %w", settings.Proxy, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	if settings.CABundle != "" {
+		pem, err := os.ReadFile(settings.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", settings.CABundle)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Transport: transport}, nil
+}
+
+// The http client all requests go through
+func httpClient() (*http.Client, error) {
+	sharedClientOnce.Do(func() {
+		sharedClient, sharedClientErr = buildHTTPClient(httpSettings)
+	})
+	return sharedClient, sharedClientErr
+}
+
+// POST payload as json to url and unmarshal the response body into out
+func postJSON(ctx context.Context, url string, headers map[string]string, payload any, out any) error {
+	body, err := postRaw(ctx, url, headers, payload)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return unexpectedBody(url, body)
+	}
+	return nil
+}
+
+// POST payload as json to url and return the raw response body
+func postRaw(ctx context.Context, url string, headers map[string]string, payload any) ([]byte, error) {
+	req, err := newJSONRequest(ctx, url, headers, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return doRequest(req)
+}
+
+func newJSONRequest(ctx context.Context, url string, headers map[string]string, payload any) (*http.Request, error) {
+	payloadBytes, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Add("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Add(key, value)
+	}
+
+	return req, nil
+}
+
+// GET url and unmarshal the response body into out
+func getJSON(ctx context.Context, url string, headers map[string]string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	for key, value := range headers {
+		req.Header.Add(key, value)
+	}
+
+	body, err := doRequest(req)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return unexpectedBody(url, body)
+	}
+	return nil
+}
+
+// POST payload as json to url and hand back the response body unread, for
+// streaming. The caller must close it. An error status is read and returned as
+// an error instead.
+func postStream(ctx context.Context, url string, headers map[string]string, payload any) (io.ReadCloser, error) {
+	req, err := newJSONRequest(ctx, url, headers, payload)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "text/event-stream")
+
+	resp, err := send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return nil, apiStatusError(resp.StatusCode, body)
+	}
+
+	return resp.Body, nil
+}
+
+// Send req and read the whole response body. An error status comes back as
+// an error, classified by what the api said went wrong.
+func doRequest(req *http.Request) ([]byte, error) {
+	resp, err := send(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, networkError(err)
+	}
+
+	if resp.StatusCode >= 400 {
+		return nil, apiStatusError(resp.StatusCode, body)
+	}
+
+	return body, nil
+}
+
+// Send req through the shared client, with the configured extra headers,
+// retrying when it's rate limited or the api is unavailable
+func send(req *http.Request) (*http.Response, error) {
+	client, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range httpSettings.Headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := sendWithRetries(req, client.Do)
+	if err != nil {
+		return nil, networkError(err)
+	}
+	return resp, nil
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Swap in settings for the duration of a test
+func useHTTPSettings(t *testing.T, settings HTTPSettings) {
+	previous := httpSettings
+	setHTTPSettings(settings)
+	t.Cleanup(func() { setHTTPSettings(previous) })
+}
+
+func TestParseHeaders(t *testing.T) {
+	headers := parseHeaders("OpenAI-Organization: org-123; X-Gateway-Token: a:b\nbogus")
+
+	if len(headers) != 2 || headers["OpenAI-Organization"] != "org-123" || headers["X-Gateway-Token"] != "a:b" {
+		t.Errorf("unexpected headers: %v", headers)
+	}
+}
+
+func TestHTTP_BaseURLAndHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gateway/v1/chat/completions" {
+			t.Errorf("request did not go through the base url, path: %s", r.URL.Path)
+		}
+		if r.Header.Get("X-Gateway-Token") != "secret" {
+			t.Errorf("extra header missing, got headers: %v", r.Header)
+		}
+		w.Write([]byte(`{"choices": [{"message": {"content": "hi"}}]}`))
+	}))
+	defer server.Close()
+
+	useHTTPSettings(t, HTTPSettings{
+		BaseURL: server.URL + "/gateway/v1",
+		Headers: map[string]string{"X-Gateway-Token": "secret"},
+	})
+	t.Setenv("AI_PROVIDER", "openai")
+
+	if _, err := PerformPrimaryRequest(context.Background(), "gpt-4o", "hi", "Linux", ""); err != nil {
+		t.Fatal("primary request errored:", err)
+	}
+}
+
+func TestHTTP_Proxy(t *testing.T) {
+	proxied := false
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.Host == "api.example.test"
+		w.Write([]byte(`{"data": []}`))
+	}))
+	defer proxy.Close()
+
+	useHTTPSettings(t, HTTPSettings{Proxy: proxy.URL})
+
+	var out map[string]any
+	if err := getJSON(context.Background(), "http://api.example.test/v1/models", nil, &out); err != nil {
+		t.Fatal("request through proxy errored:", err)
+	}
+
+	if !proxied {
+		t.Error("request did not go through the proxy")
+	}
+}
+
+func TestHTTP_CABundle(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": []}`))
+	}))
+	defer server.Close()
+
+	var out map[string]any
+
+	// Without the bundle the server's self signed cert isn't trusted
+	useHTTPSettings(t, HTTPSettings{})
+	if err := getJSON(context.Background(), server.URL, nil, &out); err == nil {
+		t.Fatal("expected an untrusted certificate error")
+	}
+
+	bundle := filepath.Join(t.TempDir(), "ca.pem")
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(bundle, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	useHTTPSettings(t, HTTPSettings{CABundle: bundle})
+	if err := getJSON(context.Background(), server.URL, nil, &out); err != nil {
+		t.Error("request with CA bundle errored:", err)
+	}
+}
@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+// Keep the tool cache, usage ledger, sessions and config of the tests in a
+// temp dir, rather than the real ones in the home dir
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "ai-functions-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	for _, name := range []string{"XDG_CACHE_HOME", "XDG_STATE_HOME", "XDG_CONFIG_HOME"} {
+		os.Setenv(name, dir)
+	}
+	os.Unsetenv("AI_SESSIONS_DIR")
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,422 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// A link found in a page's content
+type WebLink struct {
+	URL  string
+	Text string
+}
+
+// Elements that never hold content worth reading
+var skippedElements = map[atom.Atom]bool{
+	atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+	atom.Nav: true, atom.Footer: true, atom.Aside: true, atom.Form: true,
+	atom.Iframe: true, atom.Svg: true, atom.Button: true, atom.Select: true,
+	atom.Dialog: true, atom.Head: true,
+}
+
+// Class and id words that mark page furniture rather than content
+var boilerplatePattern = regexp.MustCompile(`(?i)(^|[\s_-])(nav|navbar|menu|footer|sidebar|breadcrumbs?|cookie|banner|share|social|comments?|related|advert|ads|promo|newsletter|subscribe|popup|modal|skip)($|[\s_-])`)
+
+var boilerplateRoles = map[string]bool{
+	"navigation": true, "banner": true, "contentinfo": true, "complementary": true, "search": true, "dialog": true,
+}
+
+var whitespacePattern = regexp.MustCompile(`\s+`)
+var blankLinesPattern = regexp.MustCompile(`\n{3,}`)
+
+func attr(n *html.Node, key string) string {
+	value, _ := findAttr(n, key)
+	return value
+}
+
+// Whether n is navigation, a footer, an ad or the like
+func isBoilerplate(n *html.Node) bool {
+	if skippedElements[n.DataAtom] {
+		return true
+	}
+
+	if _, hidden := findAttr(n, "hidden"); hidden || attr(n, "aria-hidden") == "true" {
+		return true
+	}
+
+	if boilerplateRoles[attr(n, "role")] {
+		return true
+	}
+
+	// A header inside an article is the article's title, a page's header is
+	// its masthead
+	if n.DataAtom == atom.Header && !hasAncestor(n, atom.Article, atom.Main) {
+		return true
+	}
+
+	if n.DataAtom == atom.Body || n.DataAtom == atom.Main || n.DataAtom == atom.Article {
+		return false
+	}
+
+	return boilerplatePattern.MatchString(attr(n, "class")) || boilerplatePattern.MatchString(attr(n, "id"))
+}
+
+func findAttr(n *html.Node, key string) (string, bool) {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val, true
+		}
+	}
+	return "", false
+}
+
+func hasAncestor(n *html.Node, atoms ...atom.Atom) bool {
+	for p := n.Parent; p != nil; p = p.Parent {
+		for _, a := range atoms {
+			if p.DataAtom == a {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The element holding the page's main content: the article or main with the
+// most text, otherwise the body
+func mainContent(doc *html.Node) *html.Node {
+	var best, body *html.Node
+	bestLength := 0
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch {
+			case n.DataAtom == atom.Body:
+				body = n
+			case n.DataAtom == atom.Article || n.DataAtom == atom.Main || attr(n, "role") == "main":
+				if length := len(strings.TrimSpace(textContent(n))); length > bestLength {
+					best, bestLength = n, length
+				}
+			}
+		}
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			walk(c)
+		}
+	}
+	walk(doc)
+
+	// A short article on a page full of other content is probably a teaser
+	if best != nil && body != nil && bestLength*5 >= len(strings.TrimSpace(textContent(body))) {
+		return best
+	}
+	if body != nil {
+		return body
+	}
+	return doc
+}
+
+func textContent(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	if n.Type == html.ElementNode && isBoilerplate(n) {
+		return ""
+	}
+
+	var sb strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		sb.WriteString(textContent(c))
+	}
+	return sb.String()
+}
+
+func findElement(n *html.Node, a atom.Atom) *html.Node {
+	if n.Type == html.ElementNode && n.DataAtom == a {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, a); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// Turns the readable parts of an html document into markdown. Links are kept
+// as plain text in the markdown, and collected on the side.
+type markdownConverter struct {
+	sb    strings.Builder
+	base  *url.URL
+	links *[]WebLink
+	seen  map[string]bool
+	inPre bool
+}
+
+// Convert doc's main content to markdown, returning it along with the page's
+// title and links. base resolves relative links.
+func htmlToMarkdown(doc *html.Node, base *url.URL) (title string, markdown string, links []WebLink) {
+	if titleNode := findElement(doc, atom.Title); titleNode != nil {
+		title = strings.TrimSpace(whitespacePattern.ReplaceAllString(textContent(titleNode), " "))
+	}
+
+	if baseNode := findElement(doc, atom.Base); baseNode != nil && base != nil {
+		if href, err := base.Parse(attr(baseNode, "href")); err == nil {
+			base = href
+		}
+	}
+
+	c := &markdownConverter{base: base, links: &links, seen: map[string]bool{}}
+	c.children(mainContent(doc))
+
+	return title, cleanMarkdown(c.sb.String()), links
+}
+
+func cleanMarkdown(markdown string) string {
+	lines := strings.Split(markdown, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	markdown = strings.Join(lines, "\n")
+	return strings.TrimSpace(blankLinesPattern.ReplaceAllString(markdown, "\n\n"))
+}
+
+// A converter for a piece of the page, like a list item or table cell, that
+// shares this one's links
+func (c *markdownConverter) sub() *markdownConverter {
+	return &markdownConverter{base: c.base, links: c.links, seen: c.seen, inPre: c.inPre}
+}
+
+func (c *markdownConverter) convertChildren(n *html.Node) string {
+	sub := c.sub()
+	sub.children(n)
+	return cleanMarkdown(sub.sb.String())
+}
+
+func (c *markdownConverter) children(n *html.Node) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.node(child)
+	}
+}
+
+// Start a new block, separated from what came before by a blank line
+func (c *markdownConverter) blockBreak() {
+	c.sb.WriteString("\n\n")
+}
+
+func (c *markdownConverter) write(s string) {
+	if c.inPre {
+		c.sb.WriteString(s)
+		return
+	}
+
+	s = whitespacePattern.ReplaceAllString(s, " ")
+	current := c.sb.String()
+	if strings.HasPrefix(s, " ") && (current == "" || strings.HasSuffix(current, " ") || strings.HasSuffix(current, "\n")) {
+		s = strings.TrimLeft(s, " ")
+	}
+	c.sb.WriteString(s)
+}
+
+func (c *markdownConverter) node(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		c.write(n.Data)
+		return
+	case html.ElementNode:
+	default:
+		return
+	}
+
+	if isBoilerplate(n) {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		if text := oneLine(c.convertChildren(n)); text != "" {
+			c.blockBreak()
+			c.sb.WriteString(strings.Repeat("#", level) + " " + text)
+			c.blockBreak()
+		}
+	case atom.P, atom.Div, atom.Section, atom.Article, atom.Main, atom.Header, atom.Figure, atom.Figcaption, atom.Dl, atom.Details, atom.Summary:
+		c.blockBreak()
+		c.children(n)
+		c.blockBreak()
+	case atom.Dt, atom.Dd:
+		c.sb.WriteString("\n")
+		c.children(n)
+		c.sb.WriteString("\n")
+	case atom.Br:
+		c.sb.WriteString("\n")
+	case atom.Hr:
+		c.blockBreak()
+		c.sb.WriteString("---")
+		c.blockBreak()
+	case atom.Pre:
+		c.blockBreak()
+		sub := c.sub()
+		sub.inPre = true
+		sub.children(n)
+		c.sb.WriteString("```\n" + strings.Trim(sub.sb.String(), "\n") + "\n```")
+		c.blockBreak()
+	case atom.Code:
+		if c.inPre {
+			c.children(n)
+		} else if text := oneLine(c.convertChildren(n)); text != "" {
+			c.write("`" + text + "`")
+		}
+	case atom.Strong, atom.B:
+		c.wrapInline(n, "**")
+	case atom.Em, atom.I:
+		c.wrapInline(n, "*")
+	case atom.A:
+		c.link(n)
+	case atom.Ul, atom.Ol:
+		c.list(n)
+	case atom.Blockquote:
+		quoted := c.convertChildren(n)
+		if quoted != "" {
+			c.blockBreak()
+			c.sb.WriteString("> " + strings.ReplaceAll(quoted, "\n", "\n> "))
+			c.blockBreak()
+		}
+	case atom.Table:
+		c.table(n)
+	case atom.Img:
+		// The model can't see images, and alt text is mostly noise
+	default:
+		c.children(n)
+	}
+}
+
+func oneLine(s string) string {
+	return strings.TrimSpace(whitespacePattern.ReplaceAllString(s, " "))
+}
+
+func (c *markdownConverter) wrapInline(n *html.Node, marker string) {
+	text := oneLine(c.convertChildren(n))
+	if text == "" {
+		return
+	}
+
+	current := c.sb.String()
+	if current != "" && !strings.HasSuffix(current, " ") && !strings.HasSuffix(current, "\n") && startsWithSpace(n) {
+		c.sb.WriteString(" ")
+	}
+	c.sb.WriteString(marker + text + marker)
+}
+
+func startsWithSpace(n *html.Node) bool {
+	if n.FirstChild != nil && n.FirstChild.Type == html.TextNode {
+		return strings.TrimLeft(n.FirstChild.Data, " \t\n") != n.FirstChild.Data
+	}
+	return false
+}
+
+func (c *markdownConverter) link(n *html.Node) {
+	c.children(n)
+
+	href := attr(n, "href")
+	if href == "" || c.base == nil {
+		return
+	}
+
+	resolved, err := c.base.Parse(href)
+	if err != nil || (resolved.Scheme != "http" && resolved.Scheme != "https") {
+		return
+	}
+	resolved.Fragment = ""
+
+	if !c.seen[resolved.String()] {
+		c.seen[resolved.String()] = true
+		*c.links = append(*c.links, WebLink{URL: resolved.String(), Text: oneLine(textContent(n))})
+	}
+}
+
+func (c *markdownConverter) list(n *html.Node) {
+	ordered := n.DataAtom == atom.Ol
+	c.blockBreak()
+
+	number := 1
+	for li := n.FirstChild; li != nil; li = li.NextSibling {
+		if li.Type != html.ElementNode || li.DataAtom != atom.Li || isBoilerplate(li) {
+			continue
+		}
+
+		item := c.convertChildren(li)
+		if item == "" {
+			continue
+		}
+
+		marker := "- "
+		if ordered {
+			marker = strconv.Itoa(number) + ". "
+			number++
+		}
+
+		indent := "\n" + strings.Repeat(" ", len(marker))
+		c.sb.WriteString(marker + strings.ReplaceAll(item, "\n", indent) + "\n")
+	}
+
+	c.blockBreak()
+}
+
+func (c *markdownConverter) table(n *html.Node) {
+	var rows [][]string
+	var collect func(n *html.Node)
+	collect = func(n *html.Node) {
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			switch child.DataAtom {
+			case atom.Tr:
+				var row []string
+				for cell := child.FirstChild; cell != nil; cell = cell.NextSibling {
+					if cell.Type == html.ElementNode && (cell.DataAtom == atom.Td || cell.DataAtom == atom.Th) {
+						row = append(row, strings.ReplaceAll(oneLine(c.convertChildren(cell)), "|", `\|`))
+					}
+				}
+				if len(row) > 0 {
+					rows = append(rows, row)
+				}
+			case atom.Thead, atom.Tbody, atom.Tfoot:
+				collect(child)
+			}
+		}
+	}
+	collect(n)
+
+	if len(rows) == 0 {
+		return
+	}
+
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+
+	c.blockBreak()
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		c.sb.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			c.sb.WriteString("|" + strings.Repeat(" --- |", columns) + "\n")
+		}
+	}
+	c.blockBreak()
+}
@@ -0,0 +1,405 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The MCP version we speak
+const mcpProtocolVersion = "2024-11-05"
+
+// How long a server gets to start up and list its tools
+const mcpListTimeout = 10 * time.Second
+
+// How to start an MCP server, from mcp_servers in the config
+type MCPServerConfig struct {
+	Command string   `mapstructure:"command" yaml:"command"`
+	Args    []string `mapstructure:"args" yaml:"args,omitempty"`
+	// Extra env vars for the server, like KEY=value
+	Env []string `mapstructure:"env" yaml:"env,omitempty"`
+}
+
+// A tool as tools/list describes it
+type mcpToolInfo struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+type mcpRequest struct {
+	JSONRPC string `json:"jsonrpc"`
+	Id      *int   `json:"id,omitempty"`
+	Method  string `json:"method"`
+	Params  any    `json:"params,omitempty"`
+}
+
+type mcpResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Result  any             `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Anything a server might send: a response to us, or a request or
+// notification of its own
+type mcpMessage struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *mcpError       `json:"error"`
+}
+
+// A running MCP server, spoken to in newline delimited JSON-RPC over its
+// stdin and stdout
+type mcpClient struct {
+	name     string
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	decoder  *json.Decoder
+	stderr   lockedBuffer
+	nextId   int
+	timer    *time.Timer
+	timedOut atomic.Bool
+	timeout  time.Duration
+}
+
+// Written by the server as it runs, read when explaining a failure
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// Start the server and go through MCP's initialize handshake. The server is
+// killed if the client is still open after timeout.
+func startMCPClient(name string, server MCPServerConfig, timeout time.Duration) (*mcpClient, error) {
+	if server.Command == "" {
+		return nil, fmt.Errorf("mcp server %s has no command", name)
+	}
+
+	c := &mcpClient{name: name, timeout: timeout}
+
+	c.cmd = exec.Command(server.Command, server.Args...)
+	c.cmd.Env = append(os.Environ(), server.Env...)
+	c.cmd.Stderr = &c.stderr
+
+	stdin, err := c.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := c.cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	c.stdin = stdin
+	c.decoder = json.NewDecoder(stdout)
+
+	if err := c.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("unable to start mcp server %s: %w", name, err)
+	}
+
+	c.timer = time.AfterFunc(timeout, func() {
+		c.timedOut.Store(true)
+		c.cmd.Process.Kill()
+	})
+
+	var initialized struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	err = c.call("initialize", map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]any{"name": "ai-functions", "version": "1.0.0"},
+	}, &initialized)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	if err := c.send(mcpRequest{JSONRPC: "2.0", Method: "notifications/initialized"}); err != nil {
+		c.Close()
+		return nil, c.explain(err)
+	}
+
+	return c, nil
+}
+
+func (c *mcpClient) send(message any) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.stdin.Write(append(data, '\n'))
+	return err
+}
+
+// Make a request and unmarshal its result into result. Requests the server
+// makes of us in the meantime are answered, and its notifications ignored.
+func (c *mcpClient) call(method string, params any, result any) error {
+	c.nextId++
+	id := c.nextId
+
+	if err := c.send(mcpRequest{JSONRPC: "2.0", Id: &id, Method: method, Params: params}); err != nil {
+		return c.explain(err)
+	}
+
+	for {
+		var message mcpMessage
+		if err := c.decoder.Decode(&message); err != nil {
+			return c.explain(err)
+		}
+
+		if message.Method != "" {
+			if len(message.Id) > 0 {
+				c.answerServerRequest(message)
+			}
+			continue
+		}
+
+		if string(message.Id) != fmt.Sprint(id) {
+			continue
+		}
+
+		if message.Error != nil {
+			return fmt.Errorf("mcp server %s: %s failed: %s", c.name, method, message.Error.Message)
+		}
+
+		return json.Unmarshal(message.Result, result)
+	}
+}
+
+// We don't offer servers anything beyond ping
+func (c *mcpClient) answerServerRequest(message mcpMessage) {
+	response := mcpResponse{JSONRPC: "2.0", Id: message.Id}
+	if message.Method == "ping" {
+		response.Result = map[string]any{}
+	} else {
+		response.Error = &mcpError{Code: -32601, Message: "method not found"}
+	}
+	c.send(response)
+}
+
+// Turn a failure talking to the server into something a person can act on
+func (c *mcpClient) explain(err error) error {
+	if c.timedOut.Load() {
+		return fmt.Errorf("mcp server %s timed out after %s", c.name, c.timeout)
+	}
+
+	if stderr := strings.TrimSpace(c.stderr.String()); stderr != "" {
+		return fmt.Errorf("mcp server %s: %w: %s", c.name, err, stderr)
+	}
+
+	return fmt.Errorf("mcp server %s: %w", c.name, err)
+}
+
+// Every tool the server has, following tools/list's pages
+func (c *mcpClient) listTools() ([]mcpToolInfo, error) {
+	var tools []mcpToolInfo
+	cursor := ""
+
+	for {
+		params := map[string]any{}
+		if cursor != "" {
+			params["cursor"] = cursor
+		}
+
+		var page struct {
+			Tools      []mcpToolInfo `json:"tools"`
+			NextCursor string        `json:"nextCursor"`
+		}
+		if err := c.call("tools/list", params, &page); err != nil {
+			return nil, err
+		}
+
+		tools = append(tools, page.Tools...)
+		if page.NextCursor == "" {
+			return tools, nil
+		}
+		cursor = page.NextCursor
+	}
+}
+
+// Call a tool, returning its text content. A tool reporting an error is
+// returned as one.
+func (c *mcpClient) callTool(name string, arguments map[string]any) (string, error) {
+	var result struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+		IsError bool `json:"isError"`
+	}
+
+	if err := c.call("tools/call", map[string]any{"name": name, "arguments": arguments}, &result); err != nil {
+		return "", err
+	}
+
+	var parts []string
+	for _, content := range result.Content {
+		if content.Type == "text" {
+			parts = append(parts, content.Text)
+		} else {
+			parts = append(parts, fmt.Sprintf("[%s content]", content.Type))
+		}
+	}
+	text := strings.Join(parts, "\n")
+
+	if result.IsError {
+		return "", fmt.Errorf("%s failed: %s", name, text)
+	}
+
+	return text, nil
+}
+
+// Shut the server down: close its stdin like the spec asks, then kill it if
+// it doesn't exit on its own
+func (c *mcpClient) Close() error {
+	c.timer.Stop()
+	c.stdin.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- c.cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(time.Second):
+		c.cmd.Process.Kill()
+		return <-done
+	}
+}
+
+// A tool of an MCP server. The server is started again to call it, since the
+// shell hands the call back to a new process.
+type mcpTool struct {
+	server     string
+	serverConf MCPServerConfig
+	info       mcpToolInfo
+}
+
+func init() {
+	registerToolSource(discoverMCPTools)
+}
+
+// The tools of every configured server. Servers that fail to start or list
+// their tools are skipped with a warning.
+func discoverMCPTools() []Tool {
+	var names []string
+	for name := range activeConfig.MCPServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tools []Tool
+	for _, name := range names {
+		server := activeConfig.MCPServers[name]
+
+		infos, err := cachedMCPToolList(name, server)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "skipping mcp server:", err)
+			continue
+		}
+
+		for _, info := range infos {
+			tool := &mcpTool{server: name, serverConf: server, info: info}
+			if !validToolName.MatchString(tool.Name()) {
+				fmt.Fprintf(os.Stderr, "skipping mcp tool %s, its name isn't usable\n", tool.Name())
+				continue
+			}
+			tools = append(tools, tool)
+		}
+	}
+
+	return tools
+}
+
+func listMCPTools(name string, server MCPServerConfig) ([]mcpToolInfo, error) {
+	client, err := startMCPClient(name, server, mcpListTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	return client.listTools()
+}
+
+// Named after the server too, since two servers may well have a tool by the
+// same name
+func (t *mcpTool) Name() string {
+	return t.server + "__" + t.info.Name
+}
+
+func (t *mcpTool) Description() string {
+	return t.info.Description
+}
+
+func (t *mcpTool) Parameters() map[string]any {
+	if t.info.InputSchema == nil {
+		return map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+	return t.info.InputSchema
+}
+
+func (t *mcpTool) Guidance() string {
+	return ""
+}
+
+func (t *mcpTool) Payload(arguments string) string {
+	return arguments
+}
+
+func (t *mcpTool) Run(ctx context.Context, arguments string, w io.Writer) error {
+	timeout := time.Duration(activeConfig.PluginTimeout) * time.Second
+
+	client, err := startMCPClient(t.server, t.serverConf, timeout)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// Being cancelled kills the server, which ends the call
+	stop := context.AfterFunc(ctx, func() { client.cmd.Process.Kill() })
+	defer stop()
+
+	text, err := client.callTool(t.info.Name, argumentsToObject(arguments))
+	if ctx.Err() != nil {
+		return networkError(ctx.Err())
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, text)
+	return nil
+}
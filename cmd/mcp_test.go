@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Not a real test. The tests below run the test binary again with this env var
+// set, which turns it into a fake MCP server for them to talk to.
+func TestMCPFakeServer(t *testing.T) {
+	if os.Getenv("AI_FAKE_MCP_SERVER") != "1" {
+		return
+	}
+
+	runFakeMCPServer()
+	os.Exit(0)
+}
+
+func runFakeMCPServer() {
+	scanner := bufio.NewScanner(os.Stdin)
+	reply := func(id any, result any) {
+		data, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": id, "result": result})
+		fmt.Println(string(data))
+	}
+
+	for scanner.Scan() {
+		var request struct {
+			Id     any            `json:"id"`
+			Method string         `json:"method"`
+			Params map[string]any `json:"params"`
+		}
+		json.Unmarshal(scanner.Bytes(), &request)
+
+		switch request.Method {
+		case "initialize":
+			reply(request.Id, map[string]any{
+				"protocolVersion": request.Params["protocolVersion"],
+				"capabilities":    map[string]any{"tools": map[string]any{}},
+				"serverInfo":      map[string]any{"name": "fake-jira", "version": "0.0.1"},
+			})
+		case "tools/list":
+			// Two pages, to make sure the client follows the cursor
+			if request.Params["cursor"] == nil {
+				reply(request.Id, map[string]any{
+					"tools": []map[string]any{{
+						"name":        "lookup",
+						"description": "Look up a jira ticket",
+						"inputSchema": map[string]any{"type": "object", "properties": map[string]any{"key": map[string]any{"type": "string"}}},
+					}},
+					"nextCursor": "page2",
+				})
+			} else {
+				reply(request.Id, map[string]any{"tools": []map[string]any{{"name": "explode", "description": "Always fails"}}})
+			}
+		case "tools/call":
+			// Servers can make requests and send notifications of their own mid call
+			fmt.Println(`{"jsonrpc": "2.0", "method": "notifications/message", "params": {"level": "info", "data": "looking"}}`)
+			fmt.Println(`{"jsonrpc": "2.0", "id": "srv-1", "method": "ping"}`)
+
+			arguments, _ := request.Params["arguments"].(map[string]any)
+			if request.Params["name"] == "explode" {
+				reply(request.Id, map[string]any{"content": []map[string]any{{"type": "text", "text": "jira is down"}}, "isError": true})
+			} else {
+				reply(request.Id, map[string]any{"content": []map[string]any{{"type": "text", "text": fmt.Sprintf("%s is in progress", arguments["key"])}}})
+			}
+		}
+	}
+}
+
+func useFakeMCPServer(t *testing.T) {
+	previous := activeConfig
+	activeConfig.MCPServers = map[string]MCPServerConfig{
+		"jira": {
+			Command: os.Args[0],
+			Args:    []string{"-test.run=TestMCPFakeServer"},
+			Env:     []string{"AI_FAKE_MCP_SERVER=1"},
+		},
+	}
+	t.Cleanup(func() { activeConfig = previous })
+
+	discoverWithPath(t, t.TempDir())
+}
+
+func TestMCP_ToolsAreOfferedToTheModel(t *testing.T) {
+	useFakeMCPServer(t)
+
+	prompt := buildPrimaryPrompt("what's the status of OPS-1?", "gpt-4o", "Linux", nil)
+	names := strings.Join(promptToolNames(prompt), " ")
+
+	for _, want := range []string{"jira__lookup", "jira__explode", "printz", "crawl_web", "gen_image"} {
+		if !strings.Contains(names, want) {
+			t.Errorf("expected %s to be offered, got %s", want, names)
+		}
+	}
+
+	tool, _ := lookupTool("jira__explode")
+	if tool.Parameters()["type"] != "object" {
+		t.Errorf("a tool without a schema should take an empty object, got %v", tool.Parameters())
+	}
+}
+
+func TestMCP_Call(t *testing.T) {
+	useFakeMCPServer(t)
+
+	resp := completionFromJson(t, `{"choices": [{"message": {"tool_calls": [{"function": {"name": "jira__lookup", "arguments": "{\"key\": \"OPS-1\"}"}}]}}]}`)
+
+	var handled bytes.Buffer
+	HandlePrimaryResponse(resp, &handled)
+	if handled.String() != "jira__lookup {\"key\": \"OPS-1\"}\n" {
+		t.Fatalf("unexpected primary output %q", handled.String())
+	}
+
+	var output bytes.Buffer
+	if err := RunTool(context.Background(), "jira__lookup", `{"key": "OPS-1"}`, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "OPS-1 is in progress\n" {
+		t.Errorf("unexpected tool output %q", output.String())
+	}
+
+	err := RunTool(context.Background(), "jira__explode", `{}`, &output)
+	if err == nil || !strings.Contains(err.Error(), "jira is down") {
+		t.Errorf("expected the tool's error, got %v", err)
+	}
+}
+
+func TestMCP_BrokenServerIsSkipped(t *testing.T) {
+	previous := activeConfig
+	activeConfig.MCPServers = map[string]MCPServerConfig{"gone": {Command: "/nonexistent/mcp-server"}}
+	t.Cleanup(func() { activeConfig = previous })
+	discoverWithPath(t, t.TempDir())
+
+	names := promptToolNames(buildPrimaryPrompt("hi", "gpt-4o", "Linux", nil))
+	if len(names) != 3 {
+		t.Errorf("expected just the built in tools, got %v", names)
+	}
+}
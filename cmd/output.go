@@ -0,0 +1,127 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// How primary's answers, and errors, are written for the shell. Set by the
+// --output_format flag.
+type OutputFormat string
+
+const (
+	// `<action> <payload>` lines, what ai.zsh has always read. A payload can't
+	// hold a newline of its own.
+	FormatPrefix OutputFormat = "prefix"
+	// A json object per line
+	FormatJSON OutputFormat = "json"
+	// Records of NUL terminated fields: the version, action and payload, a
+	// `key=value` field per bit of metadata, then an empty field
+	FormatNUL OutputFormat = "nul"
+)
+
+var outputFormats = []OutputFormat{FormatPrefix, FormatJSON, FormatNUL}
+
+// Bumped whenever records change in a way a wrapper could trip on
+const protocolVersion = 1
+
+var outputFormat = FormatPrefix
+
+// One thing for the shell to do, like printz a command or show an error
+type Record struct {
+	Version int    `json:"version"`
+	Action  string `json:"action"`
+	Payload string `json:"payload"`
+	// Anything else worth knowing, like an error's class
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func validOutputFormat(format OutputFormat) bool {
+	for _, known := range outputFormats {
+		if format == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Write record to w in the output format
+func writeRecord(w io.Writer, record Record) {
+	record.Version = protocolVersion
+
+	switch outputFormat {
+	case FormatJSON:
+		encoder := json.NewEncoder(w)
+		// Commands are full of &&, which should read as is
+		encoder.SetEscapeHTML(false)
+		encoder.Encode(record)
+	case FormatNUL:
+		fields := []string{strconv.Itoa(record.Version), record.Action, record.Payload}
+		var keys []string
+		for key := range record.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fields = append(fields, key+"="+record.Metadata[key])
+		}
+		fields = append(fields, "")
+
+		io.WriteString(w, strings.Join(fields, "\x00")+"\x00")
+	default:
+		fmt.Fprintln(w, record.Action, record.Payload)
+	}
+}
+
+// Writes an answer, like the info tool's text, out as it arrives. As a prefix
+// line it's written whole once it starts, while the other formats get a
+// message_part record per piece, and the whole answer in a record of its own
+// at the end. It's an io.Writer too, for tools that print their answer.
+type messageStream struct {
+	w io.Writer
+	// What the answer's written as, ex info
+	action  string
+	started bool
+}
+
+func (s *messageStream) write(text string) {
+	if outputFormat != FormatPrefix {
+		s.started = true
+		writeRecord(s.w, Record{Action: "message_part", Payload: text})
+		return
+	}
+
+	if !s.started {
+		fmt.Fprint(s.w, s.action+" ")
+		s.started = true
+	}
+	fmt.Fprint(s.w, text)
+}
+
+func (s *messageStream) Write(p []byte) (int, error) {
+	s.write(string(p))
+	return len(p), nil
+}
+
+// Finish the stream. If the pieces were the answer, metadata goes on the
+// record of the whole of it, marked streamed. Otherwise it's nil, and the
+// pieces are left as they are.
+func (s *messageStream) end(answer string, metadata map[string]string) {
+	if outputFormat == FormatPrefix {
+		fmt.Fprintln(s.w)
+		return
+	}
+
+	if metadata != nil {
+		metadata["streamed"] = "true"
+		writeRecord(s.w, Record{Action: s.action, Payload: answer, Metadata: metadata})
+	}
+}
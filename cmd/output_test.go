@@ -0,0 +1,97 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func useOutputFormat(t *testing.T, format OutputFormat) {
+	previous := outputFormat
+	outputFormat = format
+	t.Cleanup(func() { outputFormat = previous })
+}
+
+// A printz whose command spans lines, which the prefix format can't carry
+var multilinePrintz = toolCallResponse("printz", `{"command": "for f in *.log; do\n  gzip \"$f\" && echo done\ndone"}`)
+
+func TestOutput_JSON(t *testing.T) {
+	useOutputFormat(t, FormatJSON)
+
+	var output bytes.Buffer
+	if err := HandlePrimaryResponse(multilinePrintz, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output.String(), "\n"), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `gzip \"$f\" && echo done`) {
+		t.Fatalf("expected one line of json, with && left as is, got %q", output.String())
+	}
+
+	var record Record
+	if err := json.Unmarshal([]byte(lines[0]), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Version != protocolVersion || record.Action != "printz" || record.Payload != "for f in *.log; do\n  gzip \"$f\" && echo done\ndone" {
+		t.Errorf("unexpected record %+v", record)
+	}
+	if !json.Valid([]byte(record.Metadata["arguments"])) {
+		t.Errorf("expected the model's arguments in the metadata, got %+v", record.Metadata)
+	}
+}
+
+func TestOutput_NUL(t *testing.T) {
+	useOutputFormat(t, FormatNUL)
+
+	var output bytes.Buffer
+	HandlePrimaryResponse(multilinePrintz, &output)
+	report(&output, classifyf(ErrAuth, "Incorrect API key provided"))
+
+	fields := strings.Split(output.String(), "\x00")
+	want := []string{
+		"1", "printz", "for f in *.log; do\n  gzip \"$f\" && echo done\ndone", `arguments={"command": "for f in *.log; do\n  gzip \"$f\" && echo done\ndone"}`, "",
+		"1", "error", "Incorrect API key provided", "class=auth", "exit_code=4", "",
+		"",
+	}
+	if strings.Join(fields, "|") != strings.Join(want, "|") {
+		t.Errorf("unexpected records\nwant %q\ngot  %q", want, fields)
+	}
+}
+
+func TestOutput_Prefix(t *testing.T) {
+	var output bytes.Buffer
+	HandlePrimaryResponse(toolCallResponse("printz", `{"command": "ls -la"}`), &output)
+	HandlePrimaryResponse(toolCallResponse("crawl_web", `{"url": "https://bbc.com", "purpose": "news"}`), &output)
+	report(&output, classifyf(ErrAuth, "Incorrect API key\nprovided"))
+
+	want := "printz ls -la\n" +
+		`crawl_web {"url": "https://bbc.com", "purpose": "news"}` + "\n" +
+		"error auth Incorrect API key provided\n"
+	if output.String() != want {
+		t.Errorf("expected the lines ai.zsh has always read, got %q", output.String())
+	}
+}
+
+func TestOutput_Stream(t *testing.T) {
+	useOutputFormat(t, FormatJSON)
+
+	server := sseServer(t, []string{
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "info", "arguments": "{\"str\": \"There are "}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "4 quarts.\"}"}}]}}]}`,
+	})
+	t.Setenv("AI_PROVIDER", "openai")
+
+	var output bytes.Buffer
+	if _, err := StreamPrimaryRequest(context.Background(), "gpt-4o", "how many quarts in a gallon", "Linux", server.URL, &output); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `{"version":1,"action":"message_part","payload":"There are "}` + "\n" +
+		`{"version":1,"action":"message_part","payload":"4 quarts."}` + "\n" +
+		`{"version":1,"action":"info","payload":"There are 4 quarts.","metadata":{"arguments":"{\"str\": \"There are 4 quarts.\"}","streamed":"true"}}` + "\n"
+	if output.String() != want {
+		t.Errorf("expected a record per piece, then the whole answer, got %s", output.String())
+	}
+}
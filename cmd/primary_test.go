@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -59,7 +60,7 @@ func TestPrimary(t *testing.T) {
 		model := "fake-model"
 		systemContent := "Linux art76 6.5.0-15-generic #15~22.04.1-Ubuntu SMP PREEMPT_DYNAMIC Fri Jan 12 18:54:30 UTC 2 x86_64 x86_64 x86_64 GNU/Linux"
 
-		resp, err := PerformPrimaryRequest(model, userInput, systemContent, server.URL)
+		resp, err := PerformPrimaryRequest(context.Background(), model, userInput, systemContent, server.URL)
 
 		gotFunctionName := getToolcallFunctionName(*resp)
 
@@ -0,0 +1,171 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// A Provider is an LLM backend. Requests and responses are OpenAI shaped, so
+// the rest of the app never has to know which backend is answering. Providers
+// that speak a different dialect translate on the way in and out.
+type Provider interface {
+	Name() string
+	ChatCompletion(ctx context.Context, payload map[string]any) (*OpenAICompletionResponse, error)
+	GenerateImage(ctx context.Context, params CarryoverJson) (*OpenAIImageGenerationResponse, error)
+	ListModels(ctx context.Context) ([]string, error)
+}
+
+// Builds a provider. url, when not empty, overrides the endpoint of whichever
+// call is made with the provider, which is how the tests point at httptest.
+type providerConstructor func(url string) Provider
+
+var providerConstructors = map[string]providerConstructor{}
+
+// Set by the --provider flag. Falls back to AI_PROVIDER, then the config.
+var providerName string
+
+func registerProvider(name string, constructor providerConstructor) {
+	providerConstructors[name] = constructor
+}
+
+// The names of all registered providers, sorted
+func providerNames() []string {
+	var names []string
+	for name := range providerConstructors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Which provider the user has selected
+func selectedProviderName() string {
+	if providerName != "" {
+		return providerName
+	}
+
+	if name := os.Getenv("AI_PROVIDER"); name != "" {
+		return name
+	}
+
+	return activeConfig.Provider
+}
+
+// Get the selected provider, with url overriding its endpoint if not empty
+func NewProvider(url string) (Provider, error) {
+	name := selectedProviderName()
+	constructor, ok := providerConstructors[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, expected one of: %s", name, strings.Join(providerNames(), ", "))
+	}
+
+	return constructor(url), nil
+}
+
+// A tool call translated out of another provider's dialect
+type translatedToolCall struct {
+	Id        string
+	Name      string
+	Arguments string
+}
+
+// The parts of a completion the rest of the app cares about, as translated out
+// of another provider's dialect. Use toOpenAI to get the shape the app speaks.
+type translatedCompletion struct {
+	Model            string
+	Content          string
+	ToolCalls        []translatedToolCall
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+	ErrorMessage     string
+	ErrorType        string
+}
+
+func (t translatedCompletion) toOpenAI() (*OpenAICompletionResponse, error) {
+	obj := map[string]any{"model": t.Model, "object": "chat.completion"}
+
+	if t.ErrorMessage != "" {
+		obj["error"] = map[string]any{"message": t.ErrorMessage, "type": t.ErrorType}
+	} else {
+		message := map[string]any{"role": "assistant"}
+		if t.Content != "" {
+			message["content"] = t.Content
+		}
+
+		if len(t.ToolCalls) > 0 {
+			var toolCalls []map[string]any
+			for i, toolCall := range t.ToolCalls {
+				id := toolCall.Id
+				if id == "" {
+					id = fmt.Sprintf("call_%d", i)
+				}
+
+				toolCalls = append(toolCalls, map[string]any{
+					"id":       id,
+					"type":     "function",
+					"function": map[string]any{"name": toolCall.Name, "arguments": toolCall.Arguments},
+				})
+			}
+			message["tool_calls"] = toolCalls
+		}
+
+		obj["choices"] = []map[string]any{{"index": 0, "finish_reason": t.FinishReason, "message": message}}
+	}
+
+	obj["usage"] = map[string]any{
+		"prompt_tokens":     t.PromptTokens,
+		"completion_tokens": t.CompletionTokens,
+		"total_tokens":      t.PromptTokens + t.CompletionTokens,
+	}
+
+	objBytes, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp OpenAICompletionResponse
+	if err := json.Unmarshal(objBytes, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// Pull the openai shaped messages and tools off of a payload
+func payloadMessages(payload map[string]any) []map[string]any {
+	messages, _ := payload["messages"].([]map[string]any)
+	return messages
+}
+
+func payloadTools(payload map[string]any) []map[string]any {
+	tools, _ := payload["tools"].([]map[string]any)
+	return tools
+}
+
+// Tool call arguments are a json string in openai's dialect, most others want an object
+func argumentsToObject(arguments string) map[string]any {
+	obj := map[string]any{}
+	json.Unmarshal([]byte(arguments), &obj)
+	return obj
+}
+
+// Ask provider for a completion, giving up after the request timeout
+func chatCompletion(ctx context.Context, provider Provider, payload map[string]any) (*OpenAICompletionResponse, error) {
+	return withTimeout(ctx, requestStage(provider), activeConfig.Timeouts.Request, func(ctx context.Context) (*OpenAICompletionResponse, error) {
+		return provider.ChatCompletion(ctx, payload)
+	})
+}
+
+// What a request to provider is called when it times out
+func requestStage(provider Provider) string {
+	return "the request to " + provider.Name()
+}
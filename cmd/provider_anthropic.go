@@ -0,0 +1,241 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+// Talks to Anthropic's Messages API
+type AnthropicProvider struct {
+	URL    string
+	ApiKey string
+}
+
+func init() {
+	registerProvider("anthropic", func(url string) Provider {
+		return &AnthropicProvider{URL: url, ApiKey: os.Getenv("ANTHROPIC_API_KEY")}
+	})
+}
+
+type anthropicResponse struct {
+	Type  string `json:"type"`
+	Error *struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Model   string `json:"model"`
+	Content []struct {
+		Type  string         `json:"type"`
+		Text  string         `json:"text"`
+		Id    string         `json:"id"`
+		Name  string         `json:"name"`
+		Input map[string]any `json:"input"`
+	} `json:"content"`
+	StopReason string `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+func (p *AnthropicProvider) Name() string {
+	return "anthropic"
+}
+
+func (p *AnthropicProvider) endpoint(path string) string {
+	if p.URL != "" {
+		return p.URL
+	}
+	return "https://api.anthropic.com/v1" + path
+}
+
+func (p *AnthropicProvider) headers() map[string]string {
+	return map[string]string{
+		"x-api-key":         p.ApiKey,
+		"anthropic-version": "2023-06-01",
+	}
+}
+
+// Translate an openai shaped payload into anthropic's. System messages are
+// hoisted into the system field, and since anthropic wants user and assistant
+// turns to alternate, consecutive messages from the same side are merged.
+func buildAnthropicRequest(payload map[string]any) map[string]any {
+	var system []string
+	var messages []map[string]any
+
+	appendBlocks := func(role string, blocks ...map[string]any) {
+		if len(messages) > 0 && messages[len(messages)-1]["role"] == role {
+			last := messages[len(messages)-1]
+			last["content"] = append(last["content"].([]map[string]any), blocks...)
+			return
+		}
+		messages = append(messages, map[string]any{"role": role, "content": blocks})
+	}
+
+	for _, message := range payloadMessages(payload) {
+		role, _ := message["role"].(string)
+		content, _ := message["content"].(string)
+
+		switch role {
+		case "system":
+			system = append(system, content)
+		case "tool":
+			appendBlocks("user", map[string]any{
+				"type":        "tool_result",
+				"tool_use_id": message["tool_call_id"],
+				"content":     content,
+			})
+		case "assistant":
+			var blocks []map[string]any
+			if content != "" {
+				blocks = append(blocks, map[string]any{"type": "text", "text": content})
+			}
+			toolCalls, _ := message["tool_calls"].([]map[string]any)
+			for _, toolCall := range toolCalls {
+				function, _ := toolCall["function"].(map[string]any)
+				arguments, _ := function["arguments"].(string)
+				blocks = append(blocks, map[string]any{
+					"type":  "tool_use",
+					"id":    toolCall["id"],
+					"name":  function["name"],
+					"input": argumentsToObject(arguments),
+				})
+			}
+			appendBlocks("assistant", blocks...)
+		default:
+			appendBlocks("user", map[string]any{"type": "text", "text": content})
+		}
+	}
+
+	var tools []map[string]any
+	for _, tool := range payloadTools(payload) {
+		function, _ := tool["function"].(map[string]any)
+		tools = append(tools, map[string]any{
+			"name":         function["name"],
+			"description":  function["description"],
+			"input_schema": function["parameters"],
+		})
+	}
+
+	// Required by anthropic, unlike openai
+	maxTokens, ok := payload["max_tokens"]
+	if !ok {
+		maxTokens = 1024
+	}
+
+	request := map[string]any{
+		"model":      payload["model"],
+		"max_tokens": maxTokens,
+		"messages":   messages,
+	}
+
+	if len(system) > 0 {
+		request["system"] = strings.Join(system, "\n\n")
+	}
+	if len(tools) > 0 {
+		request["tools"] = tools
+	}
+	if temperature, ok := payload["temperature"]; ok {
+		request["temperature"] = temperature
+	}
+
+	return request
+}
+
+// Translate anthropic's content blocks back into a completion
+func translateAnthropicResponse(resp anthropicResponse) (translatedCompletion, error) {
+	completion := translatedCompletion{
+		Model:            resp.Model,
+		FinishReason:     resp.StopReason,
+		PromptTokens:     resp.Usage.InputTokens,
+		CompletionTokens: resp.Usage.OutputTokens,
+	}
+
+	if resp.Error != nil {
+		completion.ErrorMessage = resp.Error.Message
+		completion.ErrorType = resp.Error.Type
+		return completion, nil
+	}
+
+	var text []string
+	for _, block := range resp.Content {
+		switch block.Type {
+		case "text":
+			text = append(text, block.Text)
+		case "tool_use":
+			arguments, err := json.Marshal(block.Input)
+			if err != nil {
+				return completion, err
+			}
+
+			completion.ToolCalls = append(completion.ToolCalls, translatedToolCall{
+				Id:        block.Id,
+				Name:      block.Name,
+				Arguments: string(arguments),
+			})
+		}
+	}
+	completion.Content = strings.Join(text, "\n")
+
+	if resp.StopReason == "tool_use" {
+		completion.FinishReason = "tool_calls"
+	}
+
+	return completion, nil
+}
+
+func (p *AnthropicProvider) ChatCompletion(ctx context.Context, payload map[string]any) (*OpenAICompletionResponse, error) {
+	body, err := postRaw(ctx, p.endpoint("/messages"), p.headers(), buildAnthropicRequest(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	var resp anthropicResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, unexpectedBody("anthropic", body)
+	}
+
+	completion, err := translateAnthropicResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return completion.toOpenAI()
+}
+
+func (p *AnthropicProvider) GenerateImage(ctx context.Context, params CarryoverJson) (*OpenAIImageGenerationResponse, error) {
+	return nil, errors.New("anthropic does not support image generation")
+}
+
+func (p *AnthropicProvider) ListModels(ctx context.Context) ([]string, error) {
+	var obj struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Data []struct {
+			Id string `json:"id"`
+		} `json:"data"`
+	}
+
+	if err := getJSON(ctx, p.endpoint("/models"), p.headers(), &obj); err != nil {
+		return nil, err
+	}
+
+	if obj.Error != nil {
+		return nil, errors.New(obj.Error.Message)
+	}
+
+	var models []string
+	for _, model := range obj.Data {
+		models = append(models, model.Id)
+	}
+
+	return models, nil
+}
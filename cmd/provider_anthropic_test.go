@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAnthropic_ToolUse(t *testing.T) {
+	responseJson := `{
+		"type": "message",
+		"role": "assistant",
+		"model": "claude-3-5-haiku-latest",
+		"content": [
+			{"type": "text", "text": "I'll put that on your command line."},
+			{"type": "tool_use", "id": "toolu_01", "name": "printz", "input": {"command": "netstat -u"}}
+		],
+		"stop_reason": "tool_use",
+		"usage": {"input_tokens": 500, "output_tokens": 20}
+	}`
+
+	server := localServer(t, responseJson, func(body map[string]any) {
+		system, _ := body["system"].(string)
+		if !strings.Contains(system, "helpful command line based ai assistant") {
+			t.Errorf("expected system messages to be hoisted, got %v", body["system"])
+		}
+
+		// The two leading user messages should be merged into one turn
+		messages, _ := body["messages"].([]any)
+		if len(messages) != 1 {
+			t.Errorf("expected a single user turn, got %v", body["messages"])
+		}
+
+		tools, _ := body["tools"].([]any)
+		if len(tools) != 3 {
+			t.Fatalf("expected the three primary tools, got %v", body["tools"])
+		}
+		found := false
+		for _, tool := range tools {
+			tool, _ := tool.(map[string]any)
+			if tool["name"] != "printz" {
+				continue
+			}
+			found = true
+			if tool["input_schema"] == nil {
+				t.Errorf("tool was not translated to anthropic's shape: %v", tool)
+			}
+		}
+		if !found {
+			t.Errorf("expected printz among the tools, got %v", body["tools"])
+		}
+	})
+
+	output := performLocalPrimary(t, "anthropic", server.URL)
+	if output != "printz netstat -u\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestAnthropic_Error(t *testing.T) {
+	responseJson := `{"type": "error", "error": {"type": "authentication_error", "message": "invalid x-api-key"}}`
+	server := localServer(t, responseJson, nil)
+
+	output := performLocalPrimary(t, "anthropic", server.URL)
+	if output != "error auth invalid x-api-key\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestAnthropic_ToolResultTranslation(t *testing.T) {
+	payload := map[string]any{
+		"model": "claude-3-5-haiku-latest",
+		"messages": []map[string]any{
+			{"role": "user", "content": "what is the first headline from bbc.com?"},
+			{"role": "assistant", "tool_calls": []map[string]any{
+				{"id": "toolu_01", "type": "function", "function": map[string]any{"name": "crawl_web", "arguments": `{"url": "https://bbc.com"}`}},
+			}},
+			{"role": "tool", "tool_call_id": "toolu_01", "content": "Big news today"},
+		},
+	}
+
+	request := buildAnthropicRequest(payload)
+	messages := request["messages"].([]map[string]any)
+	if len(messages) != 3 {
+		t.Fatalf("expected user, assistant, user turns, got %v", messages)
+	}
+
+	toolUse := messages[1]["content"].([]map[string]any)[0]
+	if toolUse["type"] != "tool_use" || toolUse["input"].(map[string]any)["url"] != "https://bbc.com" {
+		t.Errorf("assistant tool call was not translated to tool_use: %v", toolUse)
+	}
+
+	toolResult := messages[2]["content"].([]map[string]any)[0]
+	if toolResult["type"] != "tool_result" || toolResult["tool_use_id"] != "toolu_01" {
+		t.Errorf("tool message was not translated to tool_result: %v", toolResult)
+	}
+
+	if request["max_tokens"] != 1024 {
+		t.Errorf("expected a default max_tokens, got %v", request["max_tokens"])
+	}
+}
@@ -0,0 +1,201 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Talks to an Azure OpenAI resource. Azure serves models through named
+// deployments, so requests are routed by deployment rather than model.
+type AzureProvider struct {
+	URL        string
+	ApiKey     string
+	Endpoint   string
+	ApiVersion string
+	// model name -> deployment name. Models without an entry are assumed to
+	// have a deployment of the same name.
+	Deployments map[string]string
+}
+
+// The azure section of the config file. The AZURE_OPENAI_* env vars override
+// it, AZURE_OPENAI_RESOURCE standing in for an endpoint.
+type AzureConfig struct {
+	// The resource's endpoint, ex https://my-resource.openai.azure.com
+	Endpoint   string `mapstructure:"endpoint" yaml:"endpoint,omitempty"`
+	ApiVersion string `mapstructure:"api_version" yaml:"api_version"`
+	// Model name -> deployment name. A map in the config file, but a single
+	// string like "gpt-4o=chat-prod,dall-e-3=images" in the env var.
+	Deployments map[string]string `mapstructure:"-" yaml:"deployments,omitempty"`
+}
+
+func init() {
+	registerProvider("azure", func(url string) Provider {
+		settings := azureSettings()
+		return &AzureProvider{
+			URL:         url,
+			ApiKey:      os.Getenv("AZURE_OPENAI_API_KEY"),
+			Endpoint:    strings.TrimRight(settings.Endpoint, "/"),
+			ApiVersion:  settings.ApiVersion,
+			Deployments: settings.Deployments,
+		}
+	})
+}
+
+// The config's azure section with the env vars laid over it. They're already
+// there when the config's been loaded, but not for something like the tests.
+func azureSettings() AzureConfig {
+	settings := activeConfig.Azure
+
+	if endpoint := os.Getenv("AZURE_OPENAI_ENDPOINT"); endpoint != "" {
+		settings.Endpoint = endpoint
+	} else if resource := os.Getenv("AZURE_OPENAI_RESOURCE"); resource != "" && settings.Endpoint == "" {
+		settings.Endpoint = azureResourceEndpoint(resource)
+	}
+
+	if apiVersion := os.Getenv("AZURE_OPENAI_API_VERSION"); apiVersion != "" {
+		settings.ApiVersion = apiVersion
+	}
+	if settings.ApiVersion == "" {
+		settings.ApiVersion = defaultAzureApiVersion
+	}
+
+	if deployments := os.Getenv("AZURE_OPENAI_DEPLOYMENTS"); deployments != "" {
+		settings.Deployments = parseAzureDeployments(deployments)
+	}
+
+	return settings
+}
+
+const defaultAzureApiVersion = "2024-06-01"
+
+func azureResourceEndpoint(resource string) string {
+	return fmt.Sprintf("https://%s.openai.azure.com", resource)
+}
+
+// Parse a model to deployment mapping like "gpt-4o=chat-prod,dall-e-3=images"
+func parseAzureDeployments(mapping string) map[string]string {
+	deployments := map[string]string{}
+	for _, pair := range strings.Split(mapping, ",") {
+		model, deployment, found := strings.Cut(strings.TrimSpace(pair), "=")
+		if found && model != "" && deployment != "" {
+			deployments[strings.TrimSpace(model)] = strings.TrimSpace(deployment)
+		}
+	}
+	return deployments
+}
+
+func (p *AzureProvider) Name() string {
+	return "azure"
+}
+
+func (p *AzureProvider) deployment(model string) string {
+	if deployment, ok := p.Deployments[model]; ok {
+		return deployment
+	}
+	return model
+}
+
+// Build the url for an operation against the given model's deployment
+func (p *AzureProvider) endpoint(model string, operation string) (string, error) {
+	if p.URL != "" {
+		return p.URL, nil
+	}
+
+	if p.Endpoint == "" {
+		return "", errors.New("azure requires azure.endpoint in the config, or AZURE_OPENAI_ENDPOINT or AZURE_OPENAI_RESOURCE, to be set")
+	}
+
+	path := "/openai/models"
+	if model != "" {
+		path = fmt.Sprintf("/openai/deployments/%s/%s", url.PathEscape(p.deployment(model)), operation)
+	}
+
+	return fmt.Sprintf("%s%s?api-version=%s", p.Endpoint, path, url.QueryEscape(p.ApiVersion)), nil
+}
+
+func (p *AzureProvider) headers() map[string]string {
+	return map[string]string{"api-key": p.ApiKey}
+}
+
+func (p *AzureProvider) ChatCompletion(ctx context.Context, payload map[string]any) (*OpenAICompletionResponse, error) {
+	model, _ := payload["model"].(string)
+	url, err := p.endpoint(model, "chat/completions")
+	if err != nil {
+		return nil, err
+	}
+
+	var obj OpenAICompletionResponse
+	if err := postJSON(ctx, url, p.headers(), payload, &obj); err != nil {
+		return nil, err
+	}
+
+	return &obj, nil
+}
+
+func (p *AzureProvider) ChatCompletionStream(ctx context.Context, payload map[string]any, handler StreamHandler) (*OpenAICompletionResponse, error) {
+	model, _ := payload["model"].(string)
+	url, err := p.endpoint(model, "chat/completions")
+	if err != nil {
+		return nil, err
+	}
+
+	// Older api versions reject stream_options, so usage isn't requested
+	body, err := postStream(ctx, url, p.headers(), streamingPayload(payload, false))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return readCompletionStream(body, handler)
+}
+
+func (p *AzureProvider) GenerateImage(ctx context.Context, params CarryoverJson) (*OpenAIImageGenerationResponse, error) {
+	url, err := p.endpoint(params.Model, "images/generations")
+	if err != nil {
+		return nil, err
+	}
+
+	var obj OpenAIImageGenerationResponse
+	if err := postJSON(ctx, url, p.headers(), params, &obj); err != nil {
+		return nil, err
+	}
+
+	return &obj, nil
+}
+
+func (p *AzureProvider) ListModels(ctx context.Context) ([]string, error) {
+	url, err := p.endpoint("", "")
+	if err != nil {
+		return nil, err
+	}
+
+	var obj struct {
+		Error *OpenAIError `json:"error"`
+		Data  []struct {
+			Id string `json:"id"`
+		} `json:"data"`
+	}
+
+	if err := getJSON(ctx, url, p.headers(), &obj); err != nil {
+		return nil, err
+	}
+
+	if message := obj.Error.fullMessage(); message != "" {
+		return nil, errors.New(message)
+	}
+
+	var models []string
+	for _, model := range obj.Data {
+		models = append(models, model.Id)
+	}
+
+	return models, nil
+}
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAzure_DeploymentRouting(t *testing.T) {
+	var gotPaths []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPaths = append(gotPaths, r.URL.Path+"?"+r.URL.RawQuery)
+		if r.Header.Get("api-key") != "azure-key" || r.Header.Get("Authorization") != "" {
+			t.Errorf("expected api-key auth, got headers: %v", r.Header)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if r.URL.Path == "/openai/deployments/images/images/generations" {
+			w.Write([]byte(`{"data": [{"url": "url.biz"}]}`))
+		} else {
+			w.Write([]byte(`{"choices": [{"message": {"content": "hi"}}]}`))
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("AZURE_OPENAI_ENDPOINT", server.URL)
+	t.Setenv("AZURE_OPENAI_API_KEY", "azure-key")
+	t.Setenv("AZURE_OPENAI_API_VERSION", "2024-10-21")
+	t.Setenv("AZURE_OPENAI_DEPLOYMENTS", "gpt-4o=chat-prod, dall-e-3=images")
+	t.Setenv("AI_PROVIDER", "azure")
+
+	if _, err := PerformPrimaryRequest(context.Background(), "gpt-4o", "hi", "Linux", ""); err != nil {
+		t.Fatal("primary request errored:", err)
+	}
+
+	carryoverJson := `{"n": 1, "size": "1024x1024", "model": "dall-e-3", "prompt": "good banana"}`
+	if _, err := GenImage(context.Background(), "", carryoverJson, ""); err != nil {
+		t.Fatal("image request errored:", err)
+	}
+
+	want := []string{
+		"/openai/deployments/chat-prod/chat/completions?api-version=2024-10-21",
+		"/openai/deployments/images/images/generations?api-version=2024-10-21",
+	}
+	if len(gotPaths) != 2 || gotPaths[0] != want[0] || gotPaths[1] != want[1] {
+		t.Errorf("want paths %v, got %v", want, gotPaths)
+	}
+}
+
+func TestAzure_ContentFilterError(t *testing.T) {
+	responseJson := `{"error": {
+		"message": "The response was filtered due to the prompt triggering Azure OpenAI's content management policy.",
+		"type": null,
+		"param": "prompt",
+		"code": "content_filter",
+		"status": 400,
+		"innererror": {
+			"code": "ResponsibleAIPolicyViolation",
+			"content_filter_result": {
+				"hate": {"filtered": false, "severity": "safe"},
+				"violence": {"filtered": true, "severity": "medium"}
+			}
+		}
+	}}`
+
+	server := localServer(t, responseJson, nil)
+
+	output := performLocalPrimary(t, "azure", server.URL)
+	want := "error content_filter The response was filtered due to the prompt triggering Azure OpenAI's content management policy. (content filtered: violence)\n"
+	if output != want {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestAzure_FilteredCompletion(t *testing.T) {
+	responseJson := `{"choices": [{
+		"finish_reason": "content_filter",
+		"message": {"role": "assistant", "content": null},
+		"content_filter_results": {"self_harm": {"filtered": true, "severity": "high"}}
+	}]}`
+
+	server := localServer(t, responseJson, nil)
+
+	output := performLocalPrimary(t, "azure", server.URL)
+	want := "error content_filter The response was filtered by the content filter (content filtered: self_harm)\n"
+	if output != want {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
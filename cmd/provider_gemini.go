@@ -0,0 +1,271 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Talks to Google's Gemini generateContent API
+type GeminiProvider struct {
+	URL    string
+	ApiKey string
+}
+
+func init() {
+	registerProvider("gemini", func(url string) Provider {
+		apiKey := os.Getenv("GEMINI_API_KEY")
+		if apiKey == "" {
+			apiKey = os.Getenv("GOOGLE_API_KEY")
+		}
+
+		return &GeminiProvider{URL: url, ApiKey: apiKey}
+	})
+}
+
+type geminiResponse struct {
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+	} `json:"error"`
+	Candidates []struct {
+		Content struct {
+			Parts []struct {
+				Text         string `json:"text"`
+				FunctionCall *struct {
+					Name string         `json:"name"`
+					Args map[string]any `json:"args"`
+				} `json:"functionCall"`
+			} `json:"parts"`
+		} `json:"content"`
+		FinishReason string `json:"finishReason"`
+	} `json:"candidates"`
+	UsageMetadata struct {
+		PromptTokenCount     int `json:"promptTokenCount"`
+		CandidatesTokenCount int `json:"candidatesTokenCount"`
+	} `json:"usageMetadata"`
+	ModelVersion string `json:"modelVersion"`
+}
+
+func (p *GeminiProvider) Name() string {
+	return "gemini"
+}
+
+func (p *GeminiProvider) endpoint(path string) string {
+	if p.URL != "" {
+		return p.URL
+	}
+	return "https://generativelanguage.googleapis.com/v1beta" + path
+}
+
+func (p *GeminiProvider) headers() map[string]string {
+	return map[string]string{"x-goog-api-key": p.ApiKey}
+}
+
+// Gemini's schemas are an OpenAPI subset that spells types in upper case
+func geminiSchema(schema any) any {
+	switch schema := schema.(type) {
+	case map[string]any:
+		translated := map[string]any{}
+		for key, value := range schema {
+			if typeName, ok := value.(string); ok && key == "type" {
+				translated[key] = strings.ToUpper(typeName)
+			} else {
+				translated[key] = geminiSchema(value)
+			}
+		}
+		return translated
+	default:
+		return schema
+	}
+}
+
+// Translate an openai shaped payload into gemini's. System messages become the
+// systemInstruction, tools become functionDeclarations, and tool calls and
+// their results become functionCall and functionResponse parts.
+func buildGeminiRequest(payload map[string]any) map[string]any {
+	var system []map[string]any
+	var contents []map[string]any
+
+	// functionResponse parts are matched by name, but tool messages carry an id
+	toolCallNames := map[any]any{}
+
+	appendParts := func(role string, parts ...map[string]any) {
+		if len(contents) > 0 && contents[len(contents)-1]["role"] == role {
+			last := contents[len(contents)-1]
+			last["parts"] = append(last["parts"].([]map[string]any), parts...)
+			return
+		}
+		contents = append(contents, map[string]any{"role": role, "parts": parts})
+	}
+
+	for _, message := range payloadMessages(payload) {
+		role, _ := message["role"].(string)
+		content, _ := message["content"].(string)
+
+		switch role {
+		case "system":
+			system = append(system, map[string]any{"text": content})
+		case "tool":
+			appendParts("user", map[string]any{
+				"functionResponse": map[string]any{
+					"name":     toolCallNames[message["tool_call_id"]],
+					"response": map[string]any{"content": content},
+				},
+			})
+		case "assistant":
+			var parts []map[string]any
+			if content != "" {
+				parts = append(parts, map[string]any{"text": content})
+			}
+			toolCalls, _ := message["tool_calls"].([]map[string]any)
+			for _, toolCall := range toolCalls {
+				function, _ := toolCall["function"].(map[string]any)
+				arguments, _ := function["arguments"].(string)
+				toolCallNames[toolCall["id"]] = function["name"]
+				parts = append(parts, map[string]any{
+					"functionCall": map[string]any{"name": function["name"], "args": argumentsToObject(arguments)},
+				})
+			}
+			appendParts("model", parts...)
+		default:
+			appendParts("user", map[string]any{"text": content})
+		}
+	}
+
+	var functionDeclarations []map[string]any
+	for _, tool := range payloadTools(payload) {
+		function, _ := tool["function"].(map[string]any)
+		functionDeclarations = append(functionDeclarations, map[string]any{
+			"name":        function["name"],
+			"description": function["description"],
+			"parameters":  geminiSchema(function["parameters"]),
+		})
+	}
+
+	generationConfig := map[string]any{}
+	if temperature, ok := payload["temperature"]; ok {
+		generationConfig["temperature"] = temperature
+	}
+	if maxTokens, ok := payload["max_tokens"]; ok {
+		generationConfig["maxOutputTokens"] = maxTokens
+	}
+
+	request := map[string]any{
+		"contents":         contents,
+		"generationConfig": generationConfig,
+	}
+
+	if len(system) > 0 {
+		request["systemInstruction"] = map[string]any{"parts": system}
+	}
+	if len(functionDeclarations) > 0 {
+		request["tools"] = []map[string]any{{"functionDeclarations": functionDeclarations}}
+	}
+
+	return request
+}
+
+// Translate gemini's first candidate back into a completion
+func translateGeminiResponse(resp geminiResponse) (translatedCompletion, error) {
+	completion := translatedCompletion{
+		Model:            resp.ModelVersion,
+		PromptTokens:     resp.UsageMetadata.PromptTokenCount,
+		CompletionTokens: resp.UsageMetadata.CandidatesTokenCount,
+	}
+
+	if resp.Error != nil {
+		completion.ErrorMessage = resp.Error.Message
+		completion.ErrorType = resp.Error.Status
+		return completion, nil
+	}
+
+	if len(resp.Candidates) == 0 {
+		return completion, errors.New("gemini returned no candidates")
+	}
+
+	candidate := resp.Candidates[0]
+	completion.FinishReason = strings.ToLower(candidate.FinishReason)
+
+	var text []string
+	for _, part := range candidate.Content.Parts {
+		if part.FunctionCall != nil {
+			arguments, err := json.Marshal(part.FunctionCall.Args)
+			if err != nil {
+				return completion, err
+			}
+
+			completion.ToolCalls = append(completion.ToolCalls, translatedToolCall{
+				Name:      part.FunctionCall.Name,
+				Arguments: string(arguments),
+			})
+		} else if part.Text != "" {
+			text = append(text, part.Text)
+		}
+	}
+	completion.Content = strings.Join(text, "")
+
+	if len(completion.ToolCalls) > 0 {
+		completion.FinishReason = "tool_calls"
+	}
+
+	return completion, nil
+}
+
+func (p *GeminiProvider) ChatCompletion(ctx context.Context, payload map[string]any) (*OpenAICompletionResponse, error) {
+	url := p.endpoint(fmt.Sprintf("/models/%s:generateContent", payload["model"]))
+	body, err := postRaw(ctx, url, p.headers(), buildGeminiRequest(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	var resp geminiResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, unexpectedBody("gemini", body)
+	}
+
+	completion, err := translateGeminiResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return completion.toOpenAI()
+}
+
+func (p *GeminiProvider) GenerateImage(ctx context.Context, params CarryoverJson) (*OpenAIImageGenerationResponse, error) {
+	return nil, errors.New("gemini does not support image generation")
+}
+
+func (p *GeminiProvider) ListModels(ctx context.Context) ([]string, error) {
+	var obj struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+
+	if err := getJSON(ctx, p.endpoint("/models"), p.headers(), &obj); err != nil {
+		return nil, err
+	}
+
+	if obj.Error != nil {
+		return nil, errors.New(obj.Error.Message)
+	}
+
+	var models []string
+	for _, model := range obj.Models {
+		models = append(models, strings.TrimPrefix(model.Name, "models/"))
+	}
+
+	return models, nil
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestGemini_FunctionCall(t *testing.T) {
+	responseJson := `{
+		"candidates": [{
+			"content": {
+				"role": "model",
+				"parts": [{"functionCall": {"name": "crawl_web", "args": {"url": "https://bbc.com", "purpose": "first headline"}}}]
+			},
+			"finishReason": "STOP"
+		}],
+		"usageMetadata": {"promptTokenCount": 400, "candidatesTokenCount": 12},
+		"modelVersion": "gemini-1.5-flash"
+	}`
+
+	server := localServer(t, responseJson, func(body map[string]any) {
+		if body["systemInstruction"] == nil {
+			t.Error("expected system messages to become the systemInstruction")
+		}
+
+		tools, _ := body["tools"].([]any)
+		if len(tools) != 1 {
+			t.Fatalf("expected a single tools entry, got %v", body["tools"])
+		}
+		declarations, _ := tools[0].(map[string]any)["functionDeclarations"].([]any)
+		if len(declarations) != 3 {
+			t.Fatalf("expected the three primary tools as functionDeclarations, got %v", tools[0])
+		}
+		parameters := declarations[0].(map[string]any)["parameters"].(map[string]any)
+		if parameters["type"] != "OBJECT" {
+			t.Errorf("expected gemini's upper case schema types, got %v", parameters["type"])
+		}
+	})
+
+	output := performLocalPrimary(t, "gemini", server.URL)
+	if output != "crawl_web {\"purpose\":\"first headline\",\"url\":\"https://bbc.com\"}\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestGemini_Message(t *testing.T) {
+	responseJson := `{"candidates": [{"content": {"role": "model", "parts": [{"text": "There are 4 quarts in a gallon."}]}, "finishReason": "STOP"}]}`
+	server := localServer(t, responseJson, nil)
+
+	output := performLocalPrimary(t, "gemini", server.URL)
+	if output != "message There are 4 quarts in a gallon.\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestGemini_Error(t *testing.T) {
+	responseJson := `{"error": {"code": 400, "message": "API key not valid. Please pass a valid API key.", "status": "INVALID_ARGUMENT"}}`
+	server := localServer(t, responseJson, nil)
+
+	output := performLocalPrimary(t, "gemini", server.URL)
+	if output != "error auth API key not valid. Please pass a valid API key.\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
@@ -0,0 +1,212 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// Talks to a local Ollama server over its native /api/chat endpoint
+type OllamaProvider struct {
+	URL  string
+	Host string
+}
+
+func init() {
+	registerProvider("ollama", func(url string) Provider {
+		host := os.Getenv("OLLAMA_HOST")
+		if host == "" {
+			host = "http://localhost:11434"
+		}
+		if !strings.HasPrefix(host, "http") {
+			host = "http://" + host
+		}
+
+		return &OllamaProvider{URL: url, Host: strings.TrimRight(host, "/")}
+	})
+}
+
+type ollamaMessage struct {
+	Role      string `json:"role"`
+	Content   string `json:"content"`
+	ToolCalls []struct {
+		Function struct {
+			Name      string         `json:"name"`
+			Arguments map[string]any `json:"arguments"`
+		} `json:"function"`
+	} `json:"tool_calls"`
+}
+
+// One object of the response. With streaming, there's one of these per line.
+type ollamaChatResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	Done            bool          `json:"done"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+	Error           string        `json:"error"`
+}
+
+func (p *OllamaProvider) Name() string {
+	return "ollama"
+}
+
+func (p *OllamaProvider) endpoint(path string) string {
+	if p.URL != "" {
+		return p.URL
+	}
+	return p.Host + path
+}
+
+// Translate an openai shaped payload into ollama's
+func buildOllamaChatRequest(payload map[string]any) map[string]any {
+	var messages []map[string]any
+	for _, message := range payloadMessages(payload) {
+		translated := map[string]any{}
+		for key, value := range message {
+			translated[key] = value
+		}
+
+		// ollama wants tool call arguments as objects rather than json strings
+		if toolCalls, ok := message["tool_calls"].([]map[string]any); ok {
+			var ollamaToolCalls []map[string]any
+			for _, toolCall := range toolCalls {
+				function, _ := toolCall["function"].(map[string]any)
+				arguments, _ := function["arguments"].(string)
+				ollamaToolCalls = append(ollamaToolCalls, map[string]any{
+					"function": map[string]any{"name": function["name"], "arguments": argumentsToObject(arguments)},
+				})
+			}
+			translated["tool_calls"] = ollamaToolCalls
+		}
+
+		messages = append(messages, translated)
+	}
+
+	options := map[string]any{}
+	if temperature, ok := payload["temperature"]; ok {
+		options["temperature"] = temperature
+	}
+	if maxTokens, ok := payload["max_tokens"]; ok {
+		options["num_predict"] = maxTokens
+	}
+
+	return map[string]any{
+		"model":    payload["model"],
+		"messages": messages,
+		"tools":    payloadTools(payload),
+		"options":  options,
+		"stream":   false,
+	}
+}
+
+// Ollama answers with newline delimited json objects when streaming, and with
+// a single one when not. Either way, fold them into one completion.
+func parseOllamaChatResponse(body []byte) (translatedCompletion, error) {
+	var completion translatedCompletion
+	var content strings.Builder
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+
+	parsedAny := false
+	for {
+		var chunk ollamaChatResponse
+		err := decoder.Decode(&chunk)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return completion, unexpectedBody("ollama", body)
+		}
+		parsedAny = true
+
+		if chunk.Error != "" {
+			completion.ErrorMessage = chunk.Error
+			completion.ErrorType = "ollama_error"
+			return completion, nil
+		}
+
+		completion.Model = chunk.Model
+		content.WriteString(chunk.Message.Content)
+
+		for _, toolCall := range chunk.Message.ToolCalls {
+			arguments, err := json.Marshal(toolCall.Function.Arguments)
+			if err != nil {
+				return completion, err
+			}
+
+			completion.ToolCalls = append(completion.ToolCalls, translatedToolCall{
+				Name:      toolCall.Function.Name,
+				Arguments: string(arguments),
+			})
+		}
+
+		if chunk.Done {
+			completion.FinishReason = chunk.DoneReason
+			completion.PromptTokens = chunk.PromptEvalCount
+			completion.CompletionTokens = chunk.EvalCount
+		}
+	}
+
+	if !parsedAny {
+		return completion, classifyf(ErrBadResponse, "empty response from ollama")
+	}
+
+	completion.Content = content.String()
+	if len(completion.ToolCalls) > 0 {
+		completion.FinishReason = "tool_calls"
+	}
+
+	return completion, nil
+}
+
+func (p *OllamaProvider) ChatCompletion(ctx context.Context, payload map[string]any) (*OpenAICompletionResponse, error) {
+	body, err := postRaw(ctx, p.endpoint("/api/chat"), nil, buildOllamaChatRequest(payload))
+	if err != nil {
+		return nil, err
+	}
+
+	completion, err := parseOllamaChatResponse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return completion.toOpenAI()
+}
+
+func (p *OllamaProvider) GenerateImage(ctx context.Context, params CarryoverJson) (*OpenAIImageGenerationResponse, error) {
+	return nil, errors.New("ollama does not support image generation")
+}
+
+func (p *OllamaProvider) ListModels(ctx context.Context) ([]string, error) {
+	var obj struct {
+		Error  string `json:"error"`
+		Models []struct {
+			Name string `json:"name"`
+		} `json:"models"`
+	}
+
+	if err := getJSON(ctx, p.endpoint("/api/tags"), nil, &obj); err != nil {
+		return nil, err
+	}
+
+	if obj.Error != "" {
+		return nil, errors.New(obj.Error)
+	}
+
+	var models []string
+	for _, model := range obj.Models {
+		models = append(models, model.Name)
+	}
+
+	return models, nil
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Stands in for a local ollama or llama.cpp server
+func localServer(t *testing.T, responseBody string, onRequest func(body map[string]any)) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if onRequest != nil {
+			reqBytes, _ := io.ReadAll(r.Body)
+			var reqBody map[string]any
+			if err := json.Unmarshal(reqBytes, &reqBody); err != nil {
+				t.Errorf("request body was not json: %s", string(reqBytes))
+			}
+			onRequest(reqBody)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(responseBody))
+	}))
+
+	t.Cleanup(server.Close)
+	return server
+}
+
+func performLocalPrimary(t *testing.T, provider string, url string) string {
+	t.Setenv("AI_PROVIDER", provider)
+
+	resp, err := PerformPrimaryRequest(context.Background(), "llama3.1", "list all open udp ports", "Linux", url)
+	if err != nil {
+		t.Fatal("primary request errored:", err)
+	}
+
+	var outputBuffer bytes.Buffer
+	HandlePrimaryResponse(*resp, &outputBuffer)
+	return outputBuffer.String()
+}
+
+func TestOllama_ToolCall(t *testing.T) {
+	responseJson := `{
+		"model": "llama3.1",
+		"message": {
+			"role": "assistant",
+			"content": "",
+			"tool_calls": [{"function": {"name": "printz", "arguments": {"command": "netstat -u"}}}]
+		},
+		"done": true,
+		"prompt_eval_count": 10,
+		"eval_count": 5
+	}`
+
+	server := localServer(t, responseJson, func(body map[string]any) {
+		if body["stream"] != false {
+			t.Errorf("expected streaming to be off, got %v", body["stream"])
+		}
+		if tools, _ := body["tools"].([]any); len(tools) != 3 {
+			t.Errorf("expected the three primary tools, got %v", body["tools"])
+		}
+	})
+
+	output := performLocalPrimary(t, "ollama", server.URL)
+	if output != "printz netstat -u\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestOllama_StreamedMessage(t *testing.T) {
+	responseJson := `{"model": "llama3.1", "message": {"role": "assistant", "content": "four "}, "done": false}
+{"model": "llama3.1", "message": {"role": "assistant", "content": "quarts"}, "done": false}
+{"model": "llama3.1", "message": {"role": "assistant", "content": ""}, "done": true, "done_reason": "stop"}
+`
+
+	server := localServer(t, responseJson, nil)
+
+	output := performLocalPrimary(t, "ollama", server.URL)
+	if output != "message four quarts\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestOllama_Error(t *testing.T) {
+	server := localServer(t, `{"error": "model \"llama3.1\" not found, try pulling it first"}`, nil)
+
+	output := performLocalPrimary(t, "ollama", server.URL)
+	if output != "error api model \"llama3.1\" not found, try pulling it first\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
+
+func TestLlamaCpp_NumericErrorCode(t *testing.T) {
+	server := localServer(t, `{"error": {"code": 500, "message": "context overflow", "type": "server_error"}}`, nil)
+
+	output := performLocalPrimary(t, "llamacpp", server.URL)
+	if output != "error api context overflow\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+}
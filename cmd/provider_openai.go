@@ -0,0 +1,155 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Speaks the OpenAI API. Also serves anything OpenAI compatible, like
+// llama.cpp's server, by way of a different BaseURL.
+type OpenAIProvider struct {
+	URL     string
+	ApiKey  string
+	BaseURL string
+	name    string
+}
+
+func init() {
+	registerProvider("openai", func(url string) Provider {
+		baseUrl := httpSettings.BaseURL
+		if baseUrl == "" {
+			baseUrl = "https://api.openai.com/v1"
+		}
+
+		return &OpenAIProvider{
+			URL:     url,
+			ApiKey:  os.Getenv("OPENAI_API_KEY"),
+			BaseURL: baseUrl,
+			name:    "openai",
+		}
+	})
+
+	// llama.cpp's server exposes an OpenAI compatible api, usually without auth
+	registerProvider("llamacpp", func(url string) Provider {
+		host := os.Getenv("LLAMACPP_HOST")
+		if host == "" {
+			host = "http://localhost:8080"
+		}
+
+		return &OpenAIProvider{
+			URL:     url,
+			ApiKey:  os.Getenv("LLAMACPP_API_KEY"),
+			BaseURL: strings.TrimRight(host, "/") + "/v1",
+			name:    "llamacpp",
+		}
+	})
+}
+
+func (p *OpenAIProvider) Name() string {
+	return p.name
+}
+
+// Use the overriding url if there is one, otherwise the given path off BaseURL
+func (p *OpenAIProvider) endpoint(path string) string {
+	if p.URL != "" {
+		return p.URL
+	}
+	return p.BaseURL + path
+}
+
+func (p *OpenAIProvider) headers() map[string]string {
+	if p.ApiKey == "" && p.name != "openai" {
+		return nil
+	}
+	return map[string]string{"Authorization": fmt.Sprintf("Bearer %s", p.ApiKey)}
+}
+
+func (p *OpenAIProvider) ChatCompletion(ctx context.Context, payload map[string]any) (*OpenAICompletionResponse, error) {
+	var obj OpenAICompletionResponse
+	url := p.endpoint("/chat/completions")
+	if err := postJSON(ctx, url, p.headers(), payload, &obj); err != nil {
+		return nil, err
+	}
+
+	return &obj, nil
+}
+
+func (p *OpenAIProvider) ChatCompletionStream(ctx context.Context, payload map[string]any, handler StreamHandler) (*OpenAICompletionResponse, error) {
+	url := p.endpoint("/chat/completions")
+	body, err := postStream(ctx, url, p.headers(), streamingPayload(payload, p.name == "openai"))
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	return readCompletionStream(body, handler)
+}
+
+func (p *OpenAIProvider) GenerateImage(ctx context.Context, params CarryoverJson) (*OpenAIImageGenerationResponse, error) {
+	var obj OpenAIImageGenerationResponse
+	url := p.endpoint("/images/generations")
+	if err := postJSON(ctx, url, p.headers(), params, &obj); err != nil {
+		return nil, err
+	}
+
+	return &obj, nil
+}
+
+// The spoken audio of params' input, as mp3
+func (p *OpenAIProvider) Speech(ctx context.Context, params map[string]any) ([]byte, error) {
+	url := p.endpoint("/audio/speech")
+	body, err := postRaw(ctx, url, p.headers(), params)
+	if err != nil {
+		return nil, err
+	}
+
+	// Audio when it works, a json error when it doesn't
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("{")) {
+		var obj struct {
+			Error *OpenAIError `json:"error"`
+		}
+		if err := json.Unmarshal(body, &obj); err == nil && obj.Error.fullMessage() != "" {
+			return nil, errors.New(obj.Error.fullMessage())
+		}
+	}
+
+	return body, nil
+}
+
+func (p *OpenAIProvider) ListModels(ctx context.Context) ([]string, error) {
+	var obj struct {
+		Error *struct {
+			Message string `json:"message"`
+		} `json:"error"`
+		Data []struct {
+			Id string `json:"id"`
+		} `json:"data"`
+	}
+
+	url := p.endpoint("/models")
+	if err := getJSON(ctx, url, p.headers(), &obj); err != nil {
+		return nil, err
+	}
+
+	if obj.Error != nil && obj.Error.Message != "" {
+		return nil, fmt.Errorf("%s", obj.Error.Message)
+	}
+
+	var models []string
+	for _, model := range obj.Data {
+		models = append(models, model.Id)
+	}
+	sort.Strings(models)
+
+	return models, nil
+}
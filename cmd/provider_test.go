@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNewProvider_Selection(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "")
+
+	provider, err := NewProvider("")
+	if err != nil {
+		t.Fatal("default provider errored:", err)
+	}
+
+	if provider.Name() != "openai" {
+		t.Errorf("want default provider openai, got %s", provider.Name())
+	}
+
+	t.Setenv("AI_PROVIDER", "nonexistent")
+
+	if _, err := NewProvider(""); err == nil {
+		t.Error("expected an error selecting an unknown provider")
+	}
+
+	// The flag beats the env var
+	providerName = "openai"
+	defer func() { providerName = "" }()
+
+	if _, err := NewProvider(""); err != nil {
+		t.Error("flag selected provider errored:", err)
+	}
+}
+
+func TestOpenAIProvider_ListModels(t *testing.T) {
+	responseJson := `{"data": [{"id": "gpt-4o"}, {"id": "dall-e-3"}]}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer test-key" {
+			t.Errorf("missing bearer token, got headers: %v", r.Header)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(responseJson))
+	}))
+
+	defer server.Close()
+
+	provider := &OpenAIProvider{URL: server.URL, ApiKey: "test-key", name: "openai"}
+	models, err := provider.ListModels(context.Background())
+	if err != nil {
+		t.Fatal("listing models errored:", err)
+	}
+
+	if len(models) != 2 || models[0] != "dall-e-3" || models[1] != "gpt-4o" {
+		t.Errorf("unexpected models: %v", models)
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The first retry waits up to this long, doubling with each one after. A var
+// so tests don't have to wait.
+var retryBaseDelay = time.Second
+
+// No single wait is longer than this, whatever the server asks for
+const maxRetryDelay = time.Minute
+
+// Whether a failed attempt is safe to make again. Statuses that mean the
+// server turned the request away are, whatever the method. A server error or
+// a dropped connection may have come after the work was done, and billed, so
+// those are only retried for GETs. Running out of quota isn't going to get
+// better by waiting.
+func shouldRetry(req *http.Request, resp *http.Response, body []byte, err error) bool {
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return true
+		}
+		return idempotent
+	}
+
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return !bytes.Contains(body, []byte("insufficient_quota"))
+	case http.StatusRequestTimeout, http.StatusServiceUnavailable, 529:
+		// 529 is anthropic's "overloaded"
+		return true
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusGatewayTimeout:
+		return idempotent
+	}
+	return false
+}
+
+// How long the server asked us to wait before trying again, if it did
+func retryAfter(resp *http.Response) (time.Duration, bool) {
+	if resp == nil {
+		return 0, false
+	}
+
+	if ms, err := strconv.ParseFloat(resp.Header.Get("Retry-After-Ms"), 64); err == nil {
+		return time.Duration(ms * float64(time.Millisecond)), true
+	}
+
+	header := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.ParseFloat(header, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	if when, err := http.ParseTime(header); err == nil {
+		return time.Until(when), true
+	}
+
+	return 0, false
+}
+
+// Exponential backoff with full jitter, so that many clients backing off at
+// once don't all come back at once
+func backoff(attempt int) time.Duration {
+	ceiling := retryBaseDelay << attempt
+	if ceiling <= 0 || ceiling > maxRetryDelay {
+		ceiling = maxRetryDelay
+	}
+	return time.Duration(rand.Int63n(int64(ceiling) + 1))
+}
+
+// Send req through send, trying again with backoff when it fails in a way
+// that's safe to retry, up to max_retries times. Each attempt waits on the
+// host's rate limits first. The last response is returned as is, error
+// status and all, for the caller to make sense of. Waiting stops when req's
+// context is done.
+func sendWithRetries(req *http.Request, send func(*http.Request) (*http.Response, error)) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := rateLimits.wait(req.Context(), req.URL.Host); err != nil {
+			return nil, err
+		}
+
+		if attempt > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+
+		resp, err := send(req)
+		if resp != nil {
+			rateLimits.update(req.URL.Host, resp.Header)
+		}
+
+		// The body is needed to tell a quota error from a rate limit, and has
+		// to be put back for the caller
+		var body []byte
+		if err == nil && resp.StatusCode >= 400 {
+			body, _ = io.ReadAll(resp.Body)
+			resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		if attempt >= activeConfig.MaxRetries || !shouldRetry(req, resp, body, err) {
+			return resp, err
+		}
+
+		delay, asked := retryAfter(resp)
+		if !asked {
+			delay = backoff(attempt)
+		}
+		if delay > maxRetryDelay {
+			return resp, err
+		}
+
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = resp.Status
+		}
+		fmt.Fprintf(os.Stderr, "%s, retrying in %s (%d of %d)\n", reason, delay.Round(time.Millisecond), attempt+1, activeConfig.MaxRetries)
+		if err := sleepContext(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// What the rate limit headers of each host's last response said about when
+// the next request can go out
+type rateLimiter struct {
+	mu        sync.Mutex
+	notBefore map[string]time.Time
+}
+
+var rateLimits = &rateLimiter{notBefore: map[string]time.Time{}}
+
+// Block until host's limits allow another request, or ctx is done
+func (l *rateLimiter) wait(ctx context.Context, host string) error {
+	l.mu.Lock()
+	until := l.notBefore[host]
+	l.mu.Unlock()
+
+	if delay := time.Until(until); delay > 0 {
+		fmt.Fprintf(os.Stderr, "near the rate limit, waiting %s\n", delay.Round(time.Millisecond))
+		return sleepContext(ctx, min(delay, maxRetryDelay))
+	}
+	return nil
+}
+
+// Slow down ahead of the limit, going by openai's x-ratelimit-* or
+// anthropic's anthropic-ratelimit-* headers. With nothing left, requests wait
+// for the reset. With under a tenth left, the rest are spread out until it.
+func (l *rateLimiter) update(host string, headers http.Header) {
+	var pause time.Duration
+
+	for _, kind := range []string{"requests", "tokens"} {
+		limit, remaining, reset, ok := rateLimitHeaders(headers, kind)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case remaining <= 0:
+			pause = max(pause, reset)
+		case limit > 0 && remaining*10 < limit:
+			pause = max(pause, reset/time.Duration(remaining+1))
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if pause > 0 {
+		l.notBefore[host] = time.Now().Add(pause)
+	} else {
+		delete(l.notBefore, host)
+	}
+}
+
+// The limit, what's left of it, and how long until it resets, for kind
+// (requests or tokens), in either provider's headers
+func rateLimitHeaders(headers http.Header, kind string) (int, int, time.Duration, bool) {
+	names := [][3]string{
+		{"x-ratelimit-limit-" + kind, "x-ratelimit-remaining-" + kind, "x-ratelimit-reset-" + kind},
+		{"anthropic-ratelimit-" + kind + "-limit", "anthropic-ratelimit-" + kind + "-remaining", "anthropic-ratelimit-" + kind + "-reset"},
+	}
+
+	for _, name := range names {
+		remaining, err := strconv.Atoi(headers.Get(name[1]))
+		if err != nil {
+			continue
+		}
+		limit, _ := strconv.Atoi(headers.Get(name[0]))
+		return limit, remaining, parseReset(headers.Get(name[2])), true
+	}
+
+	return 0, 0, 0, false
+}
+
+// Resets come as a duration like 6m0s from openai, and as a time from
+// anthropic
+func parseReset(reset string) time.Duration {
+	reset = strings.TrimSpace(reset)
+	if duration, err := time.ParseDuration(reset); err == nil {
+		return duration
+	}
+	if when, err := time.Parse(time.RFC3339, reset); err == nil {
+		return max(time.Until(when), 0)
+	}
+	return 0
+}
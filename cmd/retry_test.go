@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Back off by milliseconds, with no rate limits left over from other tests
+func useFastRetries(t *testing.T) {
+	previousDelay := retryBaseDelay
+	retryBaseDelay = time.Millisecond
+	rateLimits = &rateLimiter{notBefore: map[string]time.Time{}}
+	t.Cleanup(func() {
+		retryBaseDelay = previousDelay
+		rateLimits = &rateLimiter{notBefore: map[string]time.Time{}}
+	})
+}
+
+func TestRetry_RateLimitedThenOK(t *testing.T) {
+	useFastRetries(t)
+
+	var calls atomic.Int32
+	var bodies []string
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+
+		if calls.Add(1) < 3 {
+			w.Header().Set("Retry-After-Ms", "5")
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"error": {"type": "rate_limit_exceeded"}}`))
+			return
+		}
+		w.Write([]byte(`{"ok": true}`))
+	})
+
+	var out map[string]bool
+	if err := postJSON(context.Background(), server.URL, nil, map[string]string{"prompt": "hi"}, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !out["ok"] || calls.Load() != 3 {
+		t.Errorf("expected success on the third try, got %v after %d", out, calls.Load())
+	}
+	for _, body := range bodies {
+		if body != `{"prompt":"hi"}` {
+			t.Errorf("expected every try to send the payload, got %q", body)
+		}
+	}
+}
+
+func TestRetry_GivesUpAfterMaxRetries(t *testing.T) {
+	useFastRetries(t)
+
+	var calls atomic.Int32
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"error": {"message": "overloaded"}}`))
+	})
+
+	_, err := postRaw(context.Background(), server.URL, nil, map[string]string{})
+
+	if int(calls.Load()) != activeConfig.MaxRetries+1 {
+		t.Errorf("expected %d tries, got %d", activeConfig.MaxRetries+1, calls.Load())
+	}
+	if err == nil || err.Error() != "overloaded" {
+		t.Errorf("expected the last response's error, got %v", err)
+	}
+}
+
+func TestRetry_OnlySafeErrors(t *testing.T) {
+	useFastRetries(t)
+
+	for _, test := range []struct {
+		method string
+		status int
+		body   string
+		tries  int32
+	}{
+		{"POST", http.StatusTooManyRequests, `{"error": {"code": "insufficient_quota"}}`, 1},
+		{"POST", http.StatusBadRequest, `{}`, 1},
+		{"POST", http.StatusInternalServerError, `{}`, 1},
+		{"GET", http.StatusInternalServerError, `{}`, 4},
+		{"POST", 529, `{}`, 4},
+	} {
+		var calls atomic.Int32
+		server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+			calls.Add(1)
+			w.WriteHeader(test.status)
+			w.Write([]byte(test.body))
+		})
+
+		req, _ := http.NewRequest(test.method, server.URL, strings.NewReader("{}"))
+		doRequest(req)
+
+		if calls.Load() != test.tries {
+			t.Errorf("%s %d %s: expected %d tries, got %d", test.method, test.status, test.body, test.tries, calls.Load())
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for header, want := range map[[2]string]time.Duration{
+		{"Retry-After", "2"}:        2 * time.Second,
+		{"Retry-After", "0.5"}:      500 * time.Millisecond,
+		{"Retry-After-Ms", "250"}:   250 * time.Millisecond,
+		{"Retry-After", "whenever"}: 0,
+	} {
+		resp := &http.Response{Header: http.Header{}}
+		resp.Header.Set(header[0], header[1])
+
+		got, _ := retryAfter(resp)
+		if got != want {
+			t.Errorf("%s: %s: expected %s, got %s", header[0], header[1], want, got)
+		}
+	}
+
+	resp := &http.Response{Header: http.Header{}}
+	resp.Header.Set("Retry-After", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if got, ok := retryAfter(resp); !ok || got < 58*time.Second || got > time.Minute {
+		t.Errorf("expected about a minute from an http date, got %s", got)
+	}
+}
+
+func TestRateLimiter_SlowsDownNearTheLimit(t *testing.T) {
+	useFastRetries(t)
+
+	for _, test := range []struct {
+		name    string
+		headers map[string]string
+		min     time.Duration
+		max     time.Duration
+	}{
+		{"plenty left", map[string]string{
+			"x-ratelimit-limit-requests":     "100",
+			"x-ratelimit-remaining-requests": "50",
+			"x-ratelimit-reset-requests":     "30s",
+		}, 0, 0},
+		{"none left", map[string]string{
+			"x-ratelimit-limit-tokens":     "10000",
+			"x-ratelimit-remaining-tokens": "0",
+			"x-ratelimit-reset-tokens":     "6m0s",
+		}, 5 * time.Minute, 6 * time.Minute},
+		{"a few left", map[string]string{
+			"x-ratelimit-limit-requests":     "100",
+			"x-ratelimit-remaining-requests": "3",
+			"x-ratelimit-reset-requests":     "8s",
+		}, 1900 * time.Millisecond, 2 * time.Second},
+		{"anthropic", map[string]string{
+			"anthropic-ratelimit-requests-limit":     "50",
+			"anthropic-ratelimit-requests-remaining": "0",
+			"anthropic-ratelimit-requests-reset":     time.Now().Add(20 * time.Second).UTC().Format(time.RFC3339),
+		}, 18 * time.Second, 20 * time.Second},
+	} {
+		headers := http.Header{}
+		for key, value := range test.headers {
+			headers.Set(key, value)
+		}
+
+		rateLimits.update("api.example.com", headers)
+		pause := max(time.Until(rateLimits.notBefore["api.example.com"]), 0)
+		if pause < test.min || pause > test.max {
+			t.Errorf("%s: expected to wait between %s and %s, got %s", test.name, test.min, test.max, pause)
+		}
+	}
+}
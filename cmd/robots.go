@@ -0,0 +1,162 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// What we go by in robots.txt, on top of *
+const robotsUserAgent = "ai-functions"
+
+type robotsRule struct {
+	allow   bool
+	pattern *regexp.Regexp
+	// Longer paths are more specific, and win
+	length int
+}
+
+// The rules of a robots.txt that apply to us
+type robotsRules []robotsRule
+
+// Parse a robots.txt, keeping the rules of the group for our user agent, or
+// of the * group if there isn't one for us
+func parseRobots(robotsTxt string) robotsRules {
+	var ours, everyone robotsRules
+	foundOurs := false
+
+	var agents []string
+	inRules := false
+
+	scanner := bufio.NewScanner(strings.NewReader(robotsTxt))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			// A user-agent after rules starts a new group
+			if inRules {
+				agents = nil
+				inRules = false
+			}
+			agent := strings.ToLower(value)
+			agents = append(agents, agent)
+			if agent == robotsUserAgent {
+				foundOurs = true
+			}
+		case "allow", "disallow":
+			inRules = true
+			// An empty disallow allows everything
+			if value == "" {
+				continue
+			}
+
+			rule := robotsRule{allow: key == "allow", pattern: robotsPattern(value), length: len(value)}
+			for _, agent := range agents {
+				if agent == robotsUserAgent {
+					ours = append(ours, rule)
+				} else if agent == "*" {
+					everyone = append(everyone, rule)
+				}
+			}
+		}
+	}
+
+	if foundOurs {
+		return ours
+	}
+	return everyone
+}
+
+// robots.txt paths are prefixes, where * matches anything and a trailing $
+// anchors the end
+func robotsPattern(path string) *regexp.Regexp {
+	anchored := strings.HasSuffix(path, "$")
+	path = strings.TrimSuffix(path, "$")
+
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i, part := range strings.Split(path, "*") {
+		if i > 0 {
+			expr.WriteString(".*")
+		}
+		expr.WriteString(regexp.QuoteMeta(part))
+	}
+	if anchored {
+		expr.WriteString("$")
+	}
+
+	return regexp.MustCompile(expr.String())
+}
+
+// Whether the rules let us read path. The longest matching rule decides, with
+// allow winning a tie.
+func (rules robotsRules) allowed(path string) bool {
+	allowed := true
+	longest := -1
+
+	for _, rule := range rules {
+		if !rule.pattern.MatchString(path) {
+			continue
+		}
+		if rule.length > longest || (rule.length == longest && rule.allow) {
+			allowed = rule.allow
+			longest = rule.length
+		}
+	}
+
+	return allowed
+}
+
+// Each host's robots.txt, fetched the first time one of its pages comes up
+type robotsCache struct {
+	mu    sync.Mutex
+	hosts map[string]robotsRules
+}
+
+func newRobotsCache() *robotsCache {
+	return &robotsCache{hosts: map[string]robotsRules{}}
+}
+
+// Whether robots.txt lets us read pageUrl. A site without a robots.txt, or
+// whose robots.txt can't be read, allows everything.
+func (c *robotsCache) allowed(ctx context.Context, pageUrl string) bool {
+	parsed, err := url.Parse(pageUrl)
+	if err != nil {
+		return false
+	}
+
+	c.mu.Lock()
+	rules, ok := c.hosts[parsed.Host]
+	if !ok {
+		robotsUrl := url.URL{Scheme: parsed.Scheme, Host: parsed.Host, Path: "/robots.txt"}
+		if page, err := fetchPage(ctx, robotsUrl.String()); err == nil {
+			rules = parseRobots(page.Markdown)
+		}
+		c.hosts[parsed.Host] = rules
+	}
+	c.mu.Unlock()
+
+	path := parsed.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if parsed.RawQuery != "" {
+		path += "?" + parsed.RawQuery
+	}
+
+	return rules.allowed(path)
+}
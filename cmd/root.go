@@ -5,11 +5,21 @@ Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
 package cmd
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -17,56 +27,213 @@ var rootCmd = &cobra.Command{
 	Use:   "ai",
 	Short: "A general purpose AI CLI app",
 	Long:  `Not meant to be called directly`,
-	Run: func(cmd *cobra.Command, args []string) {
-		fmt.Println("Error: requires a subcommand")
-		os.Exit(1)
+	// Errors are written as an `error <class> <message>` line by Execute
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		usageSubcommand = cmd.Name()
+		if !validOutputFormat(outputFormat) {
+			format := outputFormat
+			outputFormat = FormatPrefix
+			return classifyf(ErrUsage, "unknown output format %q, expected one of %v", format, outputFormats)
+		}
+		return classify(ErrConfig, loadConfig(cmd))
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return classifyf(ErrUsage, "requires a subcommand")
 	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
+// A failure is written to stderr as an `error <class> <message>` line, unless
+// it's been written already, and the process exits with the class's code.
+// With a structured --output_format it's an error record on stdout instead,
+// so wrappers needn't read stderr at all.
 func Execute() {
-	err := rootCmd.Execute()
-	if err != nil {
-		os.Exit(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go cancelOnInterrupt(cancel)
+
+	err := rootCmd.ExecuteContext(ctx)
+	if err == nil {
+		return
+	}
+
+	// Whatever failed after Ctrl-C failed because of it
+	if ctx.Err() != nil {
+		err = classifyf(ErrInterrupted, "stopped before finishing")
+	}
+	// A bad --output_format can fail the flags before it's checked
+	if !validOutputFormat(outputFormat) {
+		outputFormat = FormatPrefix
+	}
+
+	var reported reportedError
+	if !errors.As(err, &reported) {
+		writeError(errorOutput(), err)
+	}
+	os.Exit(exitCode(err))
+}
+
+// How long the command gets to wind down after Ctrl-C before it's cut off
+const interruptGrace = 2 * time.Second
+
+// Cancel the command's context on Ctrl-C or SIGTERM, which stops its requests
+// and kills any plugins it's running. If it hasn't finished up by the grace
+// period, or the signal comes again, exit right away.
+func cancelOnInterrupt(cancel context.CancelFunc) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	<-signals
+	cancel()
+
+	select {
+	case <-signals:
+	case <-time.After(interruptGrace):
+	}
+
+	writeError(errorOutput(), classifyf(ErrInterrupted, "stopped before finishing"))
+	os.Exit(exitCodes[ErrInterrupted])
+}
+
+// Where Execute writes a failure: stderr for a prefix line, stdout for a record
+func errorOutput() io.Writer {
+	if outputFormat == FormatPrefix {
+		return os.Stderr
 	}
+	return os.Stdout
 }
 
 var primaryCmd = &cobra.Command{
 	Use:   "primary",
 	Short: "Executes the primary AI function",
 	Long:  `Not meant to be called directly`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		prompt, _ := cmd.Flags().GetString("prompt")
-		model, _ := cmd.Flags().GetString("model")
 		systemContent, _ := cmd.Flags().GetString("system_content")
-		resp, primaryErr := PerformPrimaryRequest(model, prompt, systemContent, "")
-		if primaryErr != nil {
-			log.Fatalln("Received error performing primary request:", primaryErr)
+		stream, _ := cmd.Flags().GetBool("stream")
+
+		opts := AgentOptions{MaxSteps: activeConfig.MaxSteps, Stream: stream}
+
+		if contextFile, _ := cmd.Flags().GetString("context"); contextFile != "" {
+			content, err := readContext(contextFile)
+			if err != nil {
+				return classifyf(ErrUsage, "unable to read context: %w", err)
+			}
+			opts.Context = content
 		}
-		HandlePrimaryResponse(*resp, os.Stdout)
+
+		return answerInSession(cmd, prompt, systemContent, opts)
 	},
 }
 
+var askCmd = &cobra.Command{
+	Use:   "ask <prompt>",
+	Short: "Answers a prompt start to finish, running any tools itself",
+	Long: `Gathers what the model needs to know about the system, along with anything
+piped in on stdin, asks the model, and runs whatever tool it settles on, like
+crawl_web or gen_image, right here. Only the final action, like a command to
+printz or a message, is written out for the shell.`,
+	Args: cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		shell, _ := cmd.Flags().GetString("shell")
+
+		opts := AgentOptions{MaxSteps: activeConfig.MaxSteps, RunTools: true}
+
+		if stdinPiped() {
+			content, err := readContext("-")
+			if err != nil {
+				return classifyf(ErrUsage, "unable to read stdin: %w", err)
+			}
+			opts.Context = content
+		}
+
+		prompt := fmt.Sprintf("USER INPUT: '%s'", strings.Join(args, " "))
+		return answerInSession(cmd, prompt, systemInfo(shell), opts)
+	},
+}
+
+var shellInitCmd = &cobra.Command{
+	Use:   "shell-init <bash|zsh|fish>",
+	Short: "Prints the ai function for a shell, to be loaded from its rc file",
+	Long: `Prints the integration for the shell, pointed at this binary. Each one runs
+ask and puts a suggested command on the editing line: zsh with print -z, bash
+with bind -x and READLINE_LINE, and fish with commandline -r.
+
+  bash: eval "$(ai-functions shell-init bash)"
+  zsh:  eval "$(ai-functions shell-init zsh)"
+  fish: ai-functions shell-init fish | source`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		bin, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("unable to find this binary: %w", err)
+		}
+		return writeShellInit(os.Stdout, args[0], bin)
+	},
+}
+
+// Run the primary agent for prompt, writing its answer to stdout, in this
+// shell's session if it has one
+func answerInSession(cmd *cobra.Command, prompt string, systemContent string, opts AgentOptions) error {
+	model := activeConfig.Model
+	sessionFlag, _ := cmd.Flags().GetString("session")
+
+	// Follow ups need to see the earlier exchanges of this shell session
+	var session *Session
+	if key := currentSessionKey(sessionFlag); key != "" {
+		var err error
+		if session, err = LoadSession(key); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to load session, continuing without it:", err)
+		}
+	}
+
+	if session != nil {
+		opts.History = session.History()
+	}
+
+	// An error the model answered with is still part of the conversation
+	resp, err := RunPrimaryAgent(cmd.Context(), model, prompt, systemContent, "", opts, os.Stdout)
+	if resp != nil && session != nil {
+		// Content too big to send whole would swamp every later prompt,
+		// so the session only keeps it if it's small
+		remembered := prompt
+		if countTokens(model, opts.Context) <= chunkTokens(model) {
+			remembered = withContext(prompt, opts.Context)
+		}
+		session.Append(remembered, *resp)
+		if err := session.Save(); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to save session:", err)
+		}
+	}
+
+	return err
+}
+
 // TODO To test these in a basic way, let's just feed some jsonParams as I expect them
 // into these commands
 var crawlWebCmd = &cobra.Command{
 	Use:   "crawl_web",
 	Short: "Executes the web crawling AI function",
 	Long:  `Not meant to be called directly`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		jsonParams, _ := cmd.Flags().GetString("jsonParams")
-		model, _ := cmd.Flags().GetString("model")
+		stream, _ := cmd.Flags().GetBool("stream")
+		model := activeConfig.Model
 
-		resp, err := CrawlWeb(model, jsonParams, "")
-		if err != nil {
-			log.Fatalln("Received error performing crawl web:", err)
+		if stream {
+			_, err := StreamCrawlWeb(cmd.Context(), model, jsonParams, "", os.Stdout)
+			return err
 		}
 
-		handleErr := HandleCrawlWebResponse(*resp)
-		if handleErr != nil {
-			log.Fatalln("Received error during web crawl result handling:", handleErr)
+		resp, err := CrawlWeb(cmd.Context(), model, jsonParams, "")
+		if err != nil {
+			return err
 		}
+
+		return HandleCrawlWebResponse(*resp)
 	},
 }
 
@@ -74,39 +241,334 @@ var genImageCmd = &cobra.Command{
 	Use:   "gen_image",
 	Short: "Executes the image generation AI function",
 	Long:  `Not meant to be called directly`,
-	Run: func(cmd *cobra.Command, args []string) {
+	RunE: func(cmd *cobra.Command, args []string) error {
 		jsonParams, _ := cmd.Flags().GetString("jsonParams")
 		model, _ := cmd.Flags().GetString("model")
 
-		resp, genErr := GenImage(model, jsonParams, "")
-		if genErr != nil {
-			log.Fatalln("Received error during image generation:", genErr)
+		resp, err := GenImage(cmd.Context(), model, jsonParams, "")
+		if err != nil {
+			return err
+		}
+
+		return HandleGenImageResponse(*resp)
+	},
+}
+
+var toolCmd = &cobra.Command{
+	Use:   "tool <name>",
+	Short: "Finishes off a tool call the primary function handed to the shell",
+	Long:  `Not meant to be called directly`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		jsonParams, _ := cmd.Flags().GetString("jsonParams")
+
+		return RunTool(cmd.Context(), args[0], jsonParams, os.Stdout)
+	},
+}
+
+var modelsCmd = &cobra.Command{
+	Use:   "models",
+	Short: "Lists the models available from the selected provider",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		provider, err := NewProvider("")
+		if err != nil {
+			return classify(ErrConfig, err)
+		}
+
+		models, err := withTimeout(cmd.Context(), requestStage(provider), activeConfig.Timeouts.Request, provider.ListModels)
+		if err != nil {
+			return fmt.Errorf("unable to list models: %w", err)
+		}
+
+		for _, model := range models {
+			fmt.Println(model)
+		}
+		return nil
+	},
+}
+
+var sessionCmd = &cobra.Command{
+	Use:   "session",
+	Short: "Manages the conversation sessions follow up questions are asked in",
+	Long: `Each shell session, keyed by its terminal or $AI_SESSION, remembers its
+exchanges with the model so that follow ups like "now do it for tcp" work.`,
+}
+
+var sessionListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists saved sessions, most recent first",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		sessions, err := ListSessions()
+		if err != nil {
+			return fmt.Errorf("unable to list sessions: %w", err)
+		}
+
+		current := currentSessionKey(sessionKeyFlag)
+		for _, session := range sessions {
+			marker := " "
+			if session.Key == current {
+				marker = "*"
+			}
+
+			firstPrompt := ""
+			if len(session.Messages) > 0 {
+				firstPrompt, _ = session.Messages[0]["content"].(string)
+				firstPrompt = strings.Join(strings.Fields(firstPrompt), " ")
+				if len(firstPrompt) > 60 {
+					firstPrompt = firstPrompt[:60] + "..."
+				}
+			}
+
+			fmt.Printf("%s %s  %s  %d exchanges  %s\n",
+				marker, session.Key, session.Updated.Format("2006-01-02 15:04"), len(session.Messages)/2, firstPrompt)
+		}
+		return nil
+	},
+}
+
+var sessionResumeCmd = &cobra.Command{
+	Use:   "resume <session>",
+	Short: "Continues an earlier session from this shell",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		current := currentSessionKey(sessionKeyFlag)
+		if current == "" {
+			return classifyf(ErrUsage, "unable to tell which session this shell is in, set AI_SESSION or pass --session")
+		}
+
+		earlier, err := LoadSession(args[0])
+		if err != nil {
+			return fmt.Errorf("unable to load session: %w", err)
+		}
+		if len(earlier.Messages) == 0 {
+			return classifyf(ErrUsage, "no saved session named %s", args[0])
+		}
+
+		session := &Session{Key: current, Messages: earlier.Messages}
+		if err := session.Save(); err != nil {
+			return fmt.Errorf("unable to save session: %w", err)
+		}
+
+		fmt.Printf("Resumed %s with %d exchanges\n", args[0], len(session.Messages)/2)
+		return nil
+	},
+}
+
+var sessionExportCmd = &cobra.Command{
+	Use:   "export [session]",
+	Short: "Writes a session out as markdown, this shell's by default",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		key := currentSessionKey(sessionKeyFlag)
+		if len(args) == 1 {
+			key = args[0]
+		}
+		if key == "" {
+			return classifyf(ErrUsage, "unable to tell which session this shell is in, name one")
 		}
 
-		handleErr := HandleGenImageResponse(*resp)
-		if handleErr != nil {
-			log.Fatalln("Received error during image handling:", handleErr)
+		session, err := LoadSession(key)
+		if err != nil {
+			return fmt.Errorf("unable to load session: %w", err)
 		}
+
+		session.ExportMarkdown(os.Stdout)
+		return nil
 	},
 }
 
+var sessionClearCmd = &cobra.Command{
+	Use:   "clear [session]",
+	Short: "Forgets a session, this shell's by default",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		all, _ := cmd.Flags().GetBool("all")
+
+		var keys []string
+		if all {
+			sessions, err := ListSessions()
+			if err != nil {
+				return fmt.Errorf("unable to list sessions: %w", err)
+			}
+			for _, session := range sessions {
+				keys = append(keys, session.Key)
+			}
+		} else if len(args) == 1 {
+			keys = []string{args[0]}
+		} else if key := currentSessionKey(sessionKeyFlag); key != "" {
+			keys = []string{key}
+		} else {
+			return classifyf(ErrUsage, "unable to tell which session this shell is in, name one or pass --all")
+		}
+
+		for _, key := range keys {
+			if err := ClearSession(key); err != nil {
+				return fmt.Errorf("unable to clear session: %w", err)
+			}
+		}
+		return nil
+	},
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Shows the effective settings",
+	Long: `Shows the settings in effect, after the config file, env vars and flags
+have been applied. Header values are hidden.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path := configFile
+		if path == "" {
+			path = defaultConfigPath()
+		}
+
+		if _, err := os.Stat(path); err == nil {
+			fmt.Println("# config file:", path)
+		} else {
+			fmt.Println("# config file:", path, "(not found, using defaults)")
+		}
+
+		out, err := yaml.Marshal(activeConfig.Redacted())
+		if err != nil {
+			return fmt.Errorf("unable to print config: %w", err)
+		}
+		fmt.Print(string(out))
+		return nil
+	},
+}
+
+var configValidateCmd = &cobra.Command{
+	Use:   "validate",
+	Short: "Checks the effective settings for mistakes",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		problems := activeConfig.Validate()
+		for _, problem := range problems {
+			fmt.Println("invalid:", problem)
+		}
+
+		if len(problems) > 0 {
+			return classifyf(ErrConfig, "the config has %d problem(s)", len(problems))
+		}
+
+		fmt.Println("config ok")
+		return nil
+	},
+}
+
+var usageCmd = &cobra.Command{
+	Use:   "usage",
+	Short: "Shows what's been spent, by day, model and tool",
+	Long: `Totals up the usage ledger, where every call to a provider is recorded,
+pricing it with the built in prices and any in the config's prices.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		days, _ := cmd.Flags().GetInt("days")
+
+		now := time.Now()
+		since := time.Date(now.Year(), now.Month(), now.Day()-days+1, 0, 0, 0, 0, time.Local)
+
+		entries, err := readUsage(activeConfig.UsageLedger, since)
+		if err != nil {
+			return fmt.Errorf("unable to read usage ledger: %w", err)
+		}
+
+		writeUsageReport(os.Stdout, entries, since)
+		return nil
+	},
+}
+
+// Read the content of path, or of stdin if path is -
+func readContext(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	return string(data), err
+}
+
+// Whether stdin is a pipe, or a file, rather than a terminal. Like the shell's
+// [ -p /dev/stdin ], so nothing's read when stdin is just left open.
+func stdinPiped() bool {
+	info, err := os.Stdin.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeNamedPipe != 0 || info.Mode().IsRegular()
+}
+
+// What the model's told about the system, so its commands work here: uname -a,
+// or the OS and architecture where there's no uname, and the shell
+func systemInfo(shell string) string {
+	info := runtime.GOOS + " " + runtime.GOARCH
+	if out, err := exec.Command("uname", "-a").Output(); err == nil {
+		info = strings.TrimSpace(string(out))
+	}
+
+	if shell != "" {
+		info += "\nShell: " + shell
+	}
+	return info
+}
+
+// Which session the session subcommands consider this shell's
+var sessionKeyFlag string
+
 func init() {
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return classify(ErrUsage, err)
+	})
+
+	rootCmd.PersistentFlags().StringVar(&providerName, "provider", "", "Which LLM provider to use, defaults to $AI_PROVIDER, then the config's provider")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "Config file to use, defaults to ~/.config/ai-functions/config.yaml")
+	rootCmd.PersistentFlags().StringVar((*string)(&outputFormat), "output_format", string(FormatPrefix), "How answers and errors are written: prefix lines, json lines, or nul records")
+
 	rootCmd.AddCommand(primaryCmd)
+	rootCmd.AddCommand(askCmd)
 	rootCmd.AddCommand(crawlWebCmd)
 	rootCmd.AddCommand(genImageCmd)
+	rootCmd.AddCommand(toolCmd)
+	rootCmd.AddCommand(modelsCmd)
+	rootCmd.AddCommand(sessionCmd)
+	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(usageCmd)
+	rootCmd.AddCommand(shellInitCmd)
+
+	configCmd.AddCommand(configValidateCmd)
+
+	sessionCmd.AddCommand(sessionListCmd)
+	sessionCmd.AddCommand(sessionResumeCmd)
+	sessionCmd.AddCommand(sessionExportCmd)
+	sessionCmd.AddCommand(sessionClearCmd)
+	sessionCmd.PersistentFlags().StringVar(&sessionKeyFlag, "session", "", "This shell's session, defaults to $AI_SESSION or the terminal")
+	sessionClearCmd.Flags().Bool("all", false, "Forget every session")
 
 	primaryCmd.Flags().String("prompt", "", "What the user enters, to be sent to openai in addition to hard coded tools")
-	primaryCmd.Flags().String("model", "gpt-3.5-turbo-0125", "What model to use")
+	primaryCmd.Flags().String("model", "", "What model to use, defaults to the config's model")
 	primaryCmd.Flags().String("system_content", "", "Information about the system, used for printz")
+	primaryCmd.Flags().Bool("stream", false, "Write a plain message out as it arrives")
+	primaryCmd.Flags().String("session", "", "Which session to remember this exchange in, defaults to $AI_SESSION or the terminal")
+	primaryCmd.Flags().Int("max_steps", 0, "How many times the model may be called, feeding it tool results like crawl_web's in between. 1 is a single shot. Defaults to the config's max_steps")
+	primaryCmd.Flags().String("context", "", "File of content piped in along with the prompt, - for stdin. Big content is read in chunks")
 	primaryCmd.MarkFlagRequired("prompt")
-	primaryCmd.MarkFlagRequired("model")
 	primaryCmd.MarkFlagRequired("system_content")
 
+	askCmd.Flags().String("model", "", "What model to use, defaults to the config's model")
+	askCmd.Flags().String("session", "", "Which session to remember this exchange in, defaults to $AI_SESSION or the terminal")
+	askCmd.Flags().Int("max_steps", 0, "How many times the model may be called, feeding it tool results like crawl_web's in between. Defaults to the config's max_steps")
+	askCmd.Flags().String("shell", filepath.Base(os.Getenv("SHELL")), "The shell the model's commands are for, defaults to $SHELL")
+
 	crawlWebCmd.Flags().String("jsonParams", "", "What the user enters, to be sent to openai in addition to hard coded tools")
-	crawlWebCmd.Flags().String("model", "gpt-3.5-turbo-0125", "What model to use")
+	crawlWebCmd.Flags().String("model", "", "What model to use, defaults to the config's model")
+	crawlWebCmd.Flags().Bool("stream", false, "Write the extracted information out as it arrives")
 	crawlWebCmd.MarkFlagRequired("jsonParams")
-	crawlWebCmd.MarkFlagRequired("model")
 
 	genImageCmd.Flags().String("jsonParams", "", "The model's image generation json")
 	genImageCmd.MarkFlagRequired("jsonParams")
+
+	toolCmd.Flags().String("jsonParams", "", "The model's arguments for the tool")
+	toolCmd.Flags().String("model", "", "What model to use, defaults to the config's model")
+	toolCmd.MarkFlagRequired("jsonParams")
+
+	usageCmd.Flags().Int("days", 30, "How many days back to total up, today included")
 }
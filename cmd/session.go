@@ -0,0 +1,256 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// How many of a session's most recent messages are replayed to the model
+const sessionHistoryLimit = 20
+
+// Longer messages are cut down before being saved, so that something like a
+// big piped in log doesn't get replayed on every follow up
+const sessionMessageLimit = 4000
+
+// The exchanges between a user and the model in one shell session
+type Session struct {
+	Key      string           `json:"key"`
+	Updated  time.Time        `json:"updated"`
+	Messages []map[string]any `json:"messages"`
+}
+
+// Where sessions are kept. AI_SESSIONS_DIR wins, then $XDG_STATE_HOME.
+func sessionsDir() (string, error) {
+	if dir := os.Getenv("AI_SESSIONS_DIR"); dir != "" {
+		return dir, nil
+	}
+
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(stateHome, "ai-functions", "sessions"), nil
+}
+
+var unsafeSessionChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// Session keys are things like /dev/pts/3, so make them safe as file names
+func sessionPath(key string) (string, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dir, unsafeSessionChars.ReplaceAllString(key, "_")+".json"), nil
+}
+
+// The session of the shell we're running in: the flag if given, then
+// AI_SESSION, then the controlling terminal. Empty means no session, which
+// AI_SESSION=off asks for.
+func currentSessionKey(flag string) string {
+	if flag != "" {
+		return flag
+	}
+
+	if key := os.Getenv("AI_SESSION"); key == "off" {
+		return ""
+	} else if key != "" {
+		return key
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return ""
+	}
+	defer tty.Close()
+
+	cmd := exec.Command("tty")
+	cmd.Stdin = tty
+	output, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	return strings.TrimSpace(string(output))
+}
+
+// Load the session for key. A session that's never been saved comes back empty.
+func LoadSession(key string) (*Session, error) {
+	path, err := sessionPath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &Session{Key: key}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, fmt.Errorf("session %s is corrupt: %w", key, err)
+	}
+
+	return &session, nil
+}
+
+func (s *Session) Save() error {
+	path, err := sessionPath(s.Key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Only what's replayed is worth keeping. The limit is even, so the
+	// oldest exchange left still starts with what the user asked.
+	if len(s.Messages) > sessionHistoryLimit {
+		s.Messages = s.Messages[len(s.Messages)-sessionHistoryLimit:]
+	}
+
+	s.Updated = time.Now()
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// The most recent messages, to be replayed ahead of a new prompt
+func (s *Session) History() []map[string]any {
+	if len(s.Messages) <= sessionHistoryLimit {
+		return s.Messages
+	}
+	return s.Messages[len(s.Messages)-sessionHistoryLimit:]
+}
+
+// Record an exchange: what the user asked and what the model answered with
+func (s *Session) Append(userInput string, resp OpenAICompletionResponse) {
+	s.Messages = append(s.Messages,
+		map[string]any{"role": "user", "content": truncateForSession(userInput)},
+		map[string]any{"role": "assistant", "content": truncateForSession(describeAnswer(resp))},
+	)
+}
+
+// Cut content down to sessionMessageLimit bytes, without splitting a character
+func truncateForSession(content string) string {
+	if len(content) <= sessionMessageLimit {
+		return content
+	}
+
+	cut := sessionMessageLimit
+	for cut > 0 && !utf8.RuneStart(content[cut]) {
+		cut--
+	}
+	return content[:cut] + " ..."
+}
+
+// Put the model's answer into words. Answers are replayed as plain text rather
+// than as tool calls, which every provider understands.
+func describeAnswer(resp OpenAICompletionResponse) string {
+	if errMessage := getErrorMessage(resp); errMessage != "" {
+		return "(error) " + errMessage
+	}
+
+	functionName := getToolcallFunctionName(resp)
+	arguments := getToolcallArguments(resp)
+
+	switch functionName {
+	case "message":
+		return getMessageContent(resp)
+	case "printz":
+		return "Suggested command: " + partialJSONString(arguments, "command")
+	case "":
+		return "(no answer)"
+	default:
+		return fmt.Sprintf("Called %s with %s", functionName, arguments)
+	}
+}
+
+// Delete the session for key, if there is one
+func ClearSession(key string) error {
+	path, err := sessionPath(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// All saved sessions, most recently updated first
+func ListSessions() ([]*Session, error) {
+	dir, err := sessionsDir()
+	if err != nil {
+		return nil, err
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*Session
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var session Session
+		if err := json.Unmarshal(data, &session); err != nil {
+			continue
+		}
+		sessions = append(sessions, &session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Updated.After(sessions[j].Updated)
+	})
+
+	return sessions, nil
+}
+
+// Write the session out as markdown
+func (s *Session) ExportMarkdown(w io.Writer) {
+	fmt.Fprintf(w, "# ai session %s\n\n", s.Key)
+	fmt.Fprintf(w, "_Last updated %s_\n", s.Updated.Format(time.RFC1123))
+
+	for _, message := range s.Messages {
+		content, _ := message["content"].(string)
+		switch message["role"] {
+		case "user":
+			fmt.Fprintf(w, "\n## User\n\n%s\n", strings.TrimSpace(content))
+		case "assistant":
+			fmt.Fprintf(w, "\n## Assistant\n\n%s\n", strings.TrimSpace(content))
+		}
+	}
+}
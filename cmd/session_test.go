@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func completionFromJson(t *testing.T, responseJson string) OpenAICompletionResponse {
+	var resp OpenAICompletionResponse
+	if err := json.Unmarshal([]byte(responseJson), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestSession_FollowUp(t *testing.T) {
+	t.Setenv("AI_SESSIONS_DIR", t.TempDir())
+	t.Setenv("AI_PROVIDER", "openai")
+
+	session, err := LoadSession("/dev/pts/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Messages) != 0 {
+		t.Fatalf("expected a new session to be empty, got %v", session.Messages)
+	}
+
+	first := completionFromJson(t, `{"choices": [{"message": {"tool_calls": [{"function": {"name": "printz", "arguments": "{\"command\": \"netstat -u\"}"}}]}}]}`)
+	session.Append("list all open udp ports", first)
+	if err := session.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later invocation in the same shell picks it back up
+	session, err = LoadSession("/dev/pts/3")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sentMessages []any
+	server := localServer(t, `{"choices": [{"message": {"content": "hi"}}]}`, func(body map[string]any) {
+		sentMessages, _ = body["messages"].([]any)
+	})
+
+	opts := AgentOptions{MaxSteps: 1, History: session.History()}
+	var outputBuffer bytes.Buffer
+	if _, err := RunPrimaryAgent(context.Background(), "gpt-4o", "now do it for tcp", "Linux", server.URL, opts, &outputBuffer); err != nil {
+		t.Fatal(err)
+	}
+
+	var contents []string
+	for _, message := range sentMessages {
+		content, _ := message.(map[string]any)["content"].(string)
+		contents = append(contents, content)
+	}
+	joined := strings.Join(contents, "\n")
+
+	earlier := strings.Index(joined, "Suggested command: netstat -u")
+	followUp := strings.Index(joined, "now do it for tcp")
+	if earlier == -1 || followUp == -1 || earlier > followUp {
+		t.Errorf("expected the earlier exchange ahead of the follow up, got messages: %q", contents)
+	}
+}
+
+func TestSession_ListExportClear(t *testing.T) {
+	t.Setenv("AI_SESSIONS_DIR", t.TempDir())
+
+	message := completionFromJson(t, `{"choices": [{"message": {"content": "There are 4 quarts in a gallon."}}]}`)
+	for _, key := range []string{"/dev/pts/1", "work"} {
+		session := &Session{Key: key}
+		session.Append("how many quarts in a gallon", message)
+		if err := session.Save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sessions, err := ListSessions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].Key != "work" {
+		t.Fatalf("expected both sessions, most recent first, got %v", sessions)
+	}
+
+	var exported bytes.Buffer
+	sessions[0].ExportMarkdown(&exported)
+	for _, want := range []string{"# ai session work", "## User\n\nhow many quarts in a gallon", "## Assistant\n\nThere are 4 quarts in a gallon."} {
+		if !strings.Contains(exported.String(), want) {
+			t.Errorf("export missing %q:\n%s", want, exported.String())
+		}
+	}
+
+	if err := ClearSession("/dev/pts/1"); err != nil {
+		t.Fatal(err)
+	}
+	if sessions, _ := ListSessions(); len(sessions) != 1 {
+		t.Errorf("expected one session left after clearing, got %d", len(sessions))
+	}
+}
+
+func TestSession_Limits(t *testing.T) {
+	t.Setenv("AI_SESSIONS_DIR", t.TempDir())
+
+	session, err := LoadSession("/dev/pts/4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// é is two bytes, so the limit falls in the middle of one
+	long := "a" + strings.Repeat("é", sessionMessageLimit)
+	answer := completionFromJson(t, `{"choices": [{"message": {"content": "ok"}}]}`)
+	for i := 0; i < sessionHistoryLimit; i++ {
+		session.Append(long, answer)
+	}
+	if err := session.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	session, err = LoadSession("/dev/pts/4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(session.Messages) != sessionHistoryLimit || session.Messages[0]["role"] != "user" {
+		t.Errorf("expected the saved session trimmed to its last %d messages, got %d", sessionHistoryLimit, len(session.Messages))
+	}
+
+	content, _ := session.Messages[0]["content"].(string)
+	if !utf8.ValidString(content) || !strings.HasSuffix(content, "é ...") || len(content) > sessionMessageLimit+len(" ...") {
+		t.Errorf("expected the message cut between characters, got %q", content[len(content)-10:])
+	}
+}
@@ -0,0 +1,53 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// The ai function for each shell, embedded and registered by main, since
+// the scripts live at the project root next to main.go
+var shellIntegrations = map[string]string{}
+
+func RegisterShellIntegration(shell string, script string) {
+	shellIntegrations[shell] = script
+}
+
+// The shells with an integration, sorted
+func shellNames() []string {
+	var names []string
+	for name := range shellIntegrations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Write shell's integration to w, followed by a _ai_bin that answers with
+// bin, so the functions run this very binary rather than building one
+func writeShellInit(w io.Writer, shell string, bin string) error {
+	script, ok := shellIntegrations[shell]
+	if !ok {
+		return classifyf(ErrUsage, "unknown shell %q, expected one of: %s", shell, strings.Join(shellNames(), ", "))
+	}
+
+	io.WriteString(w, script)
+
+	switch shell {
+	case "fish":
+		// Inside fish's single quotes, only \ and ' are escaped
+		quoted := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(bin)
+		fmt.Fprintf(w, "\nfunction _ai_bin\n  echo '%s'\nend\n", quoted)
+	default:
+		quoted := strings.ReplaceAll(bin, `'`, `'\''`)
+		fmt.Fprintf(w, "\nfunction _ai_bin() {\n  echo '%s'\n}\n", quoted)
+	}
+
+	return nil
+}
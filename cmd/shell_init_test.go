@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func useShellIntegrations(t *testing.T, integrations map[string]string) {
+	previous := shellIntegrations
+	shellIntegrations = integrations
+	t.Cleanup(func() { shellIntegrations = previous })
+}
+
+func TestShellInit(t *testing.T) {
+	useShellIntegrations(t, map[string]string{
+		"bash": "function ai() { \"$(_ai_bin)\" ask --shell bash -- \"$@\"; }\n",
+		"zsh":  "function ai() { print -rz -- \"$(_ai_bin)\"; }\n",
+		"fish": "function ai; _ai_bin; end\n",
+	})
+
+	bin := "/home/o'neil/ai functions/bin/ai-functions"
+
+	var output bytes.Buffer
+	if err := writeShellInit(&output, "bash", bin); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(output.String(), "function ai() {") {
+		t.Errorf("expected the bash integration first, got %q", output.String())
+	}
+
+	// The binary's path comes back out of the shell as is, odd characters and all
+	got, err := exec.Command("bash", "-c", output.String()+"_ai_bin").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(string(got)) != bin {
+		t.Errorf("expected _ai_bin to answer with %q, got %q", bin, got)
+	}
+
+	output.Reset()
+	writeShellInit(&output, "fish", `C:\o'neil`)
+	if !strings.Contains(output.String(), `function _ai_bin`+"\n"+`  echo 'C:\\o\'neil'`) {
+		t.Errorf("expected a fish function with the path escaped, got %q", output.String())
+	}
+
+	err = writeShellInit(&output, "tcsh", bin)
+	if errorClass(err) != ErrUsage || err.Error() != `unknown shell "tcsh", expected one of: bash, fish, zsh` {
+		t.Errorf("expected a usage error, got %s %v", errorClass(err), err)
+	}
+}
@@ -0,0 +1,356 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Callbacks for a streamed completion. Either may be nil.
+type StreamHandler struct {
+	// Called with each piece of message content as it arrives
+	OnContent func(text string)
+	// Called whenever more of a tool call's arguments arrive, with all of them so far
+	OnToolCall func(name string, argumentsSoFar string)
+}
+
+// Providers that can stream their completions implement this as well
+type StreamingProvider interface {
+	ChatCompletionStream(ctx context.Context, payload map[string]any, handler StreamHandler) (*OpenAICompletionResponse, error)
+}
+
+// Stream the completion if the provider can. Otherwise make a normal request
+// and hand the handler everything at once. Either way it gets the request
+// timeout, same as chatCompletion.
+func streamChatCompletion(ctx context.Context, provider Provider, payload map[string]any, handler StreamHandler) (*OpenAICompletionResponse, error) {
+	if streamingProvider, ok := provider.(StreamingProvider); ok {
+		return withTimeout(ctx, requestStage(provider), activeConfig.Timeouts.Request, func(ctx context.Context) (*OpenAICompletionResponse, error) {
+			return streamingProvider.ChatCompletionStream(ctx, payload, handler)
+		})
+	}
+
+	resp, err := chatCompletion(ctx, provider, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	// Content alongside a tool call is only a preamble to it
+	if content := getMessageContent(*resp); content != "" && len(getToolCalls(*resp)) == 0 && handler.OnContent != nil {
+		handler.OnContent(content)
+	}
+	if name := getToolcallFunctionName(*resp); name != "message" && handler.OnToolCall != nil {
+		handler.OnToolCall(name, getToolcallArguments(*resp))
+	}
+
+	return resp, nil
+}
+
+// Copy payload with streaming turned on
+func streamingPayload(payload map[string]any, includeUsage bool) map[string]any {
+	streaming := map[string]any{}
+	for key, value := range payload {
+		streaming[key] = value
+	}
+
+	streaming["stream"] = true
+	if includeUsage {
+		streaming["stream_options"] = map[string]any{"include_usage": true}
+	}
+
+	return streaming
+}
+
+// Read server sent events off of r, calling onData with each event's data
+func readSSE(r io.Reader, onData func(data string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 10*1024*1024)
+
+	var data []string
+	dispatch := func() error {
+		if len(data) == 0 {
+			return nil
+		}
+		event := strings.Join(data, "\n")
+		data = nil
+		return onData(event)
+	}
+
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		switch {
+		case line == "":
+			if err := dispatch(); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, ":"):
+			// comment, used as a keepalive
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return networkError(err)
+	}
+
+	return dispatch()
+}
+
+// One chunk of an openai style streamed completion
+type completionChunk struct {
+	Error   *OpenAIError `json:"error"`
+	Model   string       `json:"model"`
+	Choices []struct {
+		Index        int     `json:"index"`
+		FinishReason *string `json:"finish_reason"`
+		Delta        struct {
+			Content   *string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				Id       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
+		} `json:"delta"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+// Read an openai style streamed completion off of body, reporting progress to
+// handler, and rebuild it into a regular response. Tool call arguments arrive
+// in pieces and are stitched back together by index.
+func readCompletionStream(body io.Reader, handler StreamHandler) (*OpenAICompletionResponse, error) {
+	reader := bufio.NewReader(body)
+
+	// Errors aren't streamed, they come back as a plain json body
+	if start, _ := reader.Peek(1); bytes.Equal(bytes.TrimSpace(start), []byte("{")) {
+		var obj OpenAICompletionResponse
+		raw, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, networkError(err)
+		}
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return nil, err
+		}
+		return &obj, nil
+	}
+
+	var completion translatedCompletion
+	var content strings.Builder
+	toolCalls := map[int]*translatedToolCall{}
+
+	err := readSSE(reader, func(data string) error {
+		if data == "[DONE]" {
+			return nil
+		}
+
+		var chunk completionChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("unexpected event in stream: %s", data)
+		}
+
+		if chunk.Error != nil {
+			completion.ErrorMessage = chunk.Error.fullMessage()
+			completion.ErrorType = chunk.Error.Type
+			return nil
+		}
+
+		if chunk.Model != "" {
+			completion.Model = chunk.Model
+		}
+
+		if chunk.Usage != nil {
+			completion.PromptTokens = chunk.Usage.PromptTokens
+			completion.CompletionTokens = chunk.Usage.CompletionTokens
+		}
+
+		for _, choice := range chunk.Choices {
+			if choice.Index != 0 {
+				continue
+			}
+
+			if choice.FinishReason != nil {
+				completion.FinishReason = *choice.FinishReason
+			}
+
+			if delta := choice.Delta.Content; delta != nil && *delta != "" {
+				content.WriteString(*delta)
+				if handler.OnContent != nil {
+					handler.OnContent(*delta)
+				}
+			}
+
+			for _, delta := range choice.Delta.ToolCalls {
+				toolCall, ok := toolCalls[delta.Index]
+				if !ok {
+					toolCall = &translatedToolCall{}
+					toolCalls[delta.Index] = toolCall
+				}
+
+				if delta.Id != "" {
+					toolCall.Id = delta.Id
+				}
+				toolCall.Name += delta.Function.Name
+				toolCall.Arguments += delta.Function.Arguments
+
+				if handler.OnToolCall != nil {
+					handler.OnToolCall(toolCall.Name, toolCall.Arguments)
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	completion.Content = content.String()
+
+	var indices []int
+	for index := range toolCalls {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	for _, index := range indices {
+		completion.ToolCalls = append(completion.ToolCalls, *toolCalls[index])
+	}
+
+	return completion.toOpenAI()
+}
+
+// Decode as much of a string field as has arrived in some partial json, ex
+// partialJSONString(`{"str": "The first head`, "str") is "The first head".
+func partialJSONString(partial string, field string) string {
+	keyIndex := strings.Index(partial, `"`+field+`"`)
+	if keyIndex == -1 {
+		return ""
+	}
+
+	rest := strings.TrimLeft(partial[keyIndex+len(field)+2:], " \t\r\n")
+	if !strings.HasPrefix(rest, ":") {
+		return ""
+	}
+	rest = strings.TrimLeft(rest[1:], " \t\r\n")
+	if !strings.HasPrefix(rest, `"`) {
+		return ""
+	}
+	rest = rest[1:]
+
+	// Walk to the closing quote, or to the end of what's arrived so far,
+	// leaving off anything that's been cut in half: an escape sequence, the
+	// first half of a surrogate pair, or part of a multi byte character.
+	end := len(rest)
+	closed := false
+	lastEscape := -1
+	for i := 0; i < len(rest); i++ {
+		if rest[i] == '"' {
+			end = i
+			closed = true
+			break
+		}
+		if rest[i] == '\\' {
+			length := 2
+			if i+1 < len(rest) && rest[i+1] == 'u' {
+				length = 6
+			}
+			if i+length > len(rest) {
+				end = i
+				break
+			}
+			lastEscape = i
+			i += length - 1
+		}
+	}
+
+	if !closed {
+		if lastEscape != -1 && lastEscape+6 == end && isHighSurrogateEscape(rest[lastEscape:end]) {
+			end = lastEscape
+		}
+		for end > 0 && !utf8.ValidString(rest[:end]) {
+			end--
+		}
+	}
+
+	var decoded string
+	if err := json.Unmarshal([]byte(`"`+rest[:end]+`"`), &decoded); err != nil {
+		return ""
+	}
+
+	return decoded
+}
+
+// Whether escape, ex \ud83d, is the first half of a utf-16 surrogate pair
+func isHighSurrogateEscape(escape string) bool {
+	if len(escape) != 6 || escape[1] != 'u' {
+		return false
+	}
+	var r rune
+	if _, err := fmt.Sscanf(escape[2:], "%04x", &r); err != nil {
+		return false
+	}
+	return r >= 0xD800 && r <= 0xDBFF
+}
+
+// Writes a response's content as it arrives, until a tool call starts. Content
+// ahead of a tool call is only the preamble to it, so the rest is dropped once
+// one does, and onStop is called if any was written, to set it apart from
+// whatever's written of the call.
+type contentGate struct {
+	write   func(text string)
+	onStop  func()
+	written bool
+	stopped bool
+}
+
+func (g *contentGate) content(text string) {
+	if g.stopped {
+		return
+	}
+	g.written = true
+	g.write(text)
+}
+
+func (g *contentGate) toolCall() {
+	if !g.stopped && g.written && g.onStop != nil {
+		g.onStop()
+	}
+	g.stopped = true
+}
+
+// Whether content was written and no tool call followed it
+func (g *contentGate) answered() bool {
+	return g.written && !g.stopped
+}
+
+// Wraps a field of a tool call's arguments so that only the newly arrived
+// part of it is written to w each time more arguments come in
+func toolCallFieldWriter(w io.Writer, toolName string, field string, written *int) func(name string, argumentsSoFar string) {
+	return func(name string, argumentsSoFar string) {
+		if name != toolName {
+			return
+		}
+
+		value := partialJSONString(argumentsSoFar, field)
+		if len(value) > *written {
+			fmt.Fprint(w, value[*written:])
+			*written = len(value)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Serves each event as its own flushed chunk, like the real thing
+func sseServer(t *testing.T, events []string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		for _, event := range events {
+			w.Write([]byte("data: " + event + "\n\n"))
+			w.(http.Flusher).Flush()
+		}
+		w.Write([]byte("data: [DONE]\n\n"))
+	}))
+
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Records each write separately, so tests can see what arrived when
+type writeRecorder struct {
+	writes []string
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, string(p))
+	return len(p), nil
+}
+
+func TestReadSSE(t *testing.T) {
+	stream := ": keepalive\n\ndata: one\n\ndata: two\ndata: lines\n\nevent: ignored\ndata: three"
+
+	var events []string
+	err := readSSE(strings.NewReader(stream), func(data string) error {
+		events = append(events, data)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(events) != 3 || events[0] != "one" || events[1] != "two\nlines" || events[2] != "three" {
+		t.Errorf("unexpected events: %q", events)
+	}
+}
+
+func TestPartialJSONString(t *testing.T) {
+	cases := map[string]string{
+		`{"st`:                         "",
+		`{"str": "The first head`:      "The first head",
+		`{"str":"line one\nline two"}`: "line one\nline two",
+		`{"str": "quote \`:             "quote ",
+		`{"str": "emoji é\u26`:         "emoji é",
+		`{"str": "pair \ud83d`:         "pair ",
+		`{"str": "pair 😀`:              "pair 😀",
+		"{\"str\": \"caf\xc3":          "caf",
+	}
+
+	for partial, want := range cases {
+		if got := partialJSONString(partial, "str"); got != want {
+			t.Errorf("partialJSONString(%q) = %q, want %q", partial, got, want)
+		}
+	}
+}
+
+func TestStreamPrimaryRequest_Message(t *testing.T) {
+	server := sseServer(t, []string{
+		`{"model": "gpt-4o", "choices": [{"index": 0, "delta": {"role": "assistant", "content": ""}}]}`,
+		`{"choices": [{"index": 0, "delta": {"content": "There are "}}]}`,
+		`{"choices": [{"index": 0, "delta": {"content": "4 quarts."}}]}`,
+		`{"choices": [{"index": 0, "delta": {}, "finish_reason": "stop"}]}`,
+		`{"choices": [], "usage": {"prompt_tokens": 400, "completion_tokens": 5}}`,
+	})
+	t.Setenv("AI_PROVIDER", "openai")
+
+	var recorder writeRecorder
+	resp, err := StreamPrimaryRequest(context.Background(), "gpt-4o", "how many quarts in a gallon", "Linux", server.URL, &recorder)
+	if err != nil {
+		t.Fatal("streaming primary request errored:", err)
+	}
+
+	if output := strings.Join(recorder.writes, ""); output != "message There are 4 quarts.\n" {
+		t.Errorf("unexpected output: %q", output)
+	}
+	if len(recorder.writes) < 3 {
+		t.Errorf("expected the message to arrive in pieces, got: %q", recorder.writes)
+	}
+	if resp.Usage.PromptTokens != 400 || resp.Usage.CompletionTokens != 5 {
+		t.Errorf("usage was not carried over from the stream: %+v", resp.Usage)
+	}
+}
+
+func TestStreamPrimaryRequest_ToolCall(t *testing.T) {
+	server := sseServer(t, []string{
+		`{"choices": [{"index": 0, "delta": {"role": "assistant", "tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "printz", "arguments": ""}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "{\"command\": \"netst"}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "at -u\"}"}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {}, "finish_reason": "tool_calls"}]}`,
+	})
+	t.Setenv("AI_PROVIDER", "openai")
+
+	var recorder writeRecorder
+	if _, err := StreamPrimaryRequest(context.Background(), "gpt-4o", "list all open udp ports", "Linux", server.URL, &recorder); err != nil {
+		t.Fatal("streaming primary request errored:", err)
+	}
+
+	// printz is only useful to the shell whole, so it must come in one write
+	if len(recorder.writes) != 1 || recorder.writes[0] != "printz netstat -u\n" {
+		t.Errorf("unexpected writes: %q", recorder.writes)
+	}
+}
+
+func TestStreamPrimaryRequest_ContentBeforeToolCall(t *testing.T) {
+	server := sseServer(t, []string{
+		`{"choices": [{"index": 0, "delta": {"role": "assistant", "content": "Here's how to "}}]}`,
+		`{"choices": [{"index": 0, "delta": {"content": "list them:"}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "printz", "arguments": "{\"command\": \"netstat -u\"}"}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {}, "finish_reason": "tool_calls"}]}`,
+	})
+	t.Setenv("AI_PROVIDER", "openai")
+
+	var recorder writeRecorder
+	if _, err := StreamPrimaryRequest(context.Background(), "gpt-4o", "list all open udp ports", "Linux", server.URL, &recorder); err != nil {
+		t.Fatal("streaming primary request errored:", err)
+	}
+
+	// The preamble's been written by the time the call starts, so it's ended
+	// there, and the printz line still comes whole
+	if output := strings.Join(recorder.writes, ""); output != "message Here's how to list them:\nprintz netstat -u\n" {
+		t.Errorf("expected the preamble, then the printz line, got %q", output)
+	}
+	if last := recorder.writes[len(recorder.writes)-1]; last != "printz netstat -u\n" {
+		t.Errorf("expected printz in one write, got %q", last)
+	}
+}
+
+func TestStreamPrimaryRequest_Info(t *testing.T) {
+	server := sseServer(t, []string{
+		`{"choices": [{"index": 0, "delta": {"role": "assistant", "tool_calls": [{"index": 0, "id": "call_1", "type": "function", "function": {"name": "info", "arguments": ""}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "{\"str\": \"There are "}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 0, "function": {"arguments": "4 quarts.\"}"}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {"tool_calls": [{"index": 1, "id": "call_2", "type": "function", "function": {"name": "info", "arguments": "{\"str\": \"Also\"}"}}]}}]}`,
+		`{"choices": [{"index": 0, "delta": {}, "finish_reason": "tool_calls"}]}`,
+	})
+	t.Setenv("AI_PROVIDER", "openai")
+
+	var recorder writeRecorder
+	if _, err := StreamPrimaryRequest(context.Background(), "gpt-4o", "how many quarts in a gallon", "Linux", server.URL, &recorder); err != nil {
+		t.Fatal("streaming primary request errored:", err)
+	}
+
+	if output := strings.Join(recorder.writes, ""); output != "info There are 4 quarts.\n" {
+		t.Errorf("expected the first call's text alone, got %q", output)
+	}
+	if len(recorder.writes) < 3 {
+		t.Errorf("expected the text to arrive in pieces, got: %q", recorder.writes)
+	}
+}
+
+func TestStreamPrimaryRequest_Error(t *testing.T) {
+	server := localServer(t, `{"error": {"message": "The model `+"`furby`"+` does not exist"}}`, nil)
+	t.Setenv("AI_PROVIDER", "openai")
+
+	var outputBuffer bytes.Buffer
+	_, err := StreamPrimaryRequest(context.Background(), "furby", "hi", "Linux", server.URL, &outputBuffer)
+	if errorClass(err) != ErrAPI {
+		t.Errorf("expected the api error back, got %v", err)
+	}
+
+	if !strings.HasPrefix(outputBuffer.String(), "error api The model") {
+		t.Errorf("unexpected output: %q", outputBuffer.String())
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"time"
+)
+
+// Seconds each stage gets before it's given up on, 0 for no limit
+type TimeoutConfig struct {
+	// Each call to the model, retries included
+	Request int `mapstructure:"request" yaml:"request"`
+	// Each web page fetched, redirects included
+	Page int `mapstructure:"page" yaml:"page"`
+	// Generating images
+	Image int `mapstructure:"image" yaml:"image"`
+	// All of crawl_web, from fetching the first page to the answer
+	Crawl int `mapstructure:"crawl" yaml:"crawl"`
+}
+
+// Run the stage called what with seconds to finish in. Running out of time is
+// an ErrTimeout saying which stage it was. Being cancelled from above isn't.
+func withTimeout[T any](ctx context.Context, what string, seconds int, run func(ctx context.Context) (T, error)) (T, error) {
+	if seconds <= 0 {
+		return run(ctx)
+	}
+
+	stageCtx, cancel := context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
+	defer cancel()
+
+	result, err := run(stageCtx)
+	if err != nil && ctx.Err() == nil && stageCtx.Err() == context.DeadlineExceeded {
+		return result, classifyf(ErrTimeout, "%s timed out after %ds", what, seconds)
+	}
+	return result, err
+}
+
+// Sleep for d, or until ctx is done, whichever is first
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		if err := ctx.Err(); err != nil {
+			return networkError(err)
+		}
+		return nil
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return networkError(ctx.Err())
+	}
+}
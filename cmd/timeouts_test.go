@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A server that never answers, until the request is given up on
+func hangingServer(t *testing.T) string {
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		// Closing the connection is only noticed once the body's been read
+		io.ReadAll(r.Body)
+		<-r.Context().Done()
+	})
+	return server.URL
+}
+
+func useTimeouts(t *testing.T, timeouts TimeoutConfig) {
+	previous := activeConfig
+	activeConfig.Timeouts = timeouts
+	activeConfig.MaxRetries = 0
+	t.Cleanup(func() { activeConfig = previous })
+}
+
+func TestTimeouts_Request(t *testing.T) {
+	useTimeouts(t, TimeoutConfig{Request: 1})
+
+	start := time.Now()
+	_, err := PerformPrimaryRequest(context.Background(), "gpt-4o", "list files", "Linux", hangingServer(t))
+	if errorClass(err) != ErrTimeout || err.Error() != "the request to openai timed out after 1s" {
+		t.Errorf("expected the request to time out, got %s %v", errorClass(err), err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected to give up after a second, took %s", elapsed)
+	}
+}
+
+func TestTimeouts_Page(t *testing.T) {
+	useTimeouts(t, TimeoutConfig{Page: 1})
+
+	url := hangingServer(t) + "/slow"
+	_, err := fetchWebPage(context.Background(), url)
+	if errorClass(err) != ErrTimeout || err.Error() != "fetching "+url+" timed out after 1s" {
+		t.Errorf("expected the page to time out, got %s %v", errorClass(err), err)
+	}
+}
+
+func TestTimeouts_Interrupted(t *testing.T) {
+	useTimeouts(t, TimeoutConfig{Request: 60, Crawl: 60})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	// Cancelling isn't a timeout, even with one running
+	_, err := PerformPrimaryRequest(ctx, "gpt-4o", "list files", "Linux", hangingServer(t))
+	if errorClass(err) != ErrInterrupted || exitCode(err) != 130 {
+		t.Errorf("expected the request to be interrupted, got %s %v", errorClass(err), err)
+	}
+
+	// Nothing more is started once cancelled
+	err = RunTool(ctx, "crawl_web", `{"url": "https://example.com", "purpose": "news"}`, &bytes.Buffer{})
+	if errorClass(err) != ErrInterrupted {
+		t.Errorf("expected the crawl to be interrupted, got %s %v", errorClass(err), err)
+	}
+
+	if err := sleepContext(ctx, time.Hour); errorClass(err) != ErrInterrupted {
+		t.Errorf("expected the sleep to be cut short, got %v", err)
+	}
+}
+
+func TestTimeouts_PluginKilled(t *testing.T) {
+	dir := t.TempDir()
+	marker := filepath.Join(dir, "finished")
+	slow := filepath.Join(dir, "ai-tool-slow")
+	writePlugin(t, dir, "ai-tool-slow", "#!/bin/sh\nsleep 1\ntouch "+marker+"\n", 0755)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	_, err := runPlugin(ctx, slow, nil, nil, time.Minute)
+	if errorClass(err) != ErrInterrupted {
+		t.Errorf("expected the plugin to be interrupted, got %s %v", errorClass(err), err)
+	}
+
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("expected the plugin to be killed, but it kept running")
+	}
+}
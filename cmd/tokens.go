@@ -0,0 +1,276 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/pkoukk/tiktoken-go"
+)
+
+// Counts text the way a model family does
+type Tokenizer interface {
+	Count(text string) int
+	// Split text after its first maxTokens tokens
+	Cut(text string, maxTokens int) (head string, rest string)
+}
+
+// Context windows by model name prefix, the longest matching prefix winning.
+// Anything else is assumed to be a small local model.
+var contextWindows = map[string]int{
+	"gpt-5":          400000,
+	"gpt-4.1":        1047576,
+	"gpt-4.5":        128000,
+	"gpt-4o":         128000,
+	"chatgpt-4o":     128000,
+	"gpt-4-turbo":    128000,
+	"gpt-4-32k":      32768,
+	"gpt-4":          8192,
+	"gpt-3.5-turbo":  16385,
+	"o1":             200000,
+	"o3":             200000,
+	"o4":             200000,
+	"claude":         200000,
+	"gemini-1.5-pro": 2097152,
+	"gemini":         1048576,
+	"llama3.1":       128000,
+	"llama3.2":       128000,
+	"llama3.3":       128000,
+	"llama-3.1":      128000,
+	"llama-3.2":      128000,
+	"llama-3.3":      128000,
+	"mistral-large":  128000,
+	"qwen2.5":        32768,
+	"deepseek":       128000,
+}
+
+const defaultContextWindow = 8192
+
+// The BPE tables of OpenAI's model families, by model name prefix
+var bpeEncodings = map[string]string{
+	"gpt-5":         tiktoken.MODEL_O200K_BASE,
+	"gpt-4.1":       tiktoken.MODEL_O200K_BASE,
+	"gpt-4.5":       tiktoken.MODEL_O200K_BASE,
+	"gpt-4o":        tiktoken.MODEL_O200K_BASE,
+	"chatgpt-4o":    tiktoken.MODEL_O200K_BASE,
+	"o1":            tiktoken.MODEL_O200K_BASE,
+	"o3":            tiktoken.MODEL_O200K_BASE,
+	"o4":            tiktoken.MODEL_O200K_BASE,
+	"gpt-4":         tiktoken.MODEL_CL100K_BASE,
+	"gpt-3.5-turbo": tiktoken.MODEL_CL100K_BASE,
+}
+
+// Characters a token for the families whose tables aren't public, measured on
+// English prose and code. Anything else gets 4.
+var charsPerToken = map[string]float64{
+	"claude":  3.5,
+	"gemini":  4,
+	"llama":   3.8,
+	"mistral": 3.5,
+	"qwen":    3.7,
+	"gemma":   4,
+}
+
+// The value in table for the longest prefix of model, ignoring any
+// "provider/" in front of it
+func modelLookup[V any](table map[string]V, model string) (V, bool) {
+	model = strings.ToLower(model)
+	if _, name, ok := strings.Cut(model, "/"); ok && !strings.Contains(name, "/") {
+		model = name
+	}
+
+	var found V
+	longest := -1
+	for prefix, value := range table {
+		if strings.HasPrefix(model, prefix) && len(prefix) > longest {
+			found = value
+			longest = len(prefix)
+		}
+	}
+	return found, longest >= 0
+}
+
+// How many tokens model can take in and put out in one request
+func contextWindow(model string) int {
+	if activeConfig.ContextWindow > 0 {
+		return activeConfig.ContextWindow
+	}
+	if window, ok := modelLookup(contextWindows, model); ok {
+		return window
+	}
+	return defaultContextWindow
+}
+
+var (
+	tokenizersMu sync.Mutex
+	tokenizers   = map[string]Tokenizer{}
+)
+
+// The tokenizer for model's family. OpenAI's families use their BPE tables
+// when they're in tokenizer_dir, and like every other family are estimated
+// from the length of the text when they aren't.
+func tokenizerFor(model string) Tokenizer {
+	if encoding, ok := modelLookup(bpeEncodings, model); ok {
+		if tokenizer := bpeTokenizerFor(encoding); tokenizer != nil {
+			return tokenizer
+		}
+	}
+
+	if chars, ok := modelLookup(charsPerToken, model); ok {
+		return estimateTokenizer{charsPerToken: chars}
+	}
+	return estimateTokenizer{charsPerToken: 4}
+}
+
+// The tokenizer for a BPE table, nil if the table can't be loaded. Loading
+// is tried once per table per run. A table missing from a tokenizer_dir that
+// was set is said so then, since it was meant to be there. Without one the
+// tables are optional, and estimating is nothing to warn about every call.
+func bpeTokenizerFor(encoding string) Tokenizer {
+	tokenizersMu.Lock()
+	defer tokenizersMu.Unlock()
+
+	if tokenizer, ok := tokenizers[encoding]; ok {
+		return tokenizer
+	}
+
+	var tokenizer Tokenizer
+	dir := tokenizerDir()
+	tiktoken.SetBpeLoader(localBpeLoader{dir: dir})
+	if encoder, err := tiktoken.GetEncoding(encoding); err == nil {
+		tokenizer = bpeTokenizer{encoder: encoder}
+	} else if activeConfig.TokenizerDir != "" {
+		fmt.Fprintf(os.Stderr, "ai: unable to load %s.tiktoken from %s, so tokens are estimated. See tokenizer_dir in the README to add it.\n", encoding, dir)
+	}
+
+	tokenizers[encoding] = tokenizer
+	return tokenizer
+}
+
+// Where the BPE tables are looked for, ex o200k_base.tiktoken
+func tokenizerDir() string {
+	if activeConfig.TokenizerDir != "" {
+		return activeConfig.TokenizerDir
+	}
+	return filepath.Join(filepath.Dir(defaultConfigPath()), "tokenizers")
+}
+
+// Reads BPE tables out of a directory, rather than downloading them
+type localBpeLoader struct {
+	dir string
+}
+
+func (l localBpeLoader) LoadTiktokenBpe(tableUrl string) (map[string]int, error) {
+	tablePath := filepath.Join(l.dir, path.Base(tableUrl))
+	if _, err := os.Stat(tablePath); err != nil {
+		return nil, err
+	}
+	return tiktoken.NewDefaultBpeLoader().LoadTiktokenBpe(tablePath)
+}
+
+type bpeTokenizer struct {
+	encoder *tiktoken.Tiktoken
+}
+
+func (t bpeTokenizer) Count(text string) int {
+	return len(t.encoder.EncodeOrdinary(text))
+}
+
+func (t bpeTokenizer) Cut(text string, maxTokens int) (string, string) {
+	tokens := t.encoder.EncodeOrdinary(text)
+	if len(tokens) <= maxTokens {
+		return text, ""
+	}
+
+	// Tokens are runs of bytes, so the head's bytes are the text's first ones
+	end := len(t.encoder.Decode(tokens[:maxTokens]))
+	for end > 0 && end < len(text) && !utf8.RuneStart(text[end]) {
+		end--
+	}
+	return text[:end], text[end:]
+}
+
+type estimateTokenizer struct {
+	charsPerToken float64
+}
+
+func (t estimateTokenizer) Count(text string) int {
+	return int(math.Ceil(float64(utf8.RuneCountInString(text)) / t.charsPerToken))
+}
+
+func (t estimateTokenizer) Cut(text string, maxTokens int) (string, string) {
+	maxRunes := int(float64(maxTokens) * t.charsPerToken)
+	runes := 0
+	for i := range text {
+		if runes == maxRunes {
+			return text[:i], text[i:]
+		}
+		runes++
+	}
+	return text, ""
+}
+
+// Tokens in text for model
+func countTokens(model string, text string) int {
+	return tokenizerFor(model).Count(text)
+}
+
+// The tokens a request's messages and tools will take up, roughly as the
+// provider counts them
+func requestTokens(model string, request map[string]any) int {
+	tokenizer := tokenizerFor(model)
+
+	// Each message costs a few tokens on top of its content
+	const perMessage = 4
+	total := 0
+
+	messages, _ := request["messages"].([]map[string]any)
+	for _, message := range messages {
+		total += perMessage
+		if content, ok := message["content"].(string); ok && len(message) <= 2 {
+			total += tokenizer.Count(content)
+			continue
+		}
+		marshalled, _ := json.Marshal(message)
+		total += tokenizer.Count(string(marshalled))
+	}
+
+	if tools, ok := request["tools"]; ok {
+		marshalled, _ := json.Marshal(tools)
+		total += tokenizer.Count(string(marshalled))
+	}
+
+	return total
+}
+
+// Tokens left in model's context window once used are spoken for, along with
+// max_tokens for the reply
+func tokensLeft(model string, used int) int {
+	return max(contextWindow(model)-activeConfig.MaxTokens-used, 0)
+}
+
+// Cut text down to maxTokens, saying how much was cut so that the model knows
+// it isn't seeing everything
+func truncateTokens(model string, text string, maxTokens int) string {
+	tokenizer := tokenizerFor(model)
+
+	total := tokenizer.Count(text)
+	if total <= maxTokens {
+		return text
+	}
+
+	// Room for the marker itself
+	keep := max(maxTokens-10, 0)
+	head, _ := tokenizer.Cut(text, keep)
+	return fmt.Sprintf("%s\n\n[truncated %d tokens]", head, total-tokenizer.Count(head))
+}
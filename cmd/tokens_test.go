@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Point the tokenizers at dir, forgetting any already loaded
+func useTokenizerDir(t *testing.T, dir string) {
+	previous := activeConfig
+	activeConfig.TokenizerDir = dir
+	tokenizersMu.Lock()
+	tokenizers = map[string]Tokenizer{}
+	tokenizersMu.Unlock()
+
+	t.Cleanup(func() {
+		activeConfig = previous
+		tokenizersMu.Lock()
+		tokenizers = map[string]Tokenizer{}
+		tokenizersMu.Unlock()
+	})
+}
+
+// What run writes to stderr
+func captureStderr(t *testing.T, run func()) string {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := os.Stderr
+	os.Stderr = writer
+	run()
+	os.Stderr = previous
+	writer.Close()
+
+	output, _ := io.ReadAll(reader)
+	return string(output)
+}
+
+// A tiny stand in for cl100k_base: every byte, plus "he" and "ll"
+func writeBpeTable(t *testing.T, dir string) {
+	var table strings.Builder
+	for b := 0; b < 256; b++ {
+		fmt.Fprintf(&table, "%s %d\n", base64.StdEncoding.EncodeToString([]byte{byte(b)}), b)
+	}
+	fmt.Fprintf(&table, "%s 256\n", base64.StdEncoding.EncodeToString([]byte("he")))
+	fmt.Fprintf(&table, "%s 257\n", base64.StdEncoding.EncodeToString([]byte("ll")))
+
+	if err := os.WriteFile(filepath.Join(dir, "cl100k_base.tiktoken"), []byte(table.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContextWindow(t *testing.T) {
+	for model, want := range map[string]int{
+		"gpt-4o-mini":               128000,
+		"gpt-4":                     8192,
+		"gpt-4-turbo-preview":       128000,
+		"gpt-4.1-mini":              1047576,
+		"claude-3-5-sonnet-latest":  200000,
+		"models/gemini-1.5-pro":     2097152,
+		"meta-llama/Llama-3.1-8B":   128000,
+		"some-local-model":          defaultContextWindow,
+		"openai/gpt-3.5-turbo-0125": 16385,
+	} {
+		if got := contextWindow(model); got != want {
+			t.Errorf("%s: expected %d, got %d", model, want, got)
+		}
+	}
+
+	previous := activeConfig
+	activeConfig.ContextWindow = 4096
+	t.Cleanup(func() { activeConfig = previous })
+
+	if got := contextWindow("gpt-4o"); got != 4096 {
+		t.Errorf("expected context_window to win, got %d", got)
+	}
+}
+
+func TestTokenizer_BPE(t *testing.T) {
+	dir := t.TempDir()
+	writeBpeTable(t, dir)
+	useTokenizerDir(t, dir)
+
+	tokenizer := tokenizerFor("gpt-4-0613")
+	if _, ok := tokenizer.(bpeTokenizer); !ok {
+		t.Fatalf("expected the BPE table to be used, got %T", tokenizer)
+	}
+
+	if got := tokenizer.Count("hello"); got != 3 {
+		t.Errorf("expected he, ll and o, got %d tokens", got)
+	}
+
+	head, rest := tokenizer.Cut("hello café", 2)
+	if head != "hell" || rest != "o café" {
+		t.Errorf("unexpected cut %q %q", head, rest)
+	}
+
+	// é is two bytes, and two tokens here, so cutting between them backs up
+	head, rest = tokenizer.Cut("hello café", 8)
+	if head != "hello caf" || rest != "é" {
+		t.Errorf("expected the cut not to split a character, got %q %q", head, rest)
+	}
+}
+
+func TestTokenizer_MissingTableEstimates(t *testing.T) {
+	useTokenizerDir(t, t.TempDir())
+
+	stderr := captureStderr(t, func() {
+		tokenizerFor("gpt-4o")
+		tokenizerFor("gpt-4o-mini")
+	})
+	if strings.Count(stderr, "o200k_base.tiktoken") != 1 {
+		t.Errorf("expected to be told once that the table is missing, got %q", stderr)
+	}
+
+	tokenizer := tokenizerFor("gpt-4o")
+	if _, ok := tokenizer.(estimateTokenizer); !ok {
+		t.Fatalf("expected an estimate without the table, got %T", tokenizer)
+	}
+
+	// The default dir is optional, so its tables going missing isn't news
+	useTokenizerDir(t, "")
+	stderr = captureStderr(t, func() {
+		tokenizerFor("gpt-4o")
+	})
+	if stderr != "" {
+		t.Errorf("expected nothing said without a tokenizer_dir set, got %q", stderr)
+	}
+
+	if got := tokenizerFor("claude-3-haiku").Count(strings.Repeat("a", 35)); got != 10 {
+		t.Errorf("expected claude's 3.5 characters a token, got %d", got)
+	}
+}
+
+func TestTruncateTokens(t *testing.T) {
+	text := strings.Repeat("word ", 200)
+
+	if got := truncateTokens("claude-3-haiku", text, 1000); got != text {
+		t.Error("expected text that fits to be left alone")
+	}
+
+	truncated := truncateTokens("claude-3-haiku", text, 50)
+	if !strings.HasSuffix(truncated, "[truncated 246 tokens]") {
+		t.Errorf("expected a marker saying what was cut, got %q", truncated)
+	}
+	if countTokens("claude-3-haiku", truncated) > 50 {
+		t.Errorf("expected at most 50 tokens, got %d", countTokens("claude-3-haiku", truncated))
+	}
+}
+
+func TestPrimaryPrompt_TrimsContextToWindow(t *testing.T) {
+	useTokenizerDir(t, t.TempDir())
+	activeConfig.ContextWindow = 2000
+
+	prompt := buildPrimaryPrompt(withContext("what went wrong?", strings.Repeat("a log line\n", 2000)), "gpt-4o", "Linux", nil)
+
+	content := promptContent(prompt, "what went wrong?")
+	if !strings.HasPrefix(content, "what went wrong?"+contextHeading+"a log line") {
+		t.Errorf("expected the question and the start of the context, got %q", content)
+	}
+	if !strings.Contains(content, "[truncated") {
+		t.Errorf("expected a truncated marker, got %q", content)
+	}
+
+	if used := requestTokens("gpt-4o", prompt); used > 2000-activeConfig.MaxTokens {
+		t.Errorf("expected the request to leave room for the reply, it takes %d tokens", used)
+	}
+
+	small := buildPrimaryPrompt(withContext("what went wrong?", "one log line"), "gpt-4o", "Linux", nil)
+	if content := promptContent(small, "what went wrong?"); content != "what went wrong?"+contextHeading+"one log line" {
+		t.Errorf("expected context that fits to be left alone, got %q", content)
+	}
+}
+
+// The content of the message that starts with prefix
+func promptContent(prompt map[string]any, prefix string) string {
+	for _, message := range prompt["messages"].([]map[string]any) {
+		if content, ok := message["content"].(string); ok && strings.HasPrefix(content, prefix) {
+			return content
+		}
+	}
+	return ""
+}
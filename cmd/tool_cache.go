@@ -0,0 +1,137 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// How long an mcp server's tools are trusted before it's asked again. Unlike
+// a plugin, there's no file to tell whether it's changed.
+const mcpToolCacheTTL = time.Hour
+
+// What plugins and mcp servers said their tools were, so that they needn't
+// all be run on every call just to build the prompt
+type toolCache struct {
+	Plugins    map[string]cachedManifest `json:"plugins"`
+	MCPServers map[string]cachedMCPTools `json:"mcp_servers"`
+}
+
+// A plugin's manifest, good for as long as the executable is unchanged
+type cachedManifest struct {
+	ModTime  time.Time      `json:"mod_time"`
+	Size     int64          `json:"size"`
+	Manifest pluginManifest `json:"manifest"`
+}
+
+// A server's tools, good for as long as its config is unchanged, up to
+// mcpToolCacheTTL
+type cachedMCPTools struct {
+	// A hash of the server's config, which can hold secrets in its env
+	Server string        `json:"server"`
+	Listed time.Time     `json:"listed"`
+	Tools  []mcpToolInfo `json:"tools"`
+}
+
+// What the last discovery found, read from disk, and what this one has. Only
+// what's found this time is saved, so removed plugins and servers drop out.
+var previousToolCache, currentToolCache = newToolCache(), newToolCache()
+
+// Where the cache lives, under $XDG_CACHE_HOME
+func toolCachePath() string {
+	cacheHome := os.Getenv("XDG_CACHE_HOME")
+	if cacheHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		cacheHome = filepath.Join(home, ".cache")
+	}
+
+	return filepath.Join(cacheHome, "ai-functions", "tools.json")
+}
+
+func newToolCache() *toolCache {
+	return &toolCache{Plugins: map[string]cachedManifest{}, MCPServers: map[string]cachedMCPTools{}}
+}
+
+// Read the cache ahead of discovery. A missing or unreadable one is as good
+// as empty.
+func startToolCache() {
+	previousToolCache = newToolCache()
+	currentToolCache = newToolCache()
+
+	if data, err := os.ReadFile(toolCachePath()); err == nil {
+		json.Unmarshal(data, previousToolCache)
+	}
+}
+
+// Write what discovery found. Failing to is no reason to fail the call.
+func saveToolCache() {
+	path := toolCachePath()
+	if path == "" {
+		return
+	}
+
+	data, err := json.MarshalIndent(currentToolCache, "", "  ")
+	if err != nil {
+		return
+	}
+
+	if os.MkdirAll(filepath.Dir(path), 0700) == nil {
+		os.WriteFile(path, data, 0600)
+	}
+}
+
+// The manifest of the plugin at path, from the cache if the executable hasn't
+// changed since, otherwise from running it
+func cachedPluginManifest(path string) (pluginManifest, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return pluginManifest{}, err
+	}
+
+	if cached, ok := previousToolCache.Plugins[path]; ok && cached.ModTime.Equal(info.ModTime()) && cached.Size == info.Size() {
+		currentToolCache.Plugins[path] = cached
+		return cached.Manifest, nil
+	}
+
+	manifest, err := readPluginManifest(path)
+	if err != nil {
+		return manifest, err
+	}
+
+	currentToolCache.Plugins[path] = cachedManifest{ModTime: info.ModTime(), Size: info.Size(), Manifest: manifest}
+	return manifest, nil
+}
+
+// The tools of the server called name, from the cache if it's fresh and the
+// server's config is the same, otherwise from starting it
+func cachedMCPToolList(name string, server MCPServerConfig) ([]mcpToolInfo, error) {
+	hash := mcpServerHash(server)
+	if cached, ok := previousToolCache.MCPServers[name]; ok && cached.Server == hash && time.Since(cached.Listed) < mcpToolCacheTTL {
+		currentToolCache.MCPServers[name] = cached
+		return cached.Tools, nil
+	}
+
+	infos, err := listMCPTools(name, server)
+	if err != nil {
+		return nil, err
+	}
+
+	currentToolCache.MCPServers[name] = cachedMCPTools{Server: hash, Listed: time.Now(), Tools: infos}
+	return infos, nil
+}
+
+func mcpServerHash(server MCPServerConfig) string {
+	data, _ := json.Marshal(server)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,43 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+)
+
+// Answers with plain information. Off by default, since the model answering
+// with a regular message does the same job. Turn it on with
+// tools.info.enabled in the config.
+type infoTool struct{}
+
+func init() {
+	registerOptionalTool(infoTool{})
+}
+
+func (infoTool) Name() string {
+	return "info"
+}
+
+func (infoTool) Description() string {
+	return "use this if the user asked for information which can not be represented as a bash one liner. ex info(There are 4 quarts in a gallon), info(There have been 46 US presidents). Do not call this with a bash one liner, do not provide a bash one liner with an explanation. If you have a response that's not perfect but is ok, use this."
+}
+
+func (infoTool) Parameters() map[string]any {
+	return stringParameters("str", "The information. NO BASH ONE LINERS. Never call like: info(To do such and such, use this command: <some command>)")
+}
+
+func (infoTool) Guidance() string {
+	return ""
+}
+
+func (infoTool) Payload(arguments string) string {
+	var strObj struct {
+		Str string `json:"str"`
+	}
+
+	json.Unmarshal([]byte(arguments), &strObj)
+	return strObj.Str
+}
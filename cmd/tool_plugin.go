@@ -0,0 +1,185 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Executables on PATH named like this are tools, ex ai-tool-jira_lookup
+const pluginPrefix = "ai-tool-"
+
+// How long a plugin gets to answer --manifest
+const pluginManifestTimeout = 5 * time.Second
+
+// Tool names the apis accept
+var validToolName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// What a plugin prints when run with --manifest
+type pluginManifest struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Parameters  map[string]any `json:"parameters"`
+}
+
+// A tool backed by an ai-tool-* executable. It's run with the model's
+// arguments on stdin, and what it writes to stdout is the answer.
+type pluginTool struct {
+	manifest pluginManifest
+	path     string
+}
+
+func init() {
+	registerToolSource(func() []Tool {
+		return discoverPluginTools(os.Getenv("PATH"))
+	})
+}
+
+// Find the ai-tool-* executables in the dirs of pathList and ask each for its
+// manifest. Ones that don't answer properly are skipped with a warning. The
+// first of a name on the path wins, like with commands.
+func discoverPluginTools(pathList string) []Tool {
+	var tools []Tool
+	seen := map[string]bool{}
+
+	for _, dir := range filepath.SplitList(pathList) {
+		matches, _ := filepath.Glob(filepath.Join(dir, pluginPrefix+"*"))
+		for _, path := range matches {
+			if seen[filepath.Base(path)] || !isExecutable(path) {
+				continue
+			}
+			seen[filepath.Base(path)] = true
+
+			manifest, err := cachedPluginManifest(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "skipping plugin %s: %s\n", path, err)
+				continue
+			}
+
+			tools = append(tools, &pluginTool{manifest: manifest, path: path})
+		}
+	}
+
+	return tools
+}
+
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir() && info.Mode().Perm()&0111 != 0
+}
+
+func readPluginManifest(path string) (pluginManifest, error) {
+	var manifest pluginManifest
+
+	output, err := runPlugin(context.Background(), path, []string{"--manifest"}, nil, pluginManifestTimeout)
+	if err != nil {
+		return manifest, err
+	}
+
+	if err := json.Unmarshal(output, &manifest); err != nil {
+		return manifest, fmt.Errorf("--manifest did not print json: %w", err)
+	}
+
+	// The name defaults to what comes after ai-tool-
+	if manifest.Name == "" {
+		manifest.Name = strings.TrimPrefix(filepath.Base(path), pluginPrefix)
+	}
+	if !validToolName.MatchString(manifest.Name) {
+		return manifest, fmt.Errorf("%q is not a valid tool name", manifest.Name)
+	}
+
+	if manifest.Parameters == nil {
+		manifest.Parameters = map[string]any{"type": "object", "properties": map[string]any{}}
+	}
+
+	return manifest, nil
+}
+
+// Run a plugin, returning its stdout. Exiting non zero or running past
+// timeout is an error, which carries what the plugin said on stderr. The
+// plugin is killed if parent is cancelled, rather than left running.
+func runPlugin(parent context.Context, path string, args []string, stdin io.Reader, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(parent, timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path, args...)
+	cmd.Stdin = stdin
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Don't let a grandchild holding stdout open keep us waiting past the timeout
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+
+	if parent.Err() != nil {
+		return nil, networkError(parent.Err())
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, classifyf(ErrTimeout, "%s timed out after %s", filepath.Base(path), timeout)
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = "no output on stderr"
+		}
+		return nil, fmt.Errorf("%s exited with code %d: %s", filepath.Base(path), exitErr.ExitCode(), message)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stdout.Bytes(), nil
+}
+
+func (p *pluginTool) Name() string {
+	return p.manifest.Name
+}
+
+func (p *pluginTool) Description() string {
+	return p.manifest.Description
+}
+
+func (p *pluginTool) Parameters() map[string]any {
+	return p.manifest.Parameters
+}
+
+func (p *pluginTool) Guidance() string {
+	return ""
+}
+
+func (p *pluginTool) Payload(arguments string) string {
+	return arguments
+}
+
+func (p *pluginTool) Run(ctx context.Context, arguments string, w io.Writer) error {
+	timeout := time.Duration(activeConfig.PluginTimeout) * time.Second
+
+	output, err := runPlugin(ctx, p.path, nil, strings.NewReader(arguments), timeout)
+	if err != nil {
+		return err
+	}
+
+	w.Write(output)
+	if len(output) > 0 && output[len(output)-1] != '\n' {
+		fmt.Fprintln(w)
+	}
+
+	return nil
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const deployStatusPlugin = `#!/bin/sh
+if [ "$1" = "--manifest" ]; then
+  echo '{"name": "deploy_status", "description": "Look up the status of a deploy", "parameters": {"type": "object", "properties": {"service": {"type": "string"}}, "required": ["service"]}}'
+  exit 0
+fi
+read -r args
+echo "deploying, given $args"
+`
+
+func writePlugin(t *testing.T, dir string, name string, script string, mode os.FileMode) {
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(script), mode); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Run tool discovery again against a PATH of only dir, forgetting the tools it
+// found once the test is done
+func discoverWithPath(t *testing.T, dir string) {
+	t.Setenv("PATH", dir)
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	toolSourcesOnce = sync.Once{}
+
+	before := map[string]bool{}
+	for name := range toolRegistry {
+		before[name] = true
+	}
+
+	t.Cleanup(func() {
+		for name := range toolRegistry {
+			if !before[name] {
+				delete(toolRegistry, name)
+			}
+		}
+		toolSourcesOnce = sync.Once{}
+	})
+}
+
+func TestPlugin_Discovery(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "ai-tool-deploy", deployStatusPlugin, 0755)
+	writePlugin(t, dir, "ai-tool-not_executable", deployStatusPlugin, 0644)
+	writePlugin(t, dir, "ai-tool-broken", "#!/bin/sh\necho not json\n", 0755)
+	writePlugin(t, dir, "ai-tool-printz", "#!/bin/sh\necho '{}'\n", 0755)
+
+	discoverWithPath(t, dir)
+
+	names := promptToolNames(buildPrimaryPrompt("is the api deployed?", "gpt-4o", "Linux", nil))
+	joined := strings.Join(names, " ")
+
+	if !strings.Contains(joined, "deploy_status") {
+		t.Errorf("expected deploy_status to be offered to the model, got %v", names)
+	}
+	if strings.Contains(joined, "not_executable") || strings.Contains(joined, "broken") {
+		t.Errorf("expected bad plugins to be skipped, got %v", names)
+	}
+	if strings.Count(joined, "printz") != 1 {
+		t.Errorf("a plugin should not be able to replace printz, got %v", names)
+	}
+
+	tool, _ := lookupTool("deploy_status")
+	if tool.Description() != "Look up the status of a deploy" {
+		t.Errorf("unexpected description %q", tool.Description())
+	}
+}
+
+func TestPlugin_ManifestCached(t *testing.T) {
+	dir := t.TempDir()
+	runs := filepath.Join(t.TempDir(), "runs")
+	script := "#!/bin/sh\necho run >> " + runs + "\n" + strings.TrimPrefix(deployStatusPlugin, "#!/bin/sh\n")
+	writePlugin(t, dir, "ai-tool-deploy", script, 0755)
+
+	discoverWithPath(t, dir)
+	discover := func() {
+		delete(toolRegistry, "deploy_status")
+		toolSourcesOnce = sync.Once{}
+		if _, ok := lookupTool("deploy_status"); !ok {
+			t.Fatal("expected deploy_status to be found")
+		}
+	}
+
+	discover()
+	discover()
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run") != 1 {
+		t.Errorf("expected --manifest to be run once and then cached, got %d runs", strings.Count(string(data), "run"))
+	}
+
+	// A changed plugin is asked again
+	writePlugin(t, dir, "ai-tool-deploy", script+"\n", 0755)
+	discover()
+	if data, _ := os.ReadFile(runs); strings.Count(string(data), "run") != 2 {
+		t.Errorf("expected a changed plugin to be run again, got %d runs", strings.Count(string(data), "run"))
+	}
+}
+
+func TestPlugin_Run(t *testing.T) {
+	dir := t.TempDir()
+	writePlugin(t, dir, "ai-tool-deploy", deployStatusPlugin, 0755)
+	discoverWithPath(t, dir)
+
+	resp := completionFromJson(t, `{"choices": [{"message": {"tool_calls": [{"function": {"name": "deploy_status", "arguments": "{\"service\": \"api\"}"}}]}}]}`)
+
+	var handled bytes.Buffer
+	HandlePrimaryResponse(resp, &handled)
+	if handled.String() != "deploy_status {\"service\": \"api\"}\n" {
+		t.Fatalf("unexpected primary output %q", handled.String())
+	}
+
+	var output bytes.Buffer
+	if err := RunTool(context.Background(), "deploy_status", `{"service": "api"}`, &output); err != nil {
+		t.Fatal(err)
+	}
+	if output.String() != "deploying, given {\"service\": \"api\"}\n" {
+		t.Errorf("expected the plugin's stdout, got %q", output.String())
+	}
+}
+
+func TestPlugin_ExitCodeAndTimeout(t *testing.T) {
+	dir := t.TempDir()
+
+	failing := filepath.Join(dir, "ai-tool-failing")
+	writePlugin(t, dir, "ai-tool-failing", "#!/bin/sh\necho 'jira is down' >&2\nexit 3\n", 0755)
+	_, err := runPlugin(context.Background(), failing, nil, nil, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "exited with code 3: jira is down") {
+		t.Errorf("expected the exit code and stderr in the error, got %v", err)
+	}
+
+	slow := filepath.Join(dir, "ai-tool-slow")
+	writePlugin(t, dir, "ai-tool-slow", "#!/bin/sh\nsleep 10\n", 0755)
+	_, err = runPlugin(context.Background(), slow, nil, nil, 100*time.Millisecond)
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("expected a timeout, got %v", err)
+	}
+}
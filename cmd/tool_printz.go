@@ -0,0 +1,41 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"encoding/json"
+)
+
+// Puts a command onto the user's command buffer, by way of zsh's print -z
+type printzTool struct{}
+
+func init() {
+	registerTool(printzTool{})
+}
+
+func (printzTool) Name() string {
+	return "printz"
+}
+
+func (printzTool) Description() string {
+	return "Use zsh's print -z to place the command on the command buffer. ex: printz(netstat -u), printz(lsof -n)."
+}
+
+func (printzTool) Parameters() map[string]any {
+	return stringParameters("command", "The bash one liner")
+}
+
+func (printzTool) Guidance() string {
+	return "use printz to supply a bash or zsh command, if the user has asked for a command."
+}
+
+func (printzTool) Payload(arguments string) string {
+	var commandObj struct {
+		Command string `json:"command"`
+	}
+
+	json.Unmarshal([]byte(arguments), &commandObj)
+	return commandObj.Command
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"unicode/utf8"
+)
+
+// Providers that can turn text into speech
+type SpeechProvider interface {
+	Speech(ctx context.Context, params map[string]any) ([]byte, error)
+}
+
+// Says something out loud. It works fine, but it's rarely wanted, so it's off
+// unless tools.text_to_speech.enabled is set in the config.
+type textToSpeechTool struct{}
+
+func init() {
+	registerOptionalTool(textToSpeechTool{})
+}
+
+func (textToSpeechTool) Name() string {
+	return "text_to_speech"
+}
+
+func (textToSpeechTool) Description() string {
+	return "text_to_speech({ model: model, input: string, voice: voice }) - call this only if a user is explicitly asking you to say or speak something"
+}
+
+func (textToSpeechTool) Parameters() map[string]any {
+	return stringParameters(
+		"model", "tts-1",
+		"input", "The user input, minus the parts about what model and voice to use.",
+		"voice", "Default to onyx, unless there is a better match among: **alloy** - calm, androgynous, friendly. **echo** - factual, curt, male **fable** - intellectual, British, androgynous **onyx** - male, warm, smiling **nova** - female, humorless, cool **shimmer** - female, cool",
+	)
+}
+
+func (textToSpeechTool) Guidance() string {
+	return "use text_to_speech only when explicitly asked to say or speak something out loud."
+}
+
+func (textToSpeechTool) Payload(arguments string) string {
+	return arguments
+}
+
+func (textToSpeechTool) Run(ctx context.Context, arguments string, w io.Writer) error {
+	path, err := TextToSpeech(ctx, arguments, "")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "Saved speech to", path)
+	exec.Command("open", path).Start()
+
+	return nil
+}
+
+// Have the provider speak the model's text_to_speech arguments, saving the
+// audio to a temp file whose path is returned
+func TextToSpeech(ctx context.Context, arguments string, url string) (string, error) {
+	var params map[string]any
+	if err := json.Unmarshal([]byte(arguments), &params); err != nil {
+		return "", classifyf(ErrBadToolArguments, "unable to parse text_to_speech arguments: %w", err)
+	}
+
+	provider, err := NewProvider(url)
+	if err != nil {
+		return "", err
+	}
+
+	speechProvider, ok := provider.(SpeechProvider)
+	if !ok {
+		return "", fmt.Errorf("%s does not support text to speech", provider.Name())
+	}
+
+	input, _ := params["input"].(string)
+	speechModel, _ := params["model"].(string)
+	usage := UsageEntry{
+		Model:      speechModel,
+		Tool:       "text_to_speech",
+		Characters: utf8.RuneCountInString(input),
+	}
+
+	estimate, _ := usage.Cost()
+	if err := checkBudget(fmt.Sprintf("Speaking %d characters", usage.Characters), estimate); err != nil {
+		return "", err
+	}
+
+	audio, err := withTimeout(ctx, "text_to_speech", activeConfig.Timeouts.Request, func(ctx context.Context) ([]byte, error) {
+		return speechProvider.Speech(ctx, params)
+	})
+	if err != nil {
+		return "", err
+	}
+	recordUsage(usage)
+
+	file, err := os.CreateTemp("", "ai-speech-*.mp3")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(audio); err != nil {
+		return "", err
+	}
+
+	return file.Name(), nil
+}
@@ -0,0 +1,166 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// A function the primary prompt offers the model. Tools add themselves to the
+// registry from an init, and the prompt and HandlePrimaryResponse are both
+// built off of it.
+type Tool interface {
+	Name() string
+	// What the model is told the tool is for. tools.<name>.description in the
+	// config replaces it.
+	Description() string
+	// JSON schema of the tool's arguments
+	Parameters() map[string]any
+	// A system message on when the model should use the tool, or ""
+	Guidance() string
+	// What the shell is handed to act on, given the model's arguments, like
+	// the command for printz. It goes out in a record whose action is the
+	// tool's name.
+	Payload(arguments string) string
+}
+
+// A tool the shell hands back to the go app to finish off, by way of
+// `tool <name> --jsonParams <arguments>`, like crawl_web fetching its page
+type RunnableTool interface {
+	Tool
+	Run(ctx context.Context, arguments string, w io.Writer) error
+}
+
+type registeredTool struct {
+	tool Tool
+	// Only offered to the model when the config enables it
+	optional bool
+}
+
+var toolRegistry = map[string]registeredTool{}
+
+func registerTool(tool Tool) {
+	toolRegistry[tool.Name()] = registeredTool{tool: tool}
+}
+
+// Register a tool that's off unless tools.<name>.enabled is set in the config
+func registerOptionalTool(tool Tool) {
+	toolRegistry[tool.Name()] = registeredTool{tool: tool, optional: true}
+}
+
+// Tools that have to be found rather than compiled in, like plugins on PATH.
+// Sources are only asked for their tools once one is needed, since finding
+// them can mean running things.
+var toolSources []func() []Tool
+var toolSourcesOnce sync.Once
+
+func registerToolSource(source func() []Tool) {
+	toolSources = append(toolSources, source)
+}
+
+// Register the tools of every source. A tool can't take the name of one
+// that's already registered. What the sources find is cached, see toolCache.
+func loadToolSources() {
+	toolSourcesOnce.Do(func() {
+		startToolCache()
+		defer saveToolCache()
+
+		for _, source := range toolSources {
+			for _, tool := range source() {
+				if _, taken := toolRegistry[tool.Name()]; taken {
+					fmt.Fprintf(os.Stderr, "skipping tool %s, there's already a tool by that name\n", tool.Name())
+					continue
+				}
+				registerTool(tool)
+			}
+		}
+	})
+}
+
+// The registered tool called name, enabled or not
+func lookupTool(name string) (Tool, bool) {
+	loadToolSources()
+	registered, ok := toolRegistry[name]
+	return registered.tool, ok
+}
+
+// The tools to offer the model, sorted by name so the prompt is stable
+func enabledTools() []Tool {
+	loadToolSources()
+
+	var tools []Tool
+	for name, registered := range toolRegistry {
+		enabled := !registered.optional
+		if config, ok := activeConfig.Tools[name]; ok && config.Enabled != nil {
+			enabled = *config.Enabled
+		}
+
+		if enabled {
+			tools = append(tools, registered.tool)
+		}
+	}
+
+	sort.Slice(tools, func(i, j int) bool {
+		return tools[i].Name() < tools[j].Name()
+	})
+
+	return tools
+}
+
+// The tool in the shape of a chat completion's tools entry
+func toolDefinition(tool Tool) map[string]any {
+	return map[string]any{
+		"type": "function",
+		"function": map[string]any{
+			"name":        tool.Name(),
+			"description": toolDescription(tool.Name(), tool.Description()),
+			"parameters":  tool.Parameters(),
+		},
+	}
+}
+
+// Finish off a tool call the shell handed back. Failures not classified by
+// the tool itself are tool failures.
+func RunTool(ctx context.Context, name string, arguments string, w io.Writer) error {
+	tool, ok := lookupTool(name)
+	if !ok {
+		return classifyf(ErrUsage, "no tool named %s", name)
+	}
+
+	runnable, ok := tool.(RunnableTool)
+	if !ok {
+		return classifyf(ErrUsage, "%s has nothing more to run", name)
+	}
+
+	if err := runnable.Run(ctx, arguments, w); err != nil {
+		return classify(ErrToolFailed, fmt.Errorf("%s failed: %w", name, err))
+	}
+	return nil
+}
+
+// Shorthand for a tool's parameters: an object of string properties, keyed by
+// name with their descriptions, all of them required
+func stringParameters(properties ...string) map[string]any {
+	props := map[string]any{}
+	var required []string
+	for i := 0; i+1 < len(properties); i += 2 {
+		props[properties[i]] = map[string]any{
+			"type":        "string",
+			"description": properties[i+1],
+		}
+		required = append(required, properties[i])
+	}
+
+	return map[string]any{
+		"type":       "object",
+		"properties": props,
+		"required":   required,
+	}
+}
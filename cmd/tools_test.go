@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+)
+
+func promptToolNames(prompt map[string]any) []string {
+	var names []string
+	for _, tool := range payloadTools(prompt) {
+		names = append(names, tool["function"].(map[string]any)["name"].(string))
+	}
+	return names
+}
+
+func useToolConfig(t *testing.T, tools map[string]ToolConfig) {
+	previous := activeConfig
+	activeConfig.Tools = tools
+	t.Cleanup(func() { activeConfig = previous })
+}
+
+func TestTools_OptionalToolsAreOffByDefault(t *testing.T) {
+	names := promptToolNames(buildPrimaryPrompt("hi", "gpt-4o", "Linux", nil))
+
+	want := []string{"crawl_web", "gen_image", "printz"}
+	if len(names) != len(want) {
+		t.Fatalf("expected tools %v, got %v", want, names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Errorf("expected tools %v, got %v", want, names)
+		}
+	}
+}
+
+func TestTools_ConfigTurnsToolsOnAndOff(t *testing.T) {
+	on, off := true, false
+	useToolConfig(t, map[string]ToolConfig{
+		"info":      {Enabled: &on},
+		"gen_image": {Enabled: &off},
+	})
+
+	prompt := buildPrimaryPrompt("hi", "gpt-4o", "Linux", nil)
+	names := promptToolNames(prompt)
+
+	if len(names) != 3 || names[0] != "crawl_web" || names[1] != "info" || names[2] != "printz" {
+		t.Errorf("expected info on and gen_image off, got %v", names)
+	}
+
+	for _, message := range payloadMessages(prompt) {
+		if content, _ := message["content"].(string); content == (genImageTool{}).Guidance() {
+			t.Errorf("disabled gen_image's guidance is still in the prompt")
+		}
+	}
+}
+
+func TestTools_HandleDispatchesToTheRegistry(t *testing.T) {
+	resp := completionFromJson(t, `{"choices": [{"message": {"tool_calls": [{"function": {"name": "info", "arguments": "{\"str\": \"There are 4 quarts in a gallon\"}"}}]}}]}`)
+
+	var outputBuffer bytes.Buffer
+	HandlePrimaryResponse(resp, &outputBuffer)
+
+	if output := outputBuffer.String(); output != "info There are 4 quarts in a gallon\n" {
+		t.Errorf("unexpected output %q", output)
+	}
+}
+
+func TestTools_RunTool(t *testing.T) {
+	if err := RunTool(context.Background(), "furby", "{}", &bytes.Buffer{}); err == nil {
+		t.Error("expected an error running a tool that doesn't exist")
+	}
+
+	if err := RunTool(context.Background(), "printz", `{"command": "ls"}`, &bytes.Buffer{}); err == nil {
+		t.Error("expected an error running a tool the shell finishes itself")
+	}
+}
+
+func TestTools_TextToSpeech(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+
+	var sentInput any
+	server := localServer(t, "ID3 not really an mp3", func(body map[string]any) {
+		sentInput = body["input"]
+	})
+
+	path, err := TextToSpeech(context.Background(), `{"model": "tts-1", "input": "hello there", "voice": "onyx"}`, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+
+	if sentInput != "hello there" {
+		t.Errorf("expected the input to be sent, got %v", sentInput)
+	}
+
+	audio, _ := os.ReadFile(path)
+	if string(audio) != "ID3 not really an mp3" {
+		t.Errorf("expected the audio to be saved, got %q", audio)
+	}
+}
@@ -0,0 +1,313 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// One call to a provider, as kept in the usage ledger
+type UsageEntry struct {
+	Time       time.Time `json:"time"`
+	Provider   string    `json:"provider"`
+	Model      string    `json:"model"`
+	Subcommand string    `json:"subcommand"`
+	// The fingerprint of the API key the call was made with
+	APIKey string `json:"api_key,omitempty"`
+	// What the call was for, ex primary, crawl_web, notes or gen_image
+	Tool             string `json:"tool"`
+	PromptTokens     int    `json:"prompt_tokens,omitempty"`
+	CompletionTokens int    `json:"completion_tokens,omitempty"`
+	Images           int    `json:"images,omitempty"`
+	ImageSize        string `json:"image_size,omitempty"`
+	// Text to speech is priced by the character
+	Characters int `json:"characters,omitempty"`
+}
+
+// What a model costs, in dollars
+type Price struct {
+	// Per million prompt tokens
+	Input float64 `mapstructure:"input" yaml:"input,omitempty"`
+	// Per million completion tokens
+	Output float64 `mapstructure:"output" yaml:"output,omitempty"`
+	// Per million characters, for text to speech
+	Characters float64 `mapstructure:"characters" yaml:"characters,omitempty"`
+	// Per image, by size
+	Images map[string]float64 `mapstructure:"images" yaml:"images,omitempty"`
+}
+
+// List prices, by model name prefix. The config's prices are added on top.
+var defaultPrices = map[string]Price{
+	"gpt-5":             {Input: 1.25, Output: 10},
+	"gpt-5-mini":        {Input: 0.25, Output: 2},
+	"gpt-5-nano":        {Input: 0.05, Output: 0.4},
+	"gpt-4.1":           {Input: 2, Output: 8},
+	"gpt-4.1-mini":      {Input: 0.4, Output: 1.6},
+	"gpt-4.1-nano":      {Input: 0.1, Output: 0.4},
+	"gpt-4o":            {Input: 2.5, Output: 10},
+	"gpt-4o-mini":       {Input: 0.15, Output: 0.6},
+	"gpt-4-turbo":       {Input: 10, Output: 30},
+	"gpt-4":             {Input: 30, Output: 60},
+	"gpt-3.5-turbo":     {Input: 0.5, Output: 1.5},
+	"o1":                {Input: 15, Output: 60},
+	"o1-mini":           {Input: 1.1, Output: 4.4},
+	"o3":                {Input: 2, Output: 8},
+	"o3-mini":           {Input: 1.1, Output: 4.4},
+	"o4-mini":           {Input: 1.1, Output: 4.4},
+	"claude-opus-4":     {Input: 15, Output: 75},
+	"claude-sonnet-4":   {Input: 3, Output: 15},
+	"claude-3-opus":     {Input: 15, Output: 75},
+	"claude-3-7-sonnet": {Input: 3, Output: 15},
+	"claude-3-5-sonnet": {Input: 3, Output: 15},
+	"claude-3-5-haiku":  {Input: 0.8, Output: 4},
+	"claude-3-haiku":    {Input: 0.25, Output: 1.25},
+	"gemini-2.5-pro":    {Input: 1.25, Output: 10},
+	"gemini-2.5-flash":  {Input: 0.3, Output: 2.5},
+	"gemini-2.0-flash":  {Input: 0.1, Output: 0.4},
+	"gemini-1.5-pro":    {Input: 1.25, Output: 5},
+	"gemini-1.5-flash":  {Input: 0.075, Output: 0.3},
+	"dall-e-2":          {Images: map[string]float64{"256x256": 0.016, "512x512": 0.018, "1024x1024": 0.02}},
+	"dall-e-3":          {Images: map[string]float64{"1024x1024": 0.04, "1024x1792": 0.08, "1792x1024": 0.08}},
+	"tts-1":             {Characters: 15},
+	"tts-1-hd":          {Characters: 30},
+}
+
+// The price of model, from the config if it's there, and whether it has one
+func priceOf(model string) (Price, bool) {
+	prices := map[string]Price{}
+	for name, price := range defaultPrices {
+		prices[name] = price
+	}
+	for name, price := range activeConfig.Prices {
+		prices[name] = price
+	}
+
+	return modelLookup(prices, model)
+}
+
+// What the entry cost in dollars, and whether its model has a price. Local
+// models don't, and cost nothing.
+func (e UsageEntry) Cost() (float64, bool) {
+	price, ok := priceOf(e.Model)
+	if !ok {
+		return 0, false
+	}
+
+	cost := float64(e.PromptTokens)*price.Input/1e6 +
+		float64(e.CompletionTokens)*price.Output/1e6 +
+		float64(e.Characters)*price.Characters/1e6
+
+	if e.Images > 0 {
+		perImage, ok := price.Images[e.ImageSize]
+		if !ok {
+			// An unknown size is priced like the biggest known one
+			for _, sizePrice := range price.Images {
+				perImage = max(perImage, sizePrice)
+			}
+		}
+		cost += float64(e.Images) * perImage
+	}
+
+	return cost, true
+}
+
+// Where the ledger lives unless usage_ledger says otherwise
+func defaultUsageLedgerPath() string {
+	stateHome := os.Getenv("XDG_STATE_HOME")
+	if stateHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		stateHome = filepath.Join(home, ".local", "state")
+	}
+
+	return filepath.Join(stateHome, "ai-functions", "usage.jsonl")
+}
+
+// The subcommand being run, for the ledger
+var usageSubcommand string
+
+var ledgerMu sync.Mutex
+
+// Append an entry to the ledger. Nothing is kept if usage_ledger is empty,
+// which it is until a config is loaded, or "off". Failing to write is only
+// worth a warning, the call has already been made.
+func recordUsage(entry UsageEntry) {
+	path := activeConfig.UsageLedger
+	if path == "" || path == "off" {
+		return
+	}
+
+	entry.Time = time.Now().UTC()
+	if entry.Provider == "" {
+		entry.Provider = selectedProviderName()
+	}
+	if entry.Subcommand == "" {
+		entry.Subcommand = usageSubcommand
+	}
+	if entry.APIKey == "" {
+		entry.APIKey = currentKeyFingerprint()
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	ledgerMu.Lock()
+	defer ledgerMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to record usage:", err)
+		return
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to record usage:", err)
+		return
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to record usage:", err)
+	}
+}
+
+// Record a completion's tokens against tool. Failed calls that still came
+// back with usage are recorded too, they're billed all the same.
+func recordCompletionUsage(tool string, model string, resp *OpenAICompletionResponse) {
+	if resp == nil {
+		return
+	}
+
+	recordUsage(UsageEntry{
+		Model:            model,
+		Tool:             tool,
+		PromptTokens:     resp.Usage.PromptTokens,
+		CompletionTokens: resp.Usage.CompletionTokens,
+	})
+}
+
+// Read the ledger's entries from since on. A missing ledger has none.
+func readUsage(path string, since time.Time) ([]UsageEntry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []UsageEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry UsageEntry
+		// A line cut short by a crash is skipped rather than failing the report
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+		if !entry.Time.Before(since) {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// Spend on one thing, ex a day or a model
+type usageTotal struct {
+	Key      string
+	Calls    int
+	Tokens   int
+	Images   int
+	Cost     float64
+	Unpriced bool
+}
+
+// Total entries up by key, sorted by key
+func totalUsage(entries []UsageEntry, key func(UsageEntry) string) []usageTotal {
+	totals := map[string]*usageTotal{}
+	for _, entry := range entries {
+		k := key(entry)
+		total, ok := totals[k]
+		if !ok {
+			total = &usageTotal{Key: k}
+			totals[k] = total
+		}
+
+		cost, priced := entry.Cost()
+		total.Calls++
+		total.Tokens += entry.PromptTokens + entry.CompletionTokens
+		total.Images += entry.Images
+		total.Cost += cost
+		total.Unpriced = total.Unpriced || !priced
+	}
+
+	var sorted []usageTotal
+	for _, total := range totals {
+		sorted = append(sorted, *total)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+	return sorted
+}
+
+// Write the spend in entries by day, model and tool
+func writeUsageReport(w io.Writer, entries []UsageEntry, since time.Time) {
+	overall := totalUsage(entries, func(UsageEntry) string { return "" })
+	if len(overall) == 0 {
+		fmt.Fprintf(w, "No usage since %s\n", since.Format("2006-01-02"))
+		return
+	}
+	fmt.Fprintf(w, "Since %s: %d calls, %s\n", since.Format("2006-01-02"), overall[0].Calls, formatCost(overall[0]))
+
+	sections := []struct {
+		title string
+		key   func(UsageEntry) string
+	}{
+		{"By day", func(e UsageEntry) string { return e.Time.Local().Format("2006-01-02") }},
+		{"By model", func(e UsageEntry) string { return e.Model }},
+		{"By tool", func(e UsageEntry) string { return e.Tool }},
+		{"By API key", func(e UsageEntry) string {
+			if e.APIKey == "" {
+				return "none"
+			}
+			return e.APIKey
+		}},
+	}
+
+	unpriced := false
+	for _, section := range sections {
+		fmt.Fprintf(w, "\n%s\n", section.title)
+		tw := tabwriter.NewWriter(w, 0, 0, 3, ' ', 0)
+		for _, total := range totalUsage(entries, section.key) {
+			fmt.Fprintf(tw, "%s\t%d calls\t%d tokens\t%d images\t%s\n", total.Key, total.Calls, total.Tokens, total.Images, formatCost(total))
+			unpriced = unpriced || total.Unpriced
+		}
+		tw.Flush()
+	}
+
+	if unpriced {
+		fmt.Fprintln(w, "\n* includes models without a price, counted as free. Add them under prices in the config.")
+	}
+}
+
+func formatCost(total usageTotal) string {
+	cost := fmt.Sprintf("$%.2f", total.Cost)
+	if total.Unpriced {
+		cost += "*"
+	}
+	return cost
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Keep a ledger in a temp dir, returning its path
+func useUsageLedger(t *testing.T) string {
+	previous := activeConfig
+	activeConfig.UsageLedger = filepath.Join(t.TempDir(), "usage.jsonl")
+	t.Cleanup(func() { activeConfig = previous })
+	return activeConfig.UsageLedger
+}
+
+func TestUsage_RecordsCompletions(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	ledger := useUsageLedger(t)
+	usageSubcommand = "primary"
+	t.Cleanup(func() { usageSubcommand = "" })
+
+	server, _ := sequenceServer(t, []string{
+		`{"choices": [{"message": {"content": "hi"}}], "usage": {"prompt_tokens": 120, "completion_tokens": 8}}`,
+	})
+
+	var outputBuffer bytes.Buffer
+	if _, err := RunPrimaryAgent(context.Background(), "gpt-4o-mini", "say hi", "Linux", server.URL, AgentOptions{MaxSteps: 1}, &outputBuffer); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := readUsage(ledger, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one entry, got %+v", entries)
+	}
+
+	entry := entries[0]
+	if entry.Model != "gpt-4o-mini" || entry.Tool != "primary" || entry.Subcommand != "primary" || entry.Provider != "openai" {
+		t.Errorf("unexpected entry %+v", entry)
+	}
+	if entry.PromptTokens != 120 || entry.CompletionTokens != 8 {
+		t.Errorf("expected the response's usage, got %+v", entry)
+	}
+	if time.Since(entry.Time) > time.Minute {
+		t.Errorf("expected a timestamp, got %s", entry.Time)
+	}
+}
+
+func TestUsage_RecordsImages(t *testing.T) {
+	t.Setenv("AI_PROVIDER", "openai")
+	ledger := useUsageLedger(t)
+
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"data": [{"url": "one.biz"}, {"url": "two.biz"}]}`))
+	})
+
+	if _, err := GenImage(context.Background(), "gpt-4o", `{"n": 2, "size": "1792x1024", "model": "dall-e-3", "prompt": "lions"}`, server.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := readUsage(ledger, time.Time{})
+	if len(entries) != 1 || entries[0].Images != 2 || entries[0].ImageSize != "1792x1024" || entries[0].Model != "dall-e-3" || entries[0].Tool != "gen_image" {
+		t.Fatalf("unexpected entries %+v", entries)
+	}
+
+	if cost, _ := entries[0].Cost(); math.Abs(cost-0.16) > 1e-9 {
+		t.Errorf("expected two landscape dall-e-3 images to cost $0.16, got %v", cost)
+	}
+}
+
+func TestUsage_NoLedgerWithoutConfig(t *testing.T) {
+	previous := activeConfig
+	activeConfig.UsageLedger = ""
+	t.Cleanup(func() { activeConfig = previous })
+
+	// Nothing to assert beyond not writing anywhere, which would need a path
+	recordUsage(UsageEntry{Model: "gpt-4o", Tool: "primary", PromptTokens: 1})
+}
+
+func TestUsage_Cost(t *testing.T) {
+	previous := activeConfig
+	activeConfig.Prices = map[string]Price{
+		"gpt-4o-mini": {Input: 1, Output: 2},
+		"llama3.1":    {Input: 0.1, Output: 0.1},
+	}
+	t.Cleanup(func() { activeConfig = previous })
+
+	for _, test := range []struct {
+		entry  UsageEntry
+		cost   float64
+		priced bool
+	}{
+		{UsageEntry{Model: "gpt-4o-2024-08-06", PromptTokens: 1_000_000, CompletionTokens: 100_000}, 3.5, true},
+		{UsageEntry{Model: "gpt-4o-mini", PromptTokens: 1_000_000, CompletionTokens: 1_000_000}, 3, true},
+		{UsageEntry{Model: "llama3.1:8b", PromptTokens: 1_000_000}, 0.1, true},
+		{UsageEntry{Model: "mistral", PromptTokens: 1_000_000}, 0, false},
+		{UsageEntry{Model: "tts-1", Characters: 1000}, 0.015, true},
+	} {
+		cost, priced := test.entry.Cost()
+		if math.Abs(cost-test.cost) > 1e-9 || priced != test.priced {
+			t.Errorf("%s: expected %v (priced %v), got %v (priced %v)", test.entry.Model, test.cost, test.priced, cost, priced)
+		}
+	}
+}
+
+func TestUsage_Report(t *testing.T) {
+	day := time.Date(2026, 10, 17, 12, 0, 0, 0, time.Local)
+	entries := []UsageEntry{
+		{Time: day, Model: "gpt-4o", Tool: "primary", PromptTokens: 1_000_000},
+		{Time: day, Model: "gpt-4o", Tool: "crawl_web", PromptTokens: 200_000, CompletionTokens: 10_000},
+		{Time: day.AddDate(0, 0, 1), Model: "dall-e-2", Tool: "gen_image", Images: 1, ImageSize: "1024x1024"},
+		{Time: day.AddDate(0, 0, 1), Model: "llama3.2", Tool: "primary", PromptTokens: 500},
+	}
+
+	var out bytes.Buffer
+	writeUsageReport(&out, entries, day.AddDate(0, 0, -6))
+	report := out.String()
+
+	for _, want := range []string{
+		"Since 2026-10-11: 4 calls, $3.12*",
+		"2026-10-17   2 calls   1210000 tokens   0 images   $3.10",
+		"2026-10-18   2 calls   500 tokens       1 images   $0.02*",
+		"crawl_web   1 calls   210000 tokens    0 images   $0.60",
+		"llama3.2   1 calls   500 tokens       0 images   $0.00*",
+		"without a price",
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("expected the report to have %q, got:\n%s", want, report)
+		}
+	}
+
+	out.Reset()
+	writeUsageReport(&out, nil, day)
+	if out.String() != "No usage since 2026-10-17\n" {
+		t.Errorf("unexpected empty report %q", out.String())
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright © 2024 Aaron Sullivan (@aaronik) <aar.sully@gmail.com>
+*/
+
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+const maxPageRedirects = 10
+
+// Anything past this much of a page is dropped
+const maxPageBytes = 5 << 20
+
+// A fetched page, boiled down to what's worth reading
+type WebPage struct {
+	// Where the page ended up, after redirects
+	URL      string
+	Title    string
+	Markdown string
+	// The links in the page's content, resolved to absolute urls
+	Links []WebLink
+}
+
+// The page as the model is given it
+func (p *WebPage) String() string {
+	var sb strings.Builder
+	if p.Title != "" {
+		fmt.Fprintf(&sb, "Title: %s\n", p.Title)
+	}
+	fmt.Fprintf(&sb, "URL: %s\n\n%s\n", p.URL, p.Markdown)
+	return sb.String()
+}
+
+// Get the page and pull out its readable content. A var so tests can avoid
+// hitting the web.
+var fetchPage = fetchWebPage
+
+// Fetch the page, giving up after the page timeout, redirects included
+func fetchWebPage(ctx context.Context, pageUrl string) (*WebPage, error) {
+	return withTimeout(ctx, "fetching "+pageUrl, activeConfig.Timeouts.Page, func(ctx context.Context) (*WebPage, error) {
+		return getWebPage(ctx, pageUrl)
+	})
+}
+
+func getWebPage(ctx context.Context, pageUrl string) (*WebPage, error) {
+	shared, err := httpClient()
+	if err != nil {
+		return nil, err
+	}
+
+	// Same proxy and CA bundle as the api requests, but none of their headers,
+	// which are likely credentials
+	client := *shared
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxPageRedirects {
+			return fmt.Errorf("stopped after %d redirects", maxPageRedirects)
+		}
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", pageUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "Mozilla/5.0 (compatible; ai-functions)")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml,text/plain;q=0.9,*/*;q=0.5")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, networkError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return nil, fmt.Errorf("%s returned %s", pageUrl, resp.Status)
+	}
+
+	return readWebPage(resp)
+}
+
+// Decode the response into utf-8, by its header, BOM or meta tag, and turn
+// html into markdown. Other text is passed through as is.
+func readWebPage(resp *http.Response) (*WebPage, error) {
+	contentType := resp.Header.Get("Content-Type")
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	isHTML := mediaType == "" || mediaType == "text/html" || mediaType == "application/xhtml+xml"
+	isText := strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") || strings.HasSuffix(mediaType, "xml")
+	if !isHTML && !isText {
+		return nil, fmt.Errorf("unable to read %s, it's %s", resp.Request.URL, mediaType)
+	}
+
+	body, err := charset.NewReader(io.LimitReader(resp.Body, maxPageBytes), contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	page := &WebPage{URL: resp.Request.URL.String()}
+
+	if !isHTML {
+		text, err := io.ReadAll(body)
+		if err != nil {
+			return nil, err
+		}
+		page.Markdown = strings.TrimSpace(string(text))
+		return page, nil
+	}
+
+	doc, err := html.Parse(body)
+	if err != nil {
+		return nil, err
+	}
+
+	page.Title, page.Markdown, page.Links = htmlToMarkdown(doc, resp.Request.URL)
+
+	return page, nil
+}
@@ -0,0 +1,168 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const articlePage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>Lions | Big Cat Facts</title>
+  <script>var tracking = "should not show up";</script>
+  <style>body { color: red; }</style>
+</head>
+<body>
+  <header><a href="/">Big Cat Facts</a> <a href="/login">Log in</a></header>
+  <nav><ul><li><a href="/tigers">Tigers</a></li><li><a href="/cheetahs">Cheetahs</a></li></ul></nav>
+  <div class="cookie-banner">We use cookies</div>
+  <main>
+    <article>
+      <h1>What color is a lion?</h1>
+      <p>Lions are   <strong>tawny</strong>, a light
+         sandy brown. Read more about <a href="/manes#dark">their manes</a>.</p>
+      <h2>By age</h2>
+      <table>
+        <thead><tr><th>Age</th><th>Color</th></tr></thead>
+        <tbody>
+          <tr><td>Cub</td><td>Spotted</td></tr>
+          <tr><td>Adult</td><td>Tawny</td></tr>
+        </tbody>
+      </table>
+      <ul>
+        <li>Males grow manes</li>
+        <li>White lions are rare</li>
+      </ul>
+      <pre><code>lion --color
+  tawny</code></pre>
+    </article>
+    <aside>Related: <a href="/ads">Buy a lion plushie</a></aside>
+  </main>
+  <footer>Copyright Big Cat Facts</footer>
+</body>
+</html>`
+
+func pageServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestWebPage_ReadableContent(t *testing.T) {
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(articlePage))
+	})
+
+	page, err := fetchWebPage(context.Background(), server.URL+"/lions")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if page.Title != "Lions | Big Cat Facts" {
+		t.Errorf("unexpected title %q", page.Title)
+	}
+
+	for _, want := range []string{
+		"# What color is a lion?",
+		"Lions are **tawny**, a light sandy brown. Read more about their manes.",
+		"## By age",
+		"| Age | Color |\n| --- | --- |\n| Cub | Spotted |\n| Adult | Tawny |",
+		"- Males grow manes\n- White lions are rare",
+		"```\nlion --color\n  tawny\n```",
+	} {
+		if !strings.Contains(page.Markdown, want) {
+			t.Errorf("expected the markdown to contain %q, got:\n%s", want, page.Markdown)
+		}
+	}
+
+	for _, unwanted := range []string{"tracking", "color: red", "Log in", "Tigers", "cookies", "plushie", "Copyright"} {
+		if strings.Contains(page.Markdown, unwanted) {
+			t.Errorf("expected %q to be left out as boilerplate, got:\n%s", unwanted, page.Markdown)
+		}
+	}
+
+	if len(page.Links) != 1 || page.Links[0].URL != server.URL+"/manes" || page.Links[0].Text != "their manes" {
+		t.Errorf("expected only the content's link, resolved, got %+v", page.Links)
+	}
+}
+
+func TestWebPage_Redirects(t *testing.T) {
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<p>Moved here</p>`))
+	})
+
+	page, err := fetchWebPage(context.Background(), server.URL+"/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if page.URL != server.URL+"/new" || page.Markdown != "Moved here" {
+		t.Errorf("expected to land on /new, got %+v", page)
+	}
+}
+
+func TestWebPage_Charsets(t *testing.T) {
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/header":
+			w.Header().Set("Content-Type", "text/html; charset=ISO-8859-1")
+			w.Write([]byte("<p>caf\xe9</p>"))
+		case "/meta":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><head><meta charset=\"windows-1252\"></head><body><p>na\xefve \x93quotes\x94</p></body></html>"))
+		}
+	})
+
+	page, err := fetchWebPage(context.Background(), server.URL+"/header")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Markdown != "café" {
+		t.Errorf("expected the header's charset to be used, got %q", page.Markdown)
+	}
+
+	page, err = fetchWebPage(context.Background(), server.URL+"/meta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Markdown != "naïve “quotes”" {
+		t.Errorf("expected the meta tag's charset to be used, got %q", page.Markdown)
+	}
+}
+
+func TestWebPage_NonHTML(t *testing.T) {
+	server := pageServer(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/notes.txt":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("  plain <b>notes</b>\n"))
+		case "/report.pdf":
+			w.Header().Set("Content-Type", "application/pdf")
+			w.Write([]byte("%PDF-1.4"))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	page, err := fetchWebPage(context.Background(), server.URL+"/notes.txt")
+	if err != nil || page.Markdown != "plain <b>notes</b>" {
+		t.Errorf("expected plain text to pass through, got %+v, %v", page, err)
+	}
+
+	if _, err := fetchWebPage(context.Background(), server.URL+"/report.pdf"); err == nil {
+		t.Error("expected an error reading a pdf")
+	}
+
+	if _, err := fetchWebPage(context.Background(), server.URL+"/missing"); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("expected a 404 error, got %v", err)
+	}
+}
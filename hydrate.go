@@ -5,6 +5,7 @@ package main
 
 import (
 	"aaronik/ai/cmd"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -23,18 +24,21 @@ func main() {
 
 	// Iterate through each prompt, populating the json file for each response
 	var wg sync.WaitGroup
+	var mu sync.Mutex
 	fmt.Println("hydrating...")
 	for _, promptTestDatum := range cmd.PromptTestData {
 		wg.Add(1)
 		go func(promptTestDatum cmd.PromptTestDatum) {
 			defer wg.Done()
 			userInput := promptTestDatum.UserInput
-			obj, err := cmd.PerformPrimaryRequest(model, userInput, systemContent, "")
+			obj, err := cmd.PerformPrimaryRequest(context.Background(), model, userInput, systemContent, "")
 			fmt.Println("hydration complete for:", userInput)
 			if err != nil {
 				log.Fatal("Primary Request failed:", err)
 			}
+			mu.Lock()
 			responsesJson[userInput] = obj
+			mu.Unlock()
 		}(promptTestDatum)
 	}
 	wg.Wait()
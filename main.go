@@ -4,8 +4,25 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 */
 package main
 
-import "aaronik/ai/cmd"
+import (
+	_ "embed"
+
+	"aaronik/ai/cmd"
+)
+
+// The ai function for each shell, printed by `ai-functions shell-init`
+var (
+	//go:embed ai.bash
+	bashIntegration string
+	//go:embed ai.zsh
+	zshIntegration string
+	//go:embed ai.fish
+	fishIntegration string
+)
 
 func main() {
+	cmd.RegisterShellIntegration("bash", bashIntegration)
+	cmd.RegisterShellIntegration("zsh", zshIntegration)
+	cmd.RegisterShellIntegration("fish", fishIntegration)
 	cmd.Execute()
 }
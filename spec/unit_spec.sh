@@ -5,6 +5,12 @@
 
 Include ./ai.zsh
 
+# Stands in for building the go app, so the ai-functions mocks below are what
+# gets run
+function _ai_bin() {
+  echo ai-functions
+}
+
 # So running this integration suite is cheaper
 export OPENAI_API_MODEL=gpt-3.5-turbo-0125
 
@@ -12,6 +18,17 @@ function function_exists() {
   type "$1" >/dev/null 2>&1
 }
 
+# Write a record the way the go app does with --output_format nul: the
+# version, action and payload, then any key=value metadata, then an empty field
+function record() {
+  printf '1\0%s\0%s\0' "$1" "$2"
+  shift 2
+  for metadata in "$@"; do
+    printf '%s\0' "$metadata"
+  done
+  printf '\0'
+}
+
 # Test env
 Describe 'The test environment itself'
   It 'has OPENAI_API_MODEL set to 3.5'
@@ -28,69 +45,61 @@ End
 
 # Deps
 Describe 'When being called without the requisite dependencies'
-  It 'does not continue without programs'
+  It 'does not build the app without go'
+    # The real _ai_bin, with the source always newer than the build
+    source ./ai.zsh
+    find() {
+      echo ./cmd
+    }
     which() {
       false
     }
 
     When call ai "blah"
     The status should be failure
-    The output should include 'ai requires `go` and `lynx`'
+    The error should include 'ai requires `go`'
   End
 
-  It 'does not continue without OPENAI_API_KEY'
+  It 'leaves OPENAI_API_KEY to the go app, since the config can pick another provider'
     unset OPENAI_API_KEY
+    ai-functions() {
+      record printz "ollama list"
+    }
 
     When call ai "blah"
-    The status should be failure
-    The output should include 'OPENAI_API_KEY'
-  End
-
-  It 'does not continue with blank OPENAI_API_KEY'
-    export OPENAI_API_KEY=""
-
-    When call ai "blah"
-    The status should be failure
-    The output should include 'OPENAI_API_KEY'
+    The status should be success
+    The output should include 'ollama list'
   End
 End
 
-# System
-Describe 'System information'
-  uname() {
-    if [ "$1" = "-a" ]; then
-      echo "Linux"
+# Shell
+Describe 'The shell'
+  ai-functions() {
+    if [[ "$*" =~ "ask --output_format nul --shell zsh" ]]; then
+      record info works
     else
-      echo "whatevs"
+      record error "no shell" class=other
     fi
   }
 
-  go() {
-    if [[ "$*" =~ --system_content.*Linux.* ]]; then
-      echo "info works"
-    else
-      echo "error no system content"
-    fi
-  }
-
-  It 'Is included'
+  It 'Is passed along, for the go app to tell the model'
     When call ai "blah"
     The status should be success
-    The output should be defined
+    The output should eq "works"
   End
 End
 
 # Pipes
 Describe 'When data is piped in'
-  go() {
-    if [[ "$*" =~ "ADDITIONAL CONTEXT: additional context" ]]; then
-      echo "info works"
+  ai-functions() {
+    if [[ "$(cat -)" == "additional context" ]]; then
+      record info works
     else
-      echo "error additional context not detected"
+      record error "additional context not detected" class=other
     fi
   }
 
-  It "It includes it under the heading ADDITIONAL CONTEXT"
+  It "It leaves it on stdin for the app to read as context"
     When call eval 'echo "additional context" | ai "blah"'
     The status should be success
     The output should eq "works"
@@ -99,11 +108,11 @@ End
 
 # Model
 Describe 'When a model is specified via OPENAI_API_MODEL'
-  go() {
+  ai-functions() {
     if [[ "$*" =~ " --model furby " ]]; then
-      echo "info works"
+      record info works
     else
-      echo "error model didnt work"
+      record error "model didnt work" class=other
     fi
   }
 
@@ -117,15 +126,15 @@ End
 
 # Received non function message
 Describe 'When answering with a message'
-  go() {
-    if [[ "$*" =~ "primary" ]]; then
-      echo "message hello"
+  ai-functions() {
+    if [[ "$*" =~ "ask" ]]; then
+      record message hello
     else
       echo "ERROR: go called with unknown params"
     fi
   }
 
-  It "It calls the go app's crawl_web subcommand"
+  It "Prints it"
     When call ai "blah"
     The status should be success
     The output should eq "hello"
@@ -134,24 +143,40 @@ End
 
 # Received error
 Describe 'When error from api'
-  go() {
-    if [[ "$*" =~ "primary" ]]; then
-      echo "error hello"
+  ai-functions() {
+    if [[ "$*" =~ "ask" ]]; then
+      record error hello class=api exit_code=9
     else
       echo "ERROR: go called with unknown params"
     fi
   }
 
-  It "It calls the go app's error subcommand"
+  It "Reports it"
+    When call ai "blah"
+    The status should be failure
+    The stderr should include "ai: hello"
+  End
+End
+
+# Failed go app, with its error record
+Describe 'When the go app fails'
+  ai-functions() {
+    echo "retrying in 1s" >&2
+    record error "Incorrect API key provided" class=auth exit_code=4
+    return 4
+  }
+
+  It 'Reports the message and a hint for its class'
     When call ai "blah"
     The status should be failure
-    The stderr should include hello
+    The stderr should include "ai: Incorrect API key provided"
+    The stderr should include "check the API key"
   End
 End
 
 # Unexpected go app response
-Describe 'When encountering an unexpected response from the go primary request'
-  go() {
+Describe 'When encountering an unexpected response from the go app'
+  ai-functions() {
     echo "nonextentfunction"
   }
 
@@ -164,12 +189,12 @@ End
 
 # Tests print -z
 Describe 'When asked for a bash one liner'
-  go() {
-    echo "printz works"
+  ai-functions() {
+    record printz works arguments='{"command": "works"}'
   }
 
   print() {
-    if [ "$1" = "-z" ] && [ "$2" = "works" ]; then
+    if [ "$1" = "-rz" ] && [ "$3" = "works" ]; then
       true
     else
       false
@@ -182,14 +207,34 @@ Describe 'When asked for a bash one liner'
   End
 End
 
+# Tests a printz spanning lines, with characters print would otherwise expand
+Describe 'When asked for a multi line command'
+  ai-functions() {
+    record printz $'for f in *.log; do\n  printf "%s\\n" "$f"\ndone'
+  }
+
+  print() {
+    if [ "$1" = "-rz" ] && [ "$3" = $'for f in *.log; do\n  printf "%s\\n" "$f"\ndone' ]; then
+      true
+    else
+      false
+    fi
+  }
+
+  It 'Is put on the command buffer whole'
+    When call ai "blah"
+    The status should be success
+  End
+End
+
 # Tests info
 Describe 'When asked for an info'
-  go() {
-    printf "info works"
+  ai-functions() {
+    record info works
   }
 
-  echo() {
-    if [ "$1" = "works" ]; then
+  print() {
+    if [ "$1" = "-r" ] && [ "$3" = "works" ]; then
       true
     else
       false
@@ -202,40 +247,47 @@ Describe 'When asked for an info'
   End
 End
 
-# Tests gen_image
-Describe 'When asked for an image'
-  go() {
-    if [[ "$*" =~ "primary" ]]; then
-      echo "gen_image params"
-    elif [[ "$*" =~ "gen_image" ]] && [[ "$*" =~ "--jsonParams params" ]]; then
-      printf "coming from inside the go app"
+# Tests tools run by the go app, like gen_image and crawl_web
+Describe 'When the model picks a tool'
+  ai-functions() {
+    if [[ "$*" =~ "ask" ]]; then
+      record message "coming from inside the go app" tool=crawl_web arguments=params
     else
       echo "ERROR: go called with unknown params"
     fi
   }
 
-  It "It calls the go app's gen_image subcommand"
+  It "Prints what the go app's run of it printed"
     When call ai "blah"
     The status should be success
     The output should eq "coming from inside the go app"
   End
 End
 
-# Tests crawl_web
-Describe 'When asked to crawl the web'
-  go() {
-    if [[ "$*" =~ "primary" ]]; then
-      echo "crawl_web params"
-    elif [[ "$*" =~ "crawl_web" ]] && [[ "$*" =~ "--jsonParams params" ]]; then
-      printf "coming from inside the go app"
-    else
-      echo "ERROR: go called with unknown params"
-    fi
+# Tests what a tool prints, shown as the go app streams it
+Describe 'When the go app streams what a tool prints'
+  ai-functions() {
+    record message_part "The first "
+    record message_part $'headline\n'
+    record message "The first headline" arguments=params streamed=true tool=crawl_web
   }
 
-  It "It calls the go app's crawl_web subcommand"
+  It 'Prints it as it arrives, and only once'
     When call ai "blah"
     The status should be success
-    The output should eq "coming from inside the go app"
+    The output should eq "The first headline"
+  End
+End
+
+# Tests an action the shell doesn't know
+Describe 'When handed an action to finish off'
+  ai-functions() {
+    record crawl_web params
+  }
+
+  It 'Errors to stderr, since the go app runs tools itself'
+    When call ai "blah"
+    The status should be failure
+    The stderr should include "errored - received unexpected response from go app: crawl_web params"
   End
 End